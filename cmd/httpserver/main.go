@@ -1,17 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/fileserver"
+	"github/Flarenzy/learn-http-protocol-golang/internal/http2"
+	"github/Flarenzy/learn-http-protocol-golang/internal/proxy"
 	"github/Flarenzy/learn-http-protocol-golang/internal/request"
 	"github/Flarenzy/learn-http-protocol-golang/internal/response"
 	"github/Flarenzy/learn-http-protocol-golang/internal/server"
+	"github/Flarenzy/learn-http-protocol-golang/internal/sse"
+	"github/Flarenzy/learn-http-protocol-golang/internal/websocket"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 const port = 42069
 
+const shutdownTimeout = 30 * time.Second
+
 const badRequestResponse = `
 <html>
   <head>
@@ -48,73 +61,175 @@ const okResponse = `
 </html>
 `
 
-func handleRequest(w *response.Writter, r *request.Request) {
-	if r == nil {
+func writeHTML(w *response.Writter, statusCode response.StatusCode, body string) {
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		log.Printf("error writting status line to connection with status %d", statusCode)
 		return
 	}
-	switch r.RequestLine.RequestTarget {
-	case "/yourproblem":
-		err := w.WriteStatusLine(400)
-		if err != nil {
-			log.Print("error writting status line to connection with status 400")
-			return
-		}
-		headers := response.GetDefaultHeaders(len(badRequestResponse))
-		headers.Set("Content-Type", "text/html")
-		err = w.WriteHeaders(headers)
-		if err != nil {
-			log.Print("error writting headers to connection with status 400")
-		}
-		_, err = w.WriteBody([]byte(badRequestResponse))
-		if err != nil {
-			log.Print("error writting body to connection with status 400")
-		}
+	headers := response.GetDefaultHeaders(len(body))
+	headers.Set("Content-Type", "text/html")
+	err = w.WriteHeaders(headers)
+	if err != nil {
+		log.Printf("error writting headers to connection with status %d", statusCode)
+	}
+	_, err = w.WriteBody([]byte(body))
+	if err != nil {
+		log.Printf("error writting body to connection with status %d", statusCode)
+	}
+}
+
+func handleYourProblem(w *response.Writter, r *request.Request) {
+	writeHTML(w, response.StatusBadRequest, badRequestResponse)
+}
+
+func handleMyProblem(w *response.Writter, r *request.Request) {
+	writeHTML(w, response.StatusInternalServerError, internalErrorResponse)
+}
+
+func handleOK(w *response.Writter, r *request.Request) {
+	writeHTML(w, response.StatusOk, okResponse)
+}
+
+func handleWebSocket(w *response.Writter, r *request.Request) {
+	ws, err := websocket.Upgrade(w, r, websocket.Options{EnableCompression: true})
+	if err != nil {
+		log.Printf("ERROR: websocket upgrade failed: %s", err)
 		return
-	case "/myproblem":
-		err := w.WriteStatusLine(500)
+	}
+	for {
+		mt, msg, err := ws.ReadMessage()
 		if err != nil {
-			log.Print("error writting status line to connection with status 500")
 			return
 		}
-		headers := response.GetDefaultHeaders(len(internalErrorResponse))
-		headers.Set("Content-Type", "text/html")
-		err = w.WriteHeaders(headers)
-		if err != nil {
-			log.Print("error writting headers to connection with status 500")
-		}
-		_, err = w.WriteBody([]byte(internalErrorResponse))
-		if err != nil {
-			log.Print("error writting body to connection with status 500")
-		}
-	default:
-		err := w.WriteStatusLine(200)
-		if err != nil {
-			log.Print("error writting status line to connection with status 200")
+		if err := ws.WriteMessage(mt, msg); err != nil {
+			log.Printf("ERROR: unable to write websocket message: %s", err)
 			return
 		}
-		headers := response.GetDefaultHeaders(len(okResponse))
-		headers.Set("Content-Type", "text/html")
-		err = w.WriteHeaders(headers)
-		if err != nil {
-			log.Print("error writting headers to connection with status 200")
-		}
-		_, err = w.WriteBody([]byte(okResponse))
-		if err != nil {
-			log.Print("error writting body to connection with status 200")
-		}
+	}
+}
+
+func handleEvents(w *response.Writter, r *request.Request) {
+	stream, err := sse.New(w, r, sse.Options{WriteTimeout: 10 * time.Second})
+	if err != nil {
+		log.Printf("ERROR: unable to start event stream: %s", err)
 		return
 	}
+	defer stream.Close()
+	id := 0
+	if n, err := strconv.Atoi(stream.LastEventID()); err == nil {
+		id = n
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			id++
+			err := stream.Send(sse.Event{ID: strconv.Itoa(id), Event: "tick", Data: now.Format(time.RFC3339)})
+			if err != nil {
+				return
+			}
+		case <-stream.Done():
+			return
+		}
+	}
 }
 
 func main() {
-	server, err := server.Serve(port, handleRequest)
+	router := server.NewRouter()
+	router.Use(server.RequestID, server.Compress, server.WantDigest, server.Conditional)
+	router.Get("/yourproblem", handleYourProblem)
+	router.Get("/myproblem", handleMyProblem)
+	upstreams := []string{"https://httpbin.org"}
+	if v := os.Getenv("PROXY_UPSTREAMS"); v != "" {
+		upstreams = strings.Split(v, ",")
+	}
+	httpbin, err := proxy.New(proxy.Config{
+		Upstreams:   upstreams,
+		StripPrefix: "/httpbin",
+		Timeout:     30 * time.Second,
+		Strategy:    proxy.LeastConnections,
+		MaxFails:    3,
+		Retries:     1,
+		Digests:     &response.DigestOptions{LegacyFields: true},
+	})
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		log.Fatalf("Error configuring proxy: %v", err)
+	}
+	defer httpbin.Close()
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"} {
+		router.Handle(method, "/httpbin/{path...}", httpbin.ServeRequest)
 	}
-	defer server.Close()
+	staticDir := "assets"
+	if v := os.Getenv("STATIC_DIR"); v != "" {
+		staticDir = v
+	}
+	files := fileserver.New(fileserver.Dir(staticDir), fileserver.Options{StripPrefix: "/static"})
+	router.Get("/static/{path...}", files.ServeRequest)
+	router.Get("/video", func(w *response.Writter, r *request.Request) {
+		files.ServeFile(w, r, "vim.mp4")
+	})
+	router.Get("/ws", handleWebSocket)
+	router.Get("/events", handleEvents)
+	router.Get("/{path...}", handleOK)
+	cfg := server.Config{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: server.Logger(router.ServeRequest),
+		Timeouts: server.Timeouts{
+			ReadHeader: 10 * time.Second,
+			Read:       30 * time.Second,
+			Write:      2 * time.Minute,
+			Idle:       time.Minute,
+		},
+		Limits: server.Limits{
+			MaxConns:          1024,
+			MaxActiveRequests: 256,
+			QueueTimeout:      100 * time.Millisecond,
+		},
+		MaxBodyBytes: 10 << 20,
+		// proxied bodies go upstream as they arrive
+		StreamRequestBody: func(req *request.Request) bool {
+			return strings.HasPrefix(req.Path(), "/httpbin/")
+		},
+		HTTP2: &http2.Config{H2C: true},
+	}
+	if certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"); certFile != "" && keyFile != "" {
+		cfg.TLS = &server.TLSConfig{
+			Certificates:  []server.CertFile{{CertFile: certFile, KeyFile: keyFile}},
+			WatchInterval: 30 * time.Second,
+		}
+	}
+	srv, err := server.New(cfg)
+	if err != nil {
+		log.Fatalf("Error configuring server: %v", err)
+	}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, server.ErrServerClosed) {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
 	log.Println("Server started on port", port)
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if cfg.TLS == nil {
+			continue
+		}
+		if err := srv.ReloadCertificates(); err != nil {
+			log.Printf("Error reloading certificates: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error during shutdown, forced close: %v", err)
+		srv.Close()
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
@@ -0,0 +1,287 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRanges bounds how many ranges one request may ask for before the
+// Range header is ignored and the whole content sent instead.
+const maxRanges = 100
+
+var (
+	errMalformedRange = errors.New("malformed range")
+	errUnsatisfiable  = errors.New("range not satisfiable")
+)
+
+// Content is a seekable representation served by ServeContent.
+type Content struct {
+	// Type is sent as Content-Type, and per part for multiple ranges.
+	Type string
+	Size int64
+	// ModTime and ETag are the validators checked against If-Range. Zero
+	// values are not sent.
+	ModTime time.Time
+	ETag    string
+	Body    io.ReadSeeker
+}
+
+func (c Content) headers() headers.Headers {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", c.Type)
+	if c.ETag != "" {
+		h.Set("ETag", c.ETag)
+	}
+	if !c.ModTime.IsZero() {
+		h.Set("Last-Modified", c.ModTime.UTC().Format(http.TimeFormat))
+	}
+	return h
+}
+
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// ServeContent answers req with c. Conditional requests are answered
+// with 304 or 412 where their preconditions fail. GET requests with a
+// Range header get the parts asked for: one range as a plain 206, several
+// as multipart/byteranges, and 416 when none of them overlaps the content.
+func ServeContent(w *response.Writter, req *request.Request, c Content) {
+	w.EnablePreconditions(req.RequestLine.Method, req.Headers)
+	h := c.headers()
+	h.Set("Accept-Ranges", "bytes")
+
+	// preconditions come before Range; a failing one leaves the full
+	// response for the writer to turn into a 304 or 412
+	revalidate := response.CheckPreconditions(req.RequestLine.Method, req.Headers, c.ETag, c.ModTime) != 0
+	var ranges []byteRange
+	if spec := req.Headers.Get("Range"); spec != "" && req.RequestLine.Method == "GET" && !revalidate && ifRange(req, c) {
+		var err error
+		ranges, err = parseRange(spec, c.Size)
+		switch {
+		case errors.Is(err, errUnsatisfiable):
+			// the error body isn't the content, so none of its fields apply
+			eh := headers.NewHeaders()
+			eh.Set("Content-Range", "bytes */"+strconv.FormatInt(c.Size, 10))
+			response.WriteText(w, response.StatusRangeNotSatisfiable, eh, response.StatusRangeNotSatisfiable.String()+"\n")
+			return
+		case err != nil:
+			// a Range we can't make sense of is ignored
+			ranges = nil
+		}
+	}
+	switch len(ranges) {
+	case 0:
+		sendRange(w, h, c, response.StatusOk, byteRange{0, c.Size})
+	case 1:
+		h.Set("Content-Range", ranges[0].contentRange(c.Size))
+		sendRange(w, h, c, response.StatusPartialContent, ranges[0])
+	default:
+		sendMultipart(w, h, c, ranges)
+	}
+}
+
+func sendRange(w *response.Writter, h headers.Headers, c Content, statusCode response.StatusCode, r byteRange) {
+	if _, err := c.Body.Seek(r.start, io.SeekStart); err != nil {
+		log.Printf("ERROR: unable to seek content. %s\n", err.Error())
+		response.WriteText(w, response.StatusInternalServerError, nil, response.StatusInternalServerError.String()+"\n")
+		return
+	}
+	h.Set("Content-Length", strconv.FormatInt(r.length, 10))
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if _, err := w.WriteBodyFrom(c.Body); err != nil {
+		log.Printf("ERROR: unable to send content. %s\n", err.Error())
+	}
+}
+
+func sendMultipart(w *response.Writter, h headers.Headers, c Content, ranges []byteRange) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	// the parts are measured up front so the body can have a length
+	var n countingWriter
+	cw := multipart.NewWriter(&n)
+	cw.SetBoundary(mw.Boundary())
+	for _, r := range ranges {
+		cw.CreatePart(partHeader(c, r))
+		n += countingWriter(r.length)
+	}
+	cw.Close()
+
+	h.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	h.Set("Content-Length", strconv.FormatInt(int64(n), 10))
+	if err := w.WriteStatusLine(response.StatusPartialContent); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, r := range ranges {
+			part, err := mw.CreatePart(partHeader(c, r))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := c.Body.Seek(r.start, io.SeekStart); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.CopyN(part, c.Body, r.length); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+	if _, err := w.WriteBodyFrom(pr); err != nil {
+		log.Printf("ERROR: unable to send ranges. %s\n", err.Error())
+	}
+	// unblock the writer if sending stopped early, and keep it from
+	// reading c.Body after we return
+	pr.Close()
+	<-done
+}
+
+func partHeader(c Content, r byteRange) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	if c.Type != "" {
+		h.Set("Content-Type", c.Type)
+	}
+	h.Set("Content-Range", r.contentRange(c.Size))
+	return h
+}
+
+type countingWriter int64
+
+func (n *countingWriter) Write(p []byte) (int, error) {
+	*n += countingWriter(len(p))
+	return len(p), nil
+}
+
+// ifRange reports whether req's If-Range, if any, still matches c, so that
+// its Range may be honoured.
+func ifRange(req *request.Request, c Content) bool {
+	v := strings.TrimSpace(req.Headers.Get("If-Range"))
+	if v == "" {
+		return true
+	}
+	if strings.HasPrefix(v, `"`) {
+		// only strong validators may be used
+		return c.ETag != "" && !strings.HasPrefix(c.ETag, "W/") && v == c.ETag
+	}
+	if strings.HasPrefix(v, "W/") || c.ModTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(v)
+	return err == nil && t.Unix() == c.ModTime.Unix()
+}
+
+// parseRange parses a Range header value against content of size bytes.
+// Ranges lying wholly past the end are dropped; if that leaves none,
+// errUnsatisfiable is returned.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok {
+		return nil, errMalformedRange
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts) > maxRanges {
+		return nil, errMalformedRange
+	}
+	var ranges []byteRange
+	var sum int64
+	seen := false
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		seen = true
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, errMalformedRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		var r byteRange
+		if first == "" {
+			// suffix range: the last n bytes
+			n, ok := parseDigits(last)
+			if !ok {
+				return nil, errMalformedRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = byteRange{size - n, n}
+		} else {
+			start, ok := parseDigits(first)
+			if !ok {
+				return nil, errMalformedRange
+			}
+			end := size - 1
+			if last != "" {
+				e, ok := parseDigits(last)
+				if !ok || e < start {
+					return nil, errMalformedRange
+				}
+				end = min(e, end)
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start, end - start + 1}
+		}
+		ranges = append(ranges, r)
+		sum += r.length
+	}
+	if !seen {
+		return nil, errMalformedRange
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	if sum > size {
+		// overlapping ranges would send more than the whole; refuse to
+		// be used as an amplifier
+		return nil, errMalformedRange
+	}
+	return ranges, nil
+}
+
+func parseDigits(s string) (int64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
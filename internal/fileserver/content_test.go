@@ -0,0 +1,160 @@
+package fileserver
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		spec   string
+		ranges []byteRange
+		err    error
+	}{
+		{"bytes=0-4", []byteRange{{0, 5}}, nil},
+		{"bytes=5-", []byteRange{{5, 5}}, nil},
+		{"bytes=-3", []byteRange{{7, 3}}, nil},
+		{"bytes=-30", []byteRange{{0, 10}}, nil},
+		{"bytes=8-20", []byteRange{{8, 2}}, nil},
+		{"bytes= 0-1 , 4-5", []byteRange{{0, 2}, {4, 2}}, nil},
+		{"bytes=0-1,20-30", []byteRange{{0, 2}}, nil},
+		{"bytes=10-", nil, errUnsatisfiable},
+		{"bytes=-0", nil, errUnsatisfiable},
+		{"bytes=", nil, errMalformedRange},
+		{"bytes=5-1", nil, errMalformedRange},
+		{"bytes=a-b", nil, errMalformedRange},
+		{"bytes=+1-2", nil, errMalformedRange},
+		{"items=0-1", nil, errMalformedRange},
+		{"bytes=0-9,0-9", nil, errMalformedRange},
+	}
+	for _, tt := range tests {
+		ranges, err := parseRange(tt.spec, 10)
+		assert.ErrorIs(t, err, tt.err, tt.spec)
+		assert.Equal(t, tt.ranges, ranges, tt.spec)
+	}
+}
+
+func TestServeContentRanges(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"data.txt":     {Data: []byte("0123456789abcdef"), ModTime: modTime},
+		"embedded.txt": {Data: []byte("0123456789abcdef")},
+	}
+	base := "http://" + startServer(t, New(fsys, Options{}))
+	fetchFile := func(name string, h map[string]string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", base+"/"+name, nil)
+		require.NoError(t, err)
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+	fetch := func(h map[string]string) (*http.Response, string) {
+		t.Helper()
+		return fetchFile("data.txt", h)
+	}
+
+	// Test: full responses advertise range support
+	resp, body := fetch(nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "0123456789abcdef", body)
+	etag := resp.Header.Get("ETag")
+
+	// Test: single range
+	resp, body = fetch(map[string]string{"Range": "bytes=2-5"})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "bytes 2-5/16", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "4", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "2345", body)
+
+	// Test: suffix range
+	resp, body = fetch(map[string]string{"Range": "bytes=-4"})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "bytes 12-15/16", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "cdef", body)
+
+	// Test: multiple ranges as multipart/byteranges
+	resp, body = fetch(map[string]string{"Range": "bytes=0-1,-2"})
+	assert.Equal(t, 206, resp.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	assert.Equal(t, resp.Header.Get("Content-Length"), strconv.Itoa(len(body)))
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(p)
+		require.NoError(t, err)
+		assert.Equal(t, "text/plain; charset=utf-8", p.Header.Get("Content-Type"))
+		parts = append(parts, p.Header.Get("Content-Range")+" "+string(data))
+	}
+	assert.Equal(t, []string{"bytes 0-1/16 01", "bytes 14-15/16 ef"}, parts)
+
+	// Test: unsatisfiable ranges are 416
+	resp, _ = fetch(map[string]string{"Range": "bytes=16-"})
+	assert.Equal(t, 416, resp.StatusCode)
+	assert.Equal(t, "bytes */16", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Empty(t, resp.Header.Get("ETag"))
+
+	// Test: malformed ranges are ignored
+	resp, body = fetch(map[string]string{"Range": "bytes=x-y"})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "0123456789abcdef", body)
+
+	// Test: If-Range with the current validators lets the range through
+	resp, _ = fetchFile("embedded.txt", nil)
+	strongETag := resp.Header.Get("ETag")
+	resp, body = fetchFile("embedded.txt", map[string]string{"Range": "bytes=0-0", "If-Range": strongETag})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "0", body)
+	resp, _ = fetch(map[string]string{"Range": "bytes=0-0", "If-Range": "Wed, 01 May 2024 12:00:00 GMT"})
+	assert.Equal(t, 206, resp.StatusCode)
+
+	// Test: weak validators can't be used with If-Range
+	resp, _ = fetch(map[string]string{"Range": "bytes=0-0", "If-Range": etag})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: a stale If-Range gets the whole content
+	resp, body = fetch(map[string]string{"Range": "bytes=0-0", "If-Range": `"stale"`})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "0123456789abcdef", body)
+	resp, _ = fetch(map[string]string{"Range": "bytes=0-0", "If-Range": "Thu, 02 May 2024 12:00:00 GMT"})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: cached copies are revalidated, ranges or not
+	resp, body = fetch(map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 304, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	resp, _ = fetch(map[string]string{"Range": "bytes=0-1", "If-Modified-Since": "Wed, 01 May 2024 12:00:00 GMT"})
+	assert.Equal(t, 304, resp.StatusCode)
+	resp, _ = fetch(map[string]string{"If-Match": `"other"`})
+	assert.Equal(t, 412, resp.StatusCode)
+	resp, _ = fetch(map[string]string{"Range": "bytes=100-", "If-None-Match": etag})
+	assert.Equal(t, 304, resp.StatusCode)
+	resp, _ = fetch(map[string]string{"Range": "bytes=100-", "If-Match": `"other"`})
+	assert.Equal(t, 412, resp.StatusCode)
+}
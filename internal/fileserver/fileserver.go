@@ -0,0 +1,286 @@
+// Package fileserver serves files from a directory or any fs.FS, such as an
+// embed.FS.
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sniffLen is how much of a file is looked at to guess its type when the
+// extension doesn't tell.
+const sniffLen = 512
+
+// extraTypes covers common extensions missing from mime's built-in table
+// on systems without a mime.types file.
+var extraTypes = map[string]string{
+	".mp4":   "video/mp4",
+	".webm":  "video/webm",
+	".mp3":   "audio/mpeg",
+	".ogg":   "audio/ogg",
+	".txt":   "text/plain; charset=utf-8",
+	".md":    "text/markdown; charset=utf-8",
+	".ico":   "image/vnd.microsoft.icon",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+}
+
+type Options struct {
+	// StripPrefix is removed from the request path before it is looked up.
+	StripPrefix string
+	// Index is served for directory requests. Defaults to "index.html".
+	Index string
+	// Browse lists directories that have no index file. Otherwise they
+	// are answered with 404.
+	Browse bool
+}
+
+type FileServer struct {
+	fsys fs.FS
+	opts Options
+	// etags caches content hashes of files without a modification time,
+	// as found in embed.FS
+	etags sync.Map
+}
+
+// Dir returns the file system rooted at dir.
+func Dir(dir string) fs.FS {
+	return os.DirFS(dir)
+}
+
+func New(fsys fs.FS, opts Options) *FileServer {
+	if opts.Index == "" {
+		opts.Index = "index.html"
+	}
+	return &FileServer{fsys: fsys, opts: opts}
+}
+
+// ServeRequest is the file server's Handler. It maps the request path onto
+// the file system.
+func (s *FileServer) ServeRequest(w *response.Writter, req *request.Request) {
+	if req.RequestLine.Method != "GET" && req.RequestLine.Method != "HEAD" {
+		h := headers.NewHeaders()
+		h.Set("Allow", "GET, HEAD")
+		response.WriteText(w, response.StatusMethodNotAllowed, h, response.StatusMethodNotAllowed.String()+"\n")
+		return
+	}
+	raw := strings.TrimPrefix(req.Path(), s.opts.StripPrefix)
+	p, err := url.PathUnescape(raw)
+	if err != nil || strings.Contains(p, "\x00") || strings.Contains(p, "\\") {
+		response.WriteText(w, response.StatusBadRequest, nil, response.StatusBadRequest.String()+"\n")
+		return
+	}
+	if containsDotDot(p) {
+		response.WriteText(w, response.StatusForbidden, nil, response.StatusForbidden.String()+"\n")
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		name = "."
+	}
+	s.serve(w, req, name, strings.HasSuffix(p, "/") || p == "")
+}
+
+// ServeFile answers req with the named file, whatever the request path.
+func (s *FileServer) ServeFile(w *response.Writter, req *request.Request, name string) {
+	if !fs.ValidPath(name) {
+		response.WriteText(w, response.StatusNotFound, nil, response.StatusNotFound.String()+"\n")
+		return
+	}
+	s.serve(w, req, name, false)
+}
+
+func (s *FileServer) serve(w *response.Writter, req *request.Request, name string, dirPath bool) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		s.openFailed(w, name, err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		s.openFailed(w, name, err)
+		return
+	}
+	if info.IsDir() {
+		if !dirPath {
+			// relative links in the page only work below a trailing slash
+			// a leading "//" would make Location point at another host
+			location := "/" + strings.TrimLeft(req.Path(), "/\\") + "/"
+			if _, query, ok := strings.Cut(req.RequestLine.RequestTarget, "?"); ok {
+				location += "?" + query
+			}
+			redirect(w, location)
+			return
+		}
+		index := path.Join(name, s.opts.Index)
+		if idx, err := s.fsys.Open(index); err == nil {
+			defer idx.Close()
+			if idxInfo, err := idx.Stat(); err == nil && !idxInfo.IsDir() {
+				s.serveContent(w, req, index, idx, idxInfo)
+				return
+			}
+		}
+		if !s.opts.Browse {
+			response.WriteText(w, response.StatusNotFound, nil, response.StatusNotFound.String()+"\n")
+			return
+		}
+		s.listDir(w, req, name)
+		return
+	}
+	if dirPath {
+		response.WriteText(w, response.StatusNotFound, nil, response.StatusNotFound.String()+"\n")
+		return
+	}
+	s.serveContent(w, req, name, f, info)
+}
+
+func (s *FileServer) serveContent(w *response.Writter, req *request.Request, name string, f fs.File, info fs.FileInfo) {
+	rs, seekable := f.(io.ReadSeeker)
+	body := io.Reader(f)
+	ext := strings.ToLower(path.Ext(name))
+	contentType := mime.TypeByExtension(ext)
+	if contentType == "" {
+		contentType = extraTypes[ext]
+	}
+	if contentType == "" {
+		buf := make([]byte, sniffLen)
+		n, err := io.ReadFull(f, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			s.openFailed(w, name, err)
+			return
+		}
+		contentType = http.DetectContentType(buf[:n])
+		body = io.MultiReader(strings.NewReader(string(buf[:n])), f)
+	}
+	etag, err := s.etag(name, info)
+	if err != nil {
+		s.openFailed(w, name, err)
+		return
+	}
+	c := Content{Type: contentType, Size: info.Size(), ModTime: info.ModTime(), ETag: etag}
+	if seekable {
+		c.Body = rs
+		ServeContent(w, req, c)
+		return
+	}
+
+	// without Seek there are no ranges, only the whole file
+	h := c.headers()
+	h.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	if err := w.WriteStatusLine(response.StatusOk); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if _, err := w.WriteBodyFrom(body); err != nil {
+		log.Printf("ERROR: unable to send %s. %s\n", name, err.Error())
+	}
+}
+
+// etag derives a weak validator from the size and modification time, or
+// a strong one from the content for file systems that keep no
+// modification times.
+func (s *FileServer) etag(name string, info fs.FileInfo) (string, error) {
+	if !info.ModTime().IsZero() {
+		return response.WeakETag(info.Size(), info.ModTime()), nil
+	}
+	if v, ok := s.etags.Load(name); ok {
+		return v.(string), nil
+	}
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	etag, err := response.StrongETag(f)
+	if err != nil {
+		return "", err
+	}
+	s.etags.Store(name, etag)
+	return etag, nil
+}
+
+func (s *FileServer) listDir(w *response.Writter, req *request.Request, name string) {
+	entries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		s.openFailed(w, name, err)
+		return
+	}
+	title := html.EscapeString(req.Path())
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!doctype html>\n<html>\n<head><title>Index of %s</title></head>\n<body>\n<h1>Index of %s</h1>\n<ul>\n", title, title)
+	if name != "." {
+		b.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() {
+			n += "/"
+		}
+		href := (&url.URL{Path: n}).EscapedPath()
+		if strings.Contains(n, ":") {
+			// keep names like "a:b" from reading as a scheme
+			href = "./" + href
+		}
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(n))
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+
+	body := b.String()
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	if err := w.WriteStatusLine(response.StatusOk); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	w.WriteBody([]byte(body))
+}
+
+func (s *FileServer) openFailed(w *response.Writter, name string, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrInvalid):
+		response.WriteText(w, response.StatusNotFound, nil, response.StatusNotFound.String()+"\n")
+	case errors.Is(err, fs.ErrPermission):
+		response.WriteText(w, response.StatusForbidden, nil, response.StatusForbidden.String()+"\n")
+	default:
+		log.Printf("ERROR: unable to open %s. %s\n", name, err.Error())
+		response.WriteText(w, response.StatusInternalServerError, nil, response.StatusInternalServerError.String()+"\n")
+	}
+}
+
+func containsDotDot(p string) bool {
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func redirect(w *response.Writter, location string) {
+	h := response.GetDefaultHeaders(0)
+	h.Set("Location", location)
+	if err := w.WriteStatusLine(response.StatusMovedPermanently); err != nil {
+		return
+	}
+	w.WriteHeaders(h)
+}
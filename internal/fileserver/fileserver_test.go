@@ -0,0 +1,167 @@
+package fileserver
+
+import (
+	"bytes"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"github/Flarenzy/learn-http-protocol-golang/internal/server"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, fsrv *FileServer) string {
+	s, err := server.Serve(0, fsrv.ServeRequest)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	_, port, err := net.SplitHostPort(s.Addr().String())
+	require.NoError(t, err)
+	return "127.0.0.1:" + port
+}
+
+var noRedirect = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+func get(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := noRedirect.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func rawGet(t *testing.T, addr, target string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	out, _ := io.ReadAll(conn)
+	return string(out)
+}
+
+func TestFileServer(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"style.css":           {Data: []byte("body{}"), ModTime: modTime},
+		"page":                {Data: []byte("<!doctype html><p>hi</p>"), ModTime: modTime},
+		"docs/index.html":     {Data: []byte("<h1>docs</h1>"), ModTime: modTime},
+		"evil.example/docs/x": {Data: []byte("x")},
+		"files/a b.txt":       {Data: []byte("a")},
+		"files/<script>.txt":  {Data: []byte("b")},
+		"embedded.txt":        {Data: []byte("no mod time")},
+	}
+	base := "http://" + startServer(t, New(fsys, Options{Browse: true}))
+
+	// Test: file with type from the extension and validators
+	resp, body := get(t, base+"/style.css")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "body{}", body)
+	assert.Equal(t, "text/css; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "6", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", resp.Header.Get("Last-Modified"))
+	assert.Regexp(t, `^W/"[0-9a-f]+-6"$`, resp.Header.Get("ETag"))
+
+	// Test: type is sniffed when there is no extension
+	resp, body = get(t, base+"/page")
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "<!doctype html><p>hi</p>", body)
+
+	// Test: files without a modification time get a content ETag
+	resp, _ = get(t, base+"/embedded.txt")
+	assert.Empty(t, resp.Header.Get("Last-Modified"))
+	etag := resp.Header.Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+	resp, _ = get(t, base+"/embedded.txt")
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	// Test: directories redirect to a trailing slash and serve their index
+	resp, _ = get(t, base+"/docs")
+	assert.Equal(t, 301, resp.StatusCode)
+	assert.Equal(t, "/docs/", resp.Header.Get("Location"))
+	resp, _ = get(t, base+"/docs?lang=en&page=2")
+	assert.Equal(t, 301, resp.StatusCode)
+	assert.Equal(t, "/docs/?lang=en&page=2", resp.Header.Get("Location"))
+
+	// Test: the redirect stays on this host
+	for _, target := range []string{"//evil.example/docs", "///evil.example/docs"} {
+		out := rawGet(t, strings.TrimPrefix(base, "http://"), target+"?x=1")
+		assert.Contains(t, out, "Location: /evil.example/docs/?x=1\r\n", target)
+	}
+	resp, body = get(t, base+"/docs/")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "<h1>docs</h1>", body)
+
+	// Test: listing escapes names
+	resp, body = get(t, base+"/files/")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, `<a href="a%20b.txt">a b.txt</a>`)
+	assert.Contains(t, body, `<a href="%3Cscript%3E.txt">&lt;script&gt;.txt</a>`)
+	assert.Contains(t, body, `<a href="../">../</a>`)
+	_, body = get(t, base+"/files/a%20b.txt")
+	assert.Equal(t, "a", body)
+
+	// Test: missing files and files asked for as directories are 404
+	resp, _ = get(t, base+"/nope.txt")
+	assert.Equal(t, 404, resp.StatusCode)
+	resp, _ = get(t, base+"/style.css/")
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Test: path traversal is refused
+	addr := strings.TrimPrefix(base, "http://")
+	for _, target := range []string{"/../secret", "/docs/../../secret", "/%2e%2e/secret", "/..%2fsecret", "/a%00b"} {
+		out := rawGet(t, addr, target)
+		assert.Regexp(t, `^HTTP/1.1 (400|403) `, out, target)
+	}
+
+	// Test: listings are off by default
+	base = "http://" + startServer(t, New(fsys, Options{}))
+	resp, _ = get(t, base+"/files/")
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestFileServerDir(t *testing.T) {
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "big.bin"), big, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "clip.mp4"), []byte("not really a video"), 0o644))
+	fsrv := New(Dir(dir), Options{StripPrefix: "/static"})
+	s, err := server.Serve(0, func(w *response.Writter, req *request.Request) {
+		if req.Path() == "/video" {
+			fsrv.ServeFile(w, req, "clip.mp4")
+			return
+		}
+		fsrv.ServeRequest(w, req)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Addr().String())
+	base := "http://127.0.0.1:" + port
+
+	// Test: large files are streamed whole
+	resp, body := get(t, base+"/static/big.bin")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, len(big), len(body))
+	assert.True(t, bytes.Equal(big, []byte(body)))
+
+	// Test: ServeFile serves a fixed file
+	resp, body = get(t, base+"/video")
+	assert.Equal(t, "video/mp4", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "not really a video", body)
+}
@@ -36,22 +36,88 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	if !isValidFieldName(key) {
 		return 0, false, fmt.Errorf("invalid char in field-name %s", key)
 	}
-	v, ok := h[key]
-	if !ok {
+	v, ok := h.lookup(key)
+	switch {
+	case !ok:
 		h.Set(strings.ToLower(key), string(value))
-	} else {
+	case strings.EqualFold(key, "Cookie"):
+		// cookie pairs are separated by "; ", not commas (RFC 6265)
+		h.Set(strings.ToLower(key), fmt.Sprintf("%s; %s", v, string(value)))
+	default:
 		h.Set(strings.ToLower(key), fmt.Sprintf("%s, %s", v, string(value)))
 	}
 
 	return idx + 2, false, nil
 }
 
+// Set stores value under key, replacing any existing entry whose name only
+// differs in case.
 func (h Headers) Set(key, value string) {
+	for k := range h {
+		if k != key && strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
 	h[key] = value
 }
 
+// Add appends value to any existing value of key. Repeated fields are
+// folded into one comma-separated value, except Set-Cookie whose values may
+// contain commas; those are kept on separate lines and written as one field
+// each.
+func (h Headers) Add(key, value string) {
+	v, ok := h.lookup(key)
+	switch {
+	case !ok:
+		h.Set(key, value)
+	case strings.EqualFold(key, "Set-Cookie"):
+		h.Set(key, v+"\n"+value)
+	default:
+		h.Set(key, v+", "+value)
+	}
+}
+
+// Lines splits a value built by Add into the field lines to send.
+func Lines(value string) []string {
+	return strings.Split(value, "\n")
+}
+
+// HasToken reports whether the comma-separated list v contains token,
+// compared case-insensitively.
+func HasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
 func (h Headers) Get(key string) string {
-	return h[strings.ToLower(key)]
+	v, _ := h.lookup(key)
+	return v
+}
+
+func (h Headers) Del(key string) {
+	for k := range h {
+		if strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
+}
+
+// lookup finds key case-insensitively. Parsed headers are stored lowercase,
+// but headers built by handlers keep whatever casing Set was given.
+func (h Headers) lookup(key string) (string, bool) {
+	if v, ok := h[strings.ToLower(key)]; ok {
+		return v, true
+	}
+	for k, v := range h {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
 }
 
 func NewHeaders() Headers {
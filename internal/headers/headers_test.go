@@ -73,4 +73,36 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, "boban, mark", headers["set-person"])
 	assert.Equal(t, len("Set-Person: mark\r\n"), n)
 	assert.False(t, done)
+
+	// Test: repeated Cookie fields are joined with semicolons
+	headers = NewHeaders()
+	data = []byte("Cookie: a=1\r\nCookie: b=2\r\n\r\n")
+	n, _, err = headers.Parse(data)
+	require.NoError(t, err)
+	_, _, err = headers.Parse(data[n:])
+	require.NoError(t, err)
+	assert.Equal(t, "a=1; b=2", headers.Get("Cookie"))
+}
+
+func TestHeadersAdd(t *testing.T) {
+	// Test: repeated fields are folded with commas
+	h := NewHeaders()
+	h.Add("Vary", "Accept")
+	h.Add("vary", "Origin")
+	assert.Equal(t, "Accept, Origin", h.Get("Vary"))
+
+	// Test: Set-Cookie values stay separate lines
+	h.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+	h.Add("Set-Cookie", "b=2")
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"}, Lines(h.Get("Set-Cookie")))
+}
+
+func TestHasToken(t *testing.T) {
+	// Test: tokens match case-insensitively around whitespace
+	assert.True(t, HasToken("keep-alive, Upgrade", "upgrade"))
+	assert.True(t, HasToken("close", "close"))
+
+	// Test: substrings of a token do not match
+	assert.False(t, HasToken("upgrade-insecure", "upgrade"))
+	assert.False(t, HasToken("", "close"))
 }
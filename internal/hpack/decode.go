@@ -0,0 +1,131 @@
+package hpack
+
+import "fmt"
+
+// Decoder decodes header blocks of one direction of a connection. It
+// holds the dynamic table, so blocks must be fed in the order received.
+type Decoder struct {
+	table dynamicTable
+	// maxAllowed is the SETTINGS_HEADER_TABLE_SIZE we advertised, the
+	// ceiling for size updates sent by the peer.
+	maxAllowed uint32
+	// MaxStringLength bounds a single literal; 0 means no limit.
+	MaxStringLength int
+}
+
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		table:      dynamicTable{maxSize: maxTableSize},
+		maxAllowed: maxTableSize,
+	}
+}
+
+// SetAllowedMaxDynamicTableSize changes the limit the peer's table size
+// updates are checked against.
+func (d *Decoder) SetAllowedMaxDynamicTableSize(n uint32) {
+	d.maxAllowed = n
+}
+
+// Decode decodes a complete header block.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	sawField := false
+	for len(block) > 0 {
+		var f HeaderField
+		var err error
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // indexed
+			var idx uint64
+			idx, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, err = d.table.field(idx)
+			if err != nil {
+				return nil, err
+			}
+		case b&0xc0 == 0x40: // literal with incremental indexing
+			f, block, err = d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+		case b&0xe0 == 0x20: // dynamic table size update
+			if sawField {
+				return nil, fmt.Errorf("%w: size update after header field", ErrTableSize)
+			}
+			var n uint64
+			n, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if n > uint64(d.maxAllowed) {
+				return nil, ErrTableSize
+			}
+			d.table.setMaxSize(uint32(n))
+			continue
+		default: // literal without indexing (0000) or never indexed (0001)
+			sensitive := b&0x10 != 0
+			f, block, err = d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = sensitive
+		}
+		sawField = true
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(p []byte, n uint8) (HeaderField, []byte, error) {
+	var f HeaderField
+	idx, p, err := readInt(p, n)
+	if err != nil {
+		return f, nil, err
+	}
+	if idx > 0 {
+		nf, err := d.table.field(idx)
+		if err != nil {
+			return f, nil, err
+		}
+		f.Name = nf.Name
+	} else {
+		f.Name, p, err = d.readString(p)
+		if err != nil {
+			return f, nil, err
+		}
+	}
+	f.Value, p, err = d.readString(p)
+	return f, p, err
+}
+
+func (d *Decoder) readString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, ErrTruncated
+	}
+	huffman := p[0]&0x80 != 0
+	n, p, err := readInt(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if n > uint64(len(p)) {
+		return "", nil, ErrTruncated
+	}
+	if d.MaxStringLength > 0 && n > uint64(d.MaxStringLength) {
+		return "", nil, ErrStringTooLong
+	}
+	raw, p := p[:n], p[n:]
+	if !huffman {
+		return string(raw), p, nil
+	}
+	s, err := HuffmanDecode(make([]byte, 0, len(raw)*8/5), raw)
+	if err != nil {
+		return "", nil, err
+	}
+	if d.MaxStringLength > 0 && len(s) > d.MaxStringLength {
+		return "", nil, ErrStringTooLong
+	}
+	return string(s), p, nil
+}
@@ -0,0 +1,91 @@
+package hpack
+
+// Encoder encodes header blocks for one direction of a connection.
+type Encoder struct {
+	table dynamicTable
+	// maxAllowed is the peer's SETTINGS_HEADER_TABLE_SIZE.
+	maxAllowed uint32
+	// pendingUpdate is set when a table size change has to be signalled at
+	// the start of the next block.
+	pendingUpdate bool
+	minSize       uint32
+}
+
+// NewEncoder returns an encoder whose dynamic table starts at maxTableSize,
+// which must be what the peer's decoder starts with: DefaultTableSize
+// unless agreed otherwise.
+func NewEncoder(maxTableSize uint32) *Encoder {
+	return &Encoder{
+		table:      dynamicTable{maxSize: maxTableSize},
+		maxAllowed: maxTableSize,
+		minSize:    maxTableSize,
+	}
+}
+
+// SetMaxDynamicTableSizeLimit applies the peer's SETTINGS_HEADER_TABLE_SIZE.
+// The encoder never uses a bigger table than that.
+func (e *Encoder) SetMaxDynamicTableSizeLimit(n uint32) {
+	e.maxAllowed = n
+	if e.table.maxSize > n {
+		e.SetMaxDynamicTableSize(n)
+	}
+}
+
+// SetMaxDynamicTableSize changes the size of the table in use, capped at
+// the peer's limit. The change is announced in the next block.
+func (e *Encoder) SetMaxDynamicTableSize(n uint32) {
+	n = min(n, e.maxAllowed)
+	if !e.pendingUpdate || n < e.minSize {
+		e.minSize = n
+	}
+	e.pendingUpdate = true
+	e.table.setMaxSize(n)
+}
+
+// AppendBlock appends the encoding of fields to dst.
+func (e *Encoder) AppendBlock(dst []byte, fields []HeaderField) []byte {
+	if e.pendingUpdate {
+		// a shrink followed by a grow before a block is sent needs both
+		// updates so the peer evicts what we evicted
+		if e.minSize < e.table.maxSize {
+			dst = appendInt(dst, 0x20, 5, uint64(e.minSize))
+		}
+		dst = appendInt(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.pendingUpdate = false
+	}
+	for _, f := range fields {
+		dst = e.appendField(dst, f)
+	}
+	return dst
+}
+
+func (e *Encoder) appendField(dst []byte, f HeaderField) []byte {
+	idx, full := e.table.lookup(f)
+	if full && !f.Sensitive {
+		return appendInt(dst, 0x80, 7, uint64(idx))
+	}
+	switch {
+	case f.Sensitive:
+		dst = appendInt(dst, 0x10, 4, uint64(idx))
+	case f.Size() > e.table.maxSize:
+		dst = appendInt(dst, 0x00, 4, uint64(idx))
+	default:
+		dst = appendInt(dst, 0x40, 6, uint64(idx))
+		e.table.add(f)
+	}
+	if idx == 0 {
+		dst = appendString(dst, f.Name)
+	}
+	return appendString(dst, f.Value)
+}
+
+// appendString writes a string literal, Huffman coded unless that would
+// make it longer.
+func appendString(dst []byte, s string) []byte {
+	if n := HuffmanEncodeLength(s); n <= len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return AppendHuffman(dst, s)
+	}
+	dst = appendInt(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
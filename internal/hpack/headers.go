@@ -0,0 +1,58 @@
+package hpack
+
+import (
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"sort"
+	"strings"
+)
+
+// sensitiveFields are never added to a dynamic table, so credentials can't
+// be probed for through compression side channels.
+var sensitiveFields = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"set-cookie":          true,
+}
+
+// FromHeaders converts h to a header list with lowercase names, sorted so
+// equal header sets always encode the same way. Values holding several
+// lines, like repeated Set-Cookie fields, become one field per line.
+func FromHeaders(h headers.Headers) []HeaderField {
+	fields := make([]HeaderField, 0, len(h))
+	for k, v := range h {
+		name := strings.ToLower(k)
+		for _, line := range headers.Lines(v) {
+			fields = append(fields, HeaderField{Name: name, Value: line, Sensitive: sensitiveFields[name]})
+		}
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].Name < fields[j].Name
+	})
+	return fields
+}
+
+// ToHeaders converts a header list to headers.Headers. Pseudo-header fields
+// are kept under their names.
+func ToHeaders(fields []HeaderField) headers.Headers {
+	h := headers.NewHeaders()
+	for _, f := range fields {
+		AddHeader(h, f)
+	}
+	return h
+}
+
+// AddHeader adds f to h, folding repeated names into one comma-separated
+// value like the HTTP/1.1 parser does. Cookies, which HTTP/2 sends as one
+// field per pair, are joined with "; " instead.
+func AddHeader(h headers.Headers, f HeaderField) {
+	name := strings.ToLower(f.Name)
+	sep := ", "
+	if name == "cookie" {
+		sep = "; "
+	}
+	if v, ok := h[name]; ok {
+		h[name] = v + sep + f.Value
+	} else {
+		h[name] = f.Value
+	}
+}
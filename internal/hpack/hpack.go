@@ -0,0 +1,231 @@
+// Package hpack implements HPACK, the header compression format of
+// HTTP/2 (RFC 7541).
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HeaderField is a single name/value pair. Sensitive fields are never
+// added to a dynamic table, by us or by any intermediary.
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+// Size is the field's size as counted against a dynamic table.
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+func (f HeaderField) String() string {
+	return fmt.Sprintf("%s: %s", f.Name, f.Value)
+}
+
+// DefaultTableSize is the dynamic table size both ends start with until
+// SETTINGS_HEADER_TABLE_SIZE says otherwise.
+const DefaultTableSize = 4096
+
+var (
+	ErrInvalidIndex   = errors.New("hpack: invalid table index")
+	ErrIntegerTooLong = errors.New("hpack: integer overflow")
+	ErrTruncated      = errors.New("hpack: truncated header block")
+	ErrStringTooLong  = errors.New("hpack: string literal too long")
+	ErrInvalidHuffman = errors.New("hpack: invalid Huffman-encoded data")
+	ErrTableSize      = errors.New("hpack: dynamic table size update exceeds the limit")
+)
+
+var staticTable = [...]HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable is the FIFO table of recently used fields. Index 1 of the
+// dynamic part (62 overall) is the newest entry.
+type dynamicTable struct {
+	entries []HeaderField // oldest first
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	n := 0
+	for t.size > t.maxSize && n < len(t.entries) {
+		t.size -= t.entries[n].Size()
+		n++
+	}
+	if n > 0 {
+		t.entries = append(t.entries[:0], t.entries[n:]...)
+	}
+}
+
+func (t *dynamicTable) len() int {
+	return len(t.entries)
+}
+
+// at returns the entry at 1-based dynamic index i.
+func (t *dynamicTable) at(i int) HeaderField {
+	return t.entries[len(t.entries)-i]
+}
+
+// lookup returns the 1-based index into the combined static and dynamic
+// table of a field matching f, and whether the value matched too.
+func (t *dynamicTable) lookup(f HeaderField) (index int, nameValueMatch bool) {
+	for i, sf := range staticTable {
+		if sf.Name != f.Name {
+			continue
+		}
+		if index == 0 {
+			index = i + 1
+		}
+		if sf.Value == f.Value {
+			return i + 1, true
+		}
+	}
+	for i := 1; i <= t.len(); i++ {
+		df := t.at(i)
+		if df.Name != f.Name {
+			continue
+		}
+		if index == 0 {
+			index = len(staticTable) + i
+		}
+		if df.Value == f.Value {
+			return len(staticTable) + i, true
+		}
+	}
+	return index, false
+}
+
+// field returns the field at 1-based index i of the combined table.
+func (t *dynamicTable) field(i uint64) (HeaderField, error) {
+	if i == 0 {
+		return HeaderField{}, ErrInvalidIndex
+	}
+	if i <= uint64(len(staticTable)) {
+		return staticTable[i-1], nil
+	}
+	i -= uint64(len(staticTable))
+	if i > uint64(t.len()) {
+		return HeaderField{}, ErrInvalidIndex
+	}
+	return t.at(int(i)), nil
+}
+
+// appendInt appends i as an HPACK integer with an n-bit prefix, the high
+// bits of the first byte taken from first.
+func appendInt(dst []byte, first byte, n uint8, i uint64) []byte {
+	max := uint64(1)<<n - 1
+	if i < max {
+		return append(dst, first|byte(i))
+	}
+	dst = append(dst, first|byte(max))
+	i -= max
+	for i >= 128 {
+		dst = append(dst, byte(i&0x7f|0x80))
+		i >>= 7
+	}
+	return append(dst, byte(i))
+}
+
+// readInt decodes an HPACK integer with an n-bit prefix from p, returning
+// the value and the remaining bytes.
+func readInt(p []byte, n uint8) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, ErrTruncated
+	}
+	max := uint64(1)<<n - 1
+	i := uint64(p[0]) & max
+	p = p[1:]
+	if i < max {
+		return i, p, nil
+	}
+	var shift uint
+	for {
+		if len(p) == 0 {
+			return 0, nil, ErrTruncated
+		}
+		b := p[0]
+		p = p[1:]
+		if shift >= 63 {
+			return 0, nil, ErrIntegerTooLong
+		}
+		i += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return i, p, nil
+		}
+		shift += 7
+	}
+}
@@ -0,0 +1,309 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unhex decodes the RFC's hex dumps, which are split by spaces and lines.
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	require.NoError(t, err)
+	return b
+}
+
+func fields(kv ...string) []HeaderField {
+	var out []HeaderField
+	for i := 0; i < len(kv); i += 2 {
+		out = append(out, HeaderField{Name: kv[i], Value: kv[i+1]})
+	}
+	return out
+}
+
+// assertTable checks the dynamic table, newest entry first, and its size.
+func assertTable(t *testing.T, table *dynamicTable, size uint32, want ...string) {
+	t.Helper()
+	var got []string
+	for i := 1; i <= table.len(); i++ {
+		got = append(got, table.at(i).String())
+	}
+	assert.Equal(t, want, got)
+	assert.Equal(t, size, table.size)
+}
+
+func TestInteger(t *testing.T) {
+	// Test: RFC 7541 C.1 examples
+	cases := []struct {
+		value uint64
+		n     uint8
+		enc   string
+	}{
+		{10, 5, "0a"},
+		{1337, 5, "1f9a0a"},
+		{42, 8, "2a"},
+	}
+	for _, tc := range cases {
+		enc := appendInt(nil, 0, tc.n, tc.value)
+		assert.Equal(t, tc.enc, hex.EncodeToString(enc))
+		v, rest, err := readInt(enc, tc.n)
+		require.NoError(t, err)
+		assert.Equal(t, tc.value, v)
+		assert.Empty(t, rest)
+	}
+
+	// Test: Truncated and overlong integers are errors
+	_, _, err := readInt([]byte{0x1f, 0x9a}, 5)
+	assert.ErrorIs(t, err, ErrTruncated)
+	_, _, err = readInt(unhex(t, "1f ffffffffffffffffff ff 01"), 5)
+	assert.ErrorIs(t, err, ErrIntegerTooLong)
+}
+
+func TestDecodeLiterals(t *testing.T) {
+	// Test: RFC 7541 C.2 examples
+	d := NewDecoder(DefaultTableSize)
+	got, err := d.Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+	require.NoError(t, err)
+	assert.Equal(t, fields("custom-key", "custom-header"), got)
+	assertTable(t, &d.table, 55, "custom-key: custom-header")
+
+	d = NewDecoder(DefaultTableSize)
+	got, err = d.Decode(unhex(t, "040c 2f73 616d 706c 652f 7061 7468"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":path", "/sample/path"), got)
+	assertTable(t, &d.table, 0)
+
+	got, err = d.Decode(unhex(t, "1008 7061 7373 776f 7264 0673 6563 7265 74"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "password", Value: "secret", Sensitive: true}}, got)
+	assertTable(t, &d.table, 0)
+
+	got, err = d.Decode(unhex(t, "82"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":method", "GET"), got)
+}
+
+var requests = [][]HeaderField{
+	fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"),
+	fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com", "cache-control", "no-cache"),
+	fields(":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com", "custom-key", "custom-value"),
+}
+
+var requestTables = [][]string{
+	{":authority: www.example.com"},
+	{"cache-control: no-cache", ":authority: www.example.com"},
+	{"custom-key: custom-value", "cache-control: no-cache", ":authority: www.example.com"},
+}
+
+var requestTableSizes = []uint32{57, 110, 164}
+
+func TestRequests(t *testing.T) {
+	// Test: RFC 7541 C.3, requests without Huffman coding
+	plain := []string{
+		"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+		"8286 84be 5808 6e6f 2d63 6163 6865",
+		"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+	}
+	d := NewDecoder(DefaultTableSize)
+	for i, block := range plain {
+		got, err := d.Decode(unhex(t, block))
+		require.NoError(t, err)
+		assert.Equal(t, requests[i], got)
+		assertTable(t, &d.table, requestTableSizes[i], requestTables[i]...)
+	}
+
+	// Test: RFC 7541 C.4, the same requests with Huffman coding, which is
+	// also what the encoder produces
+	huffman := []string{
+		"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+		"8286 84be 5886 a8eb 1064 9cbf",
+		"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+	}
+	d = NewDecoder(DefaultTableSize)
+	e := NewEncoder(DefaultTableSize)
+	for i, block := range huffman {
+		assert.Equal(t, hex.EncodeToString(unhex(t, block)), hex.EncodeToString(e.AppendBlock(nil, requests[i])))
+		got, err := d.Decode(unhex(t, block))
+		require.NoError(t, err)
+		assert.Equal(t, requests[i], got)
+		assertTable(t, &d.table, requestTableSizes[i], requestTables[i]...)
+		assertTable(t, &e.table, requestTableSizes[i], requestTables[i]...)
+	}
+}
+
+func TestResponses(t *testing.T) {
+	responses := [][]HeaderField{
+		fields(":status", "302", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+		fields(":status", "307", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+		fields(":status", "200", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:22 GMT", "location", "https://www.example.com",
+			"content-encoding", "gzip", "set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"),
+	}
+	tables := [][]string{
+		{"location: https://www.example.com", "date: Mon, 21 Oct 2013 20:13:21 GMT", "cache-control: private", ":status: 302"},
+		{":status: 307", "location: https://www.example.com", "date: Mon, 21 Oct 2013 20:13:21 GMT", "cache-control: private"},
+		{"set-cookie: foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1", "content-encoding: gzip", "date: Mon, 21 Oct 2013 20:13:22 GMT"},
+	}
+	sizes := []uint32{222, 222, 215}
+
+	// Test: RFC 7541 C.5, responses with a 256 byte table, which forces
+	// evictions
+	plain := []string{
+		`4803 3330 3258 0770 7269 7661 7465 611d
+		4d6f 6e2c 2032 3120 4f63 7420 3230 3133
+		2032 303a 3133 3a32 3120 474d 546e 1768
+		7474 7073 3a2f 2f77 7777 2e65 7861 6d70
+		6c65 2e63 6f6d`,
+		"4803 3330 37c1 c0bf",
+		`88c1 611d 4d6f 6e2c 2032 3120 4f63 7420
+		3230 3133 2032 303a 3133 3a32 3220 474d
+		54c0 5a04 677a 6970 7738 666f 6f3d 4153
+		444a 4b48 514b 425a 584f 5157 454f 5049
+		5541 5851 5745 4f49 553b 206d 6178 2d61
+		6765 3d33 3630 303b 2076 6572 7369 6f6e
+		3d31`,
+	}
+	d := NewDecoder(256)
+	for i, block := range plain {
+		got, err := d.Decode(unhex(t, block))
+		require.NoError(t, err)
+		assert.Equal(t, responses[i], got)
+		assertTable(t, &d.table, sizes[i], tables[i]...)
+	}
+
+	// Test: RFC 7541 C.6, the same responses with Huffman coding
+	huffman := []string{
+		`4882 6402 5885 aec3 771a 4b61 96d0 7abe
+		9410 54d4 44a8 2005 9504 0b81 66e0 82a6
+		2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8
+		e9ae 82ae 43d3`,
+		"4883 640e ffc1 c0bf",
+		`88c1 6196 d07a be94 1054 d444 a820 0595
+		040b 8166 e084 a62d 1bff c05a 839b d9ab
+		77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b
+		3960 d5af 2708 7f36 72c1 ab27 0fb5 291f
+		9587 3160 65c0 03ed 4ee5 b106 3d50 07`,
+	}
+	d = NewDecoder(256)
+	e := NewEncoder(256)
+	for i, block := range huffman {
+		assert.Equal(t, hex.EncodeToString(unhex(t, block)), hex.EncodeToString(e.AppendBlock(nil, responses[i])))
+		got, err := d.Decode(unhex(t, block))
+		require.NoError(t, err)
+		assert.Equal(t, responses[i], got)
+		assertTable(t, &d.table, sizes[i], tables[i]...)
+		assertTable(t, &e.table, sizes[i], tables[i]...)
+	}
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: Every byte value round-trips
+	var all []byte
+	for i := 0; i < 256; i++ {
+		all = append(all, byte(i))
+	}
+	enc := AppendHuffman(nil, string(all))
+	assert.Equal(t, HuffmanEncodeLength(string(all)), len(enc))
+	dec, err := HuffmanDecode(nil, enc)
+	require.NoError(t, err)
+	assert.Equal(t, all, dec)
+
+	// Test: Padding must be a short run of ones
+	_, err = HuffmanDecode(nil, []byte{0x1f}) // "a" (00011) padded with 111
+	require.NoError(t, err)
+	_, err = HuffmanDecode(nil, []byte{0x18}) // "a" padded with zeros
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+	_, err = HuffmanDecode(nil, []byte{0x1f, 0xff}) // 11 bits of padding
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+	_, err = HuffmanDecode(nil, []byte{0xff, 0xff, 0xff, 0xff}) // EOS
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+}
+
+func TestTableSizeUpdate(t *testing.T) {
+	e := NewEncoder(DefaultTableSize)
+	d := NewDecoder(DefaultTableSize)
+	block := e.AppendBlock(nil, fields("custom-key", "custom-header"))
+	_, err := d.Decode(block)
+	require.NoError(t, err)
+
+	// Test: Shrinking and regrowing between blocks signals both sizes so
+	// the decoder evicts the same entries
+	e.SetMaxDynamicTableSize(0)
+	e.SetMaxDynamicTableSize(100)
+	block = e.AppendBlock(nil, fields("custom-key", "custom-header"))
+	assert.Equal(t, "203f45", hex.EncodeToString(block[:3]))
+	got, err := d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields("custom-key", "custom-header"), got)
+	assertTable(t, &d.table, 55, "custom-key: custom-header")
+	assert.Equal(t, uint32(100), d.table.maxSize)
+
+	// Test: The peer's SETTINGS_HEADER_TABLE_SIZE caps the table
+	e.SetMaxDynamicTableSizeLimit(50)
+	assertTable(t, &e.table, 0)
+	assert.Equal(t, "3f13", hex.EncodeToString(e.AppendBlock(nil, nil)))
+
+	// Test: Updates above the advertised limit or after a field are errors
+	d = NewDecoder(DefaultTableSize)
+	_, err = d.Decode(appendInt(nil, 0x20, 5, DefaultTableSize+1))
+	assert.ErrorIs(t, err, ErrTableSize)
+	_, err = d.Decode(append([]byte{0x82}, appendInt(nil, 0x20, 5, 0)...))
+	assert.ErrorIs(t, err, ErrTableSize)
+	d.SetAllowedMaxDynamicTableSize(8192)
+	_, err = d.Decode(appendInt(nil, 0x20, 5, 8192))
+	assert.NoError(t, err)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	d := NewDecoder(DefaultTableSize)
+	_, err := d.Decode([]byte{0x80})
+	assert.ErrorIs(t, err, ErrInvalidIndex)
+	_, err = d.Decode([]byte{0xbe})
+	assert.ErrorIs(t, err, ErrInvalidIndex)
+	_, err = d.Decode(unhex(t, "400a 6375 7374"))
+	assert.ErrorIs(t, err, ErrTruncated)
+	d.MaxStringLength = 4
+	_, err = d.Decode(unhex(t, "040c 2f73 616d 706c 652f 7061 7468"))
+	assert.ErrorIs(t, err, ErrStringTooLong)
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	e := NewEncoder(DefaultTableSize)
+	d := NewDecoder(DefaultTableSize)
+	in := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "authorization", Value: "Bearer secret", Sensitive: true},
+		{Name: "x-big", Value: strings.Repeat("a", 5000)},
+	}
+	for i := 0; i < 2; i++ {
+		block := e.AppendBlock(nil, in)
+		got, err := d.Decode(block)
+		require.NoError(t, err)
+		assert.Equal(t, in, got)
+	}
+	// Test: Sensitive fields and fields bigger than the table stay out of it
+	assertTable(t, &e.table, 0)
+	assertTable(t, &d.table, 0)
+}
+
+func TestHeadersConversion(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Set-Cookie", "a=1")
+	h.Set("Accept", "x")
+
+	// Test: Names are lowercased and sorted, credentials marked sensitive
+	assert.Equal(t, []HeaderField{
+		{Name: "accept", Value: "x"},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "set-cookie", Value: "a=1", Sensitive: true},
+	}, FromHeaders(h))
+
+	// Test: Repeated fields are folded, cookie crumbs with "; "
+	got := ToHeaders(fields(":path", "/", "cookie", "a=1", "Accept", "x", "cookie", "b=2", "accept", "y"))
+	assert.Equal(t, headers.Headers{":path": "/", "cookie": "a=1; b=2", "accept": "x, y"}, got)
+}
@@ -0,0 +1,89 @@
+package hpack
+
+import "sync"
+
+// huffmanNode is a node of the decoding tree. Leaves have no children and
+// carry the decoded symbol.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+}
+
+var (
+	huffmanRoot     *huffmanNode
+	huffmanRootOnce sync.Once
+)
+
+func buildHuffmanTree() {
+	huffmanRoot = &huffmanNode{}
+	for sym, code := range huffmanCodes {
+		n := huffmanRoot
+		for i := int(huffmanCodeLens[sym]) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.sym = byte(sym)
+	}
+}
+
+// HuffmanDecode appends the decoding of the Huffman-encoded p to dst.
+func HuffmanDecode(dst, p []byte) ([]byte, error) {
+	huffmanRootOnce.Do(buildHuffmanTree)
+	n := huffmanRoot
+	// depth and ones track the bits consumed since the last symbol, which
+	// must be a prefix of EOS (all ones) no longer than 7 bits.
+	depth, ones := 0, true
+	for _, b := range p {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				return dst, ErrInvalidHuffman
+			}
+			depth++
+			ones = ones && bit == 1
+			if n.children[0] == nil && n.children[1] == nil {
+				dst = append(dst, n.sym)
+				n = huffmanRoot
+				depth, ones = 0, true
+			}
+		}
+	}
+	if depth > 7 || !ones {
+		return dst, ErrInvalidHuffman
+	}
+	return dst, nil
+}
+
+// HuffmanEncodeLength is the length in bytes of the Huffman encoding of s.
+func HuffmanEncodeLength(s string) int {
+	var bits int
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLens[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+// AppendHuffman appends the Huffman encoding of s to dst, padding the last
+// byte with the most significant bits of EOS.
+func AppendHuffman(dst []byte, s string) []byte {
+	var acc uint64
+	var n uint
+	for i := 0; i < len(s); i++ {
+		l := uint(huffmanCodeLens[s[i]])
+		acc = acc<<l | uint64(huffmanCodes[s[i]])
+		n += l
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+	if n > 0 {
+		acc = acc<<(8-n) | (1<<(8-n) - 1)
+		dst = append(dst, byte(acc))
+	}
+	return dst
+}
@@ -0,0 +1,157 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+func (t FrameType) String() string {
+	names := [...]string{
+		"DATA", "HEADERS", "PRIORITY", "RST_STREAM", "SETTINGS",
+		"PUSH_PROMISE", "PING", "GOAWAY", "WINDOW_UPDATE", "CONTINUATION",
+	}
+	if int(t) < len(names) {
+		return names[t]
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+}
+
+const (
+	FlagEndStream  uint8 = 0x1
+	FlagAck        uint8 = 0x1
+	FlagEndHeaders uint8 = 0x4
+	FlagPadded     uint8 = 0x8
+	FlagPriority   uint8 = 0x20
+)
+
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+const frameHeaderLen = 9
+
+type FrameHeader struct {
+	Length   uint32
+	Type     FrameType
+	Flags    uint8
+	StreamID uint32
+}
+
+func (h FrameHeader) Has(flag uint8) bool {
+	return h.Flags&flag != 0
+}
+
+// Frame is a raw frame. Payload is only valid until the next ReadFrame on
+// the same buffer.
+type Frame struct {
+	FrameHeader
+	Payload []byte
+}
+
+// ReadFrame reads one frame into buf, growing it as needed. Frames longer
+// than maxSize are a FRAME_SIZE_ERROR.
+func ReadFrame(r io.Reader, buf *[]byte, maxSize uint32) (Frame, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Frame{}, err
+	}
+	fh := FrameHeader{
+		Length:   uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2]),
+		Type:     FrameType(hdr[3]),
+		Flags:    hdr[4],
+		StreamID: binary.BigEndian.Uint32(hdr[5:]) & (1<<31 - 1),
+	}
+	if fh.Length > maxSize {
+		return Frame{}, ConnError{ErrCodeFrameSize, fmt.Sprintf("%s frame of %d bytes", fh.Type, fh.Length)}
+	}
+	if uint32(cap(*buf)) < fh.Length {
+		*buf = make([]byte, fh.Length)
+	}
+	payload := (*buf)[:fh.Length]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	return Frame{FrameHeader: fh, Payload: payload}, nil
+}
+
+// AppendFrame appends a frame with the given header fields and payload to
+// dst.
+func AppendFrame(dst []byte, t FrameType, flags uint8, streamID uint32, payload []byte) []byte {
+	dst = appendFrameHeader(dst, FrameHeader{uint32(len(payload)), t, flags, streamID})
+	return append(dst, payload...)
+}
+
+func appendFrameHeader(dst []byte, h FrameHeader) []byte {
+	n := h.Length
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(h.Type), h.Flags)
+	return binary.BigEndian.AppendUint32(dst, h.StreamID&(1<<31-1))
+}
+
+// stripPadding removes the Pad Length field and padding of a PADDED frame.
+func stripPadding(f Frame) ([]byte, error) {
+	p := f.Payload
+	if !f.Has(FlagPadded) {
+		return p, nil
+	}
+	if len(p) == 0 {
+		return nil, ConnError{ErrCodeFrameSize, "missing pad length"}
+	}
+	padLen := int(p[0])
+	if padLen >= len(p) {
+		return nil, ConnError{ErrCodeProtocol, "padding exceeds payload"}
+	}
+	return p[1 : len(p)-padLen], nil
+}
+
+func parseSettings(p []byte) ([]Setting, error) {
+	if len(p)%6 != 0 {
+		return nil, ConnError{ErrCodeFrameSize, "SETTINGS length not a multiple of 6"}
+	}
+	settings := make([]Setting, 0, len(p)/6)
+	for ; len(p) > 0; p = p[6:] {
+		settings = append(settings, Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(p)),
+			Value: binary.BigEndian.Uint32(p[2:]),
+		})
+	}
+	return settings, nil
+}
+
+func appendSettings(dst []byte, settings ...Setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.ID))
+		dst = binary.BigEndian.AppendUint32(dst, s.Value)
+	}
+	return dst
+}
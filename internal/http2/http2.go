@@ -0,0 +1,125 @@
+// Package http2 serves HTTP/2 (RFC 9113) connections, handing each stream's
+// request to the same kind of handler the HTTP/1.1 server uses.
+package http2
+
+import (
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+)
+
+// ClientPreface is the connection preface every HTTP/2 client starts with.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// NextProtoTLS is the ALPN protocol ID of HTTP/2 over TLS.
+const NextProtoTLS = "h2"
+
+// DefaultMaxBodyBytes caps request bodies when ServeConnOpts.MaxBodyBytes
+// is zero. Bodies are buffered whole before the handler runs.
+const DefaultMaxBodyBytes = 10 << 20
+
+const (
+	defaultMaxConcurrentStreams = 250
+	defaultInitialWindowSize    = 1 << 20
+	defaultMaxHeaderListSize    = 1 << 20
+
+	initialWindowSize = 65535
+	minMaxFrameSize   = 1 << 14
+	maxMaxFrameSize   = 1<<24 - 1
+	maxWindowSize     = 1<<31 - 1
+)
+
+// Handler serves a single stream's request.
+type Handler func(w *response.Writter, req *request.Request)
+
+// Config tunes the HTTP/2 side of the server. The zero value is usable.
+type Config struct {
+	// MaxConcurrentStreams is how many requests a client may have open on
+	// one connection. Extra streams are refused. Zero means 250.
+	MaxConcurrentStreams uint32
+	// InitialWindowSize is the flow control window granted to each stream
+	// and to the connection for request bodies. Zero means 1MiB.
+	InitialWindowSize uint32
+	// MaxFrameSize is the largest frame payload accepted. Zero means the
+	// protocol minimum of 16KiB.
+	MaxFrameSize uint32
+	// MaxHeaderListSize bounds the decoded size of a request's header
+	// fields. Zero means 1MiB.
+	MaxHeaderListSize uint32
+	// H2C allows HTTP/2 over cleartext connections, both with prior
+	// knowledge and through an Upgrade: h2c request.
+	H2C bool
+}
+
+func (c Config) withDefaults() Config {
+	if c.MaxConcurrentStreams == 0 {
+		c.MaxConcurrentStreams = defaultMaxConcurrentStreams
+	}
+	if c.InitialWindowSize == 0 {
+		c.InitialWindowSize = defaultInitialWindowSize
+	}
+	c.InitialWindowSize = min(c.InitialWindowSize, maxWindowSize)
+	if c.MaxFrameSize == 0 {
+		c.MaxFrameSize = minMaxFrameSize
+	}
+	c.MaxFrameSize = min(max(c.MaxFrameSize, minMaxFrameSize), maxMaxFrameSize)
+	if c.MaxHeaderListSize == 0 {
+		c.MaxHeaderListSize = defaultMaxHeaderListSize
+	}
+	return c
+}
+
+// ErrCode is an error code carried by RST_STREAM and GOAWAY frames.
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+func (e ErrCode) String() string {
+	names := [...]string{
+		"NO_ERROR", "PROTOCOL_ERROR", "INTERNAL_ERROR", "FLOW_CONTROL_ERROR",
+		"SETTINGS_TIMEOUT", "STREAM_CLOSED", "FRAME_SIZE_ERROR", "REFUSED_STREAM",
+		"CANCEL", "COMPRESSION_ERROR", "CONNECT_ERROR", "ENHANCE_YOUR_CALM",
+		"INADEQUATE_SECURITY", "HTTP_1_1_REQUIRED",
+	}
+	if int(e) < len(names) {
+		return names[e]
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(e))
+}
+
+// ConnError is a connection error: the connection is torn down with a
+// GOAWAY carrying Code.
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error: %s: %s", e.Code, e.Reason)
+}
+
+// StreamError only resets the stream it happened on.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error: %s: %s", e.StreamID, e.Code, e.Reason)
+}
@@ -0,0 +1,843 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/hpack"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServeConnOpts carries what ServeConn needs from the server.
+type ServeConnOpts struct {
+	Handler Handler
+	// Context is the parent of every request context. Cancelling it
+	// aborts all requests.
+	Context context.Context
+	// Reader, if set, is read from instead of the connection, for bytes
+	// the caller already consumed while detecting the protocol.
+	Reader io.Reader
+	TLS    *tls.ConnectionState
+	// Shutdown is closed when the server starts shutting down gracefully.
+	Shutdown <-chan struct{}
+
+	// IdleTimeout closes the connection after this long without open
+	// streams. WriteTimeout bounds every write to the connection.
+	IdleTimeout  time.Duration
+	WriteTimeout time.Duration
+	// MaxBodyBytes caps a request body. Zero means DefaultMaxBodyBytes and
+	// a negative value no limit.
+	MaxBodyBytes int
+
+	// Upgrade is the request of an h2c upgrade, served as stream 1, and
+	// UpgradeSettings the decoded HTTP2-Settings header that came with it.
+	Upgrade         *request.Request
+	UpgradeSettings []byte
+
+	// IdleChanged is called when the connection goes from having open
+	// streams to having none, and back.
+	IdleChanged func(idle bool)
+	// OnPanic is told about a handler panic before the stream is reset.
+	OnPanic func(recovered any, stack []byte, req *request.Request)
+}
+
+var errClientDisconnected = errors.New("http2: client disconnected")
+
+// ServeConn serves HTTP/2 on conn until the client goes away, a connection
+// error occurs or the server shuts down. conn must not have sent anything
+// yet; the client preface is read from opts.Reader or conn.
+func ServeConn(conn net.Conn, cfg Config, opts ServeConnOpts) error {
+	cfg = cfg.withDefaults()
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+	if opts.MaxBodyBytes == 0 {
+		opts.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	r := opts.Reader
+	if r == nil {
+		r = conn
+	}
+	ctx, cancel := context.WithCancel(opts.Context)
+	sc := &serverConn{
+		conn:   conn,
+		br:     bufio.NewReader(r),
+		bw:     bufio.NewWriterSize(conn, 16<<10),
+		cfg:    cfg,
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+
+		enc: hpack.NewEncoder(hpack.DefaultTableSize),
+		dec: hpack.NewDecoder(hpack.DefaultTableSize),
+
+		streams:           make(map[uint32]*stream),
+		sendWindow:        initialWindowSize,
+		peerInitialWindow: initialWindowSize,
+		peerMaxFrameSize:  minMaxFrameSize,
+		recvWindow:        int64(cfg.InitialWindowSize),
+		done:              make(chan struct{}),
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.dec.MaxStringLength = int(cfg.MaxHeaderListSize)
+	err := sc.serve()
+	sc.close()
+	sc.handlers.Wait()
+	return err
+}
+
+type serverConn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	cfg    Config
+	opts   ServeConnOpts
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wmu serializes frame writes. The HPACK encoder is under it too, as
+	// header blocks must hit the wire in the order they were encoded.
+	wmu sync.Mutex
+	bw  *bufio.Writer
+	enc *hpack.Encoder
+
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	maxStreamID       uint32
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	goingAway         bool
+	closed            bool
+	// goAwayPending holds off closing until our GOAWAY is on the wire
+	goAwayPending bool
+	// active counts the streams held against MaxConcurrentStreams
+	active int
+
+	// owned by the serve goroutine
+	dec         *hpack.Decoder
+	recvWindow  int64
+	recvUnacked int64
+	// header block being assembled from HEADERS and CONTINUATION frames
+	headerStream    uint32
+	headerBlock     []byte
+	headerEndStream bool
+
+	handlers sync.WaitGroup
+	done     chan struct{}
+}
+
+func (sc *serverConn) serve() error {
+	if err := sc.writePreface(); err != nil {
+		return err
+	}
+	if sc.opts.Upgrade != nil {
+		if err := sc.upgrade(); err != nil {
+			return sc.connError(err)
+		}
+	}
+	sc.mu.Lock()
+	sc.setIdleDeadlineLocked()
+	sc.mu.Unlock()
+	if err := sc.readPreface(); err != nil {
+		return err
+	}
+	if sc.opts.Shutdown != nil {
+		go sc.watchShutdown()
+	}
+	var buf []byte
+	first := true
+	for {
+		f, err := ReadFrame(sc.br, &buf, sc.cfg.MaxFrameSize)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && sc.openStreams() == 0 {
+				sc.goAway(ErrCodeNo)
+				return fmt.Errorf("http2: idle: %w", err)
+			}
+			if errors.Is(err, io.EOF) || sc.isClosed() {
+				return nil
+			}
+			return sc.connError(err)
+		}
+		if first && f.Type != FrameSettings {
+			return sc.connError(ConnError{ErrCodeProtocol, "client preface must start with SETTINGS"})
+		}
+		first = false
+		if err := sc.processFrame(f); err != nil {
+			var se StreamError
+			if errors.As(err, &se) {
+				sc.resetStream(se.StreamID, se.Code)
+				continue
+			}
+			return sc.connError(err)
+		}
+	}
+}
+
+// connError tears the connection down for err, telling the client why
+// when it is a protocol violation.
+func (sc *serverConn) connError(err error) error {
+	var ce ConnError
+	if errors.As(err, &ce) {
+		sc.goAway(ce.Code)
+		return err
+	}
+	var ve hpackError
+	if errors.As(err, &ve) {
+		sc.goAway(ErrCodeCompression)
+		return err
+	}
+	if sc.isClosed() {
+		return nil
+	}
+	return err
+}
+
+func (sc *serverConn) writePreface() error {
+	settings := []Setting{
+		{SettingMaxConcurrentStreams, sc.cfg.MaxConcurrentStreams},
+		{SettingInitialWindowSize, sc.cfg.InitialWindowSize},
+		{SettingMaxHeaderListSize, sc.cfg.MaxHeaderListSize},
+	}
+	if sc.cfg.MaxFrameSize != minMaxFrameSize {
+		settings = append(settings, Setting{SettingMaxFrameSize, sc.cfg.MaxFrameSize})
+	}
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	sc.writeFrame(FrameSettings, 0, 0, appendSettings(nil, settings...))
+	if sc.cfg.InitialWindowSize > initialWindowSize {
+		sc.writeWindowUpdate(0, sc.cfg.InitialWindowSize-initialWindowSize)
+	}
+	return sc.flush()
+}
+
+func (sc *serverConn) readPreface() error {
+	buf := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.br, buf); err != nil {
+		return fmt.Errorf("http2: reading client preface: %w", err)
+	}
+	if string(buf) != ClientPreface {
+		return errors.New("http2: bogus client preface")
+	}
+	return nil
+}
+
+// setIdleDeadlineLocked arms the idle timeout while no stream is open. It
+// runs under mu whenever the set of streams changes, so the deadline can't
+// fire with a stream open.
+func (sc *serverConn) setIdleDeadlineLocked() {
+	if sc.opts.IdleTimeout <= 0 {
+		return
+	}
+	if len(sc.streams) == 0 {
+		sc.conn.SetReadDeadline(time.Now().Add(sc.opts.IdleTimeout))
+	} else {
+		sc.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (sc *serverConn) watchShutdown() {
+	select {
+	case <-sc.opts.Shutdown:
+		sc.goAway(ErrCodeNo)
+		sc.closeIfDrained()
+	case <-sc.done:
+	}
+}
+
+func (sc *serverConn) processFrame(f Frame) error {
+	if sc.headerStream != 0 && (f.Type != FrameContinuation || f.StreamID != sc.headerStream) {
+		return ConnError{ErrCodeProtocol, fmt.Sprintf("%s frame while expecting CONTINUATION", f.Type)}
+	}
+	switch f.Type {
+	case FrameData:
+		return sc.processData(f)
+	case FrameHeaders:
+		return sc.processHeaders(f)
+	case FrameContinuation:
+		return sc.processContinuation(f)
+	case FramePriority:
+		if f.StreamID == 0 {
+			return ConnError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.Payload) != 5 {
+			return StreamError{f.StreamID, ErrCodeFrameSize, "PRIORITY length"}
+		}
+		return nil
+	case FrameRSTStream:
+		return sc.processRSTStream(f)
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePushPromise:
+		return ConnError{ErrCodeProtocol, "PUSH_PROMISE from client"}
+	case FramePing:
+		return sc.processPing(f)
+	case FrameGoAway:
+		if f.StreamID != 0 {
+			return ConnError{ErrCodeProtocol, "GOAWAY on a stream"}
+		}
+		sc.mu.Lock()
+		sc.goingAway = true
+		sc.mu.Unlock()
+		sc.closeIfDrained()
+		return nil
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	default:
+		// unknown frame types must be ignored
+		return nil
+	}
+}
+
+func (sc *serverConn) processSettings(f Frame) error {
+	if f.StreamID != 0 {
+		return ConnError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return ConnError{ErrCodeFrameSize, "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.Payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	sc.writeFrame(FrameSettings, FlagAck, 0, nil)
+	return sc.flush()
+}
+
+func (sc *serverConn) applySettings(settings []Setting) error {
+	for _, s := range settings {
+		switch s.ID {
+		case SettingHeaderTableSize:
+			sc.wmu.Lock()
+			sc.enc.SetMaxDynamicTableSizeLimit(s.Value)
+			sc.wmu.Unlock()
+		case SettingEnablePush:
+			if s.Value > 1 {
+				return ConnError{ErrCodeProtocol, "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case SettingInitialWindowSize:
+			if s.Value > maxWindowSize {
+				return ConnError{ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE too large"}
+			}
+			sc.mu.Lock()
+			delta := int64(s.Value) - sc.peerInitialWindow
+			sc.peerInitialWindow = int64(s.Value)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					sc.mu.Unlock()
+					return ConnError{ErrCodeFlowControl, "stream window overflow"}
+				}
+			}
+			sc.cond.Broadcast()
+			sc.mu.Unlock()
+		case SettingMaxFrameSize:
+			if s.Value < minMaxFrameSize || s.Value > maxMaxFrameSize {
+				return ConnError{ErrCodeProtocol, "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			sc.mu.Lock()
+			sc.peerMaxFrameSize = s.Value
+			sc.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+func (sc *serverConn) processPing(f Frame) error {
+	if f.StreamID != 0 {
+		return ConnError{ErrCodeProtocol, "PING on a stream"}
+	}
+	if len(f.Payload) != 8 {
+		return ConnError{ErrCodeFrameSize, "PING length"}
+	}
+	if f.Has(FlagAck) {
+		return nil
+	}
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	sc.writeFrame(FramePing, FlagAck, 0, f.Payload)
+	return sc.flush()
+}
+
+func (sc *serverConn) processWindowUpdate(f Frame) error {
+	if len(f.Payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "WINDOW_UPDATE length"}
+	}
+	incr := int64(binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1))
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.StreamID == 0 {
+		if incr == 0 {
+			return ConnError{ErrCodeProtocol, "WINDOW_UPDATE of 0"}
+		}
+		sc.sendWindow += incr
+		if sc.sendWindow > maxWindowSize {
+			return ConnError{ErrCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+	if f.StreamID > sc.maxStreamID {
+		return ConnError{ErrCodeProtocol, "WINDOW_UPDATE on idle stream"}
+	}
+	st := sc.streams[f.StreamID]
+	if st == nil {
+		return nil
+	}
+	if incr == 0 {
+		return StreamError{f.StreamID, ErrCodeProtocol, "WINDOW_UPDATE of 0"}
+	}
+	st.sendWindow += incr
+	if st.sendWindow > maxWindowSize {
+		return StreamError{f.StreamID, ErrCodeFlowControl, "stream window overflow"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f Frame) error {
+	if f.StreamID == 0 {
+		return ConnError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.Payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "RST_STREAM length"}
+	}
+	sc.mu.Lock()
+	if f.StreamID > sc.maxStreamID {
+		sc.mu.Unlock()
+		return ConnError{ErrCodeProtocol, "RST_STREAM on idle stream"}
+	}
+	st := sc.streams[f.StreamID]
+	sc.mu.Unlock()
+	if st != nil {
+		sc.closeStream(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processData(f Frame) error {
+	if f.StreamID == 0 {
+		return ConnError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+	// flow control counts the whole payload, padding included, even for
+	// frames we end up discarding
+	n := int64(len(f.Payload))
+	if n > sc.recvWindow {
+		return ConnError{ErrCodeFlowControl, "connection window exceeded"}
+	}
+	sc.recvWindow -= n
+	if err := sc.refillConnWindow(n); err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	st := sc.streams[f.StreamID]
+	idle := f.StreamID > sc.maxStreamID
+	sc.mu.Unlock()
+	if idle {
+		return ConnError{ErrCodeProtocol, "DATA on idle stream"}
+	}
+	if st == nil || st.remoteClosed {
+		return StreamError{f.StreamID, ErrCodeStreamClosed, "DATA on closed stream"}
+	}
+	if n > st.recvWindow {
+		return StreamError{f.StreamID, ErrCodeFlowControl, "stream window exceeded"}
+	}
+	st.recvWindow -= n
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if st.rejected {
+		// the client is still sending the body of a request we already
+		// answered; drop it
+	} else if sc.opts.MaxBodyBytes > 0 && len(st.req.Body)+len(data) > sc.opts.MaxBodyBytes {
+		st.rejected = true
+		sc.reject(st, statusContentTooLarge)
+	} else {
+		st.req.Body = append(st.req.Body, data...)
+		if st.digest != nil {
+			st.digest.Write(data)
+		}
+	}
+	if f.Has(FlagEndStream) {
+		return sc.endRequest(st)
+	}
+	return sc.refillStreamWindow(st, n)
+}
+
+// refillConnWindow hands consumed connection window back to the client.
+// Bodies are buffered whole, so there is no reason to hold it back.
+func (sc *serverConn) refillConnWindow(n int64) error {
+	sc.recvUnacked += n
+	if sc.recvUnacked < int64(sc.cfg.InitialWindowSize)/2 {
+		return nil
+	}
+	incr := sc.recvUnacked
+	sc.recvUnacked = 0
+	sc.recvWindow += incr
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	sc.writeWindowUpdate(0, uint32(incr))
+	return sc.flush()
+}
+
+func (sc *serverConn) refillStreamWindow(st *stream, n int64) error {
+	st.recvUnacked += n
+	if st.recvUnacked < int64(sc.cfg.InitialWindowSize)/2 {
+		return nil
+	}
+	incr := st.recvUnacked
+	st.recvUnacked = 0
+	st.recvWindow += incr
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	sc.writeWindowUpdate(st.id, uint32(incr))
+	return sc.flush()
+}
+
+func (sc *serverConn) processHeaders(f Frame) error {
+	id := f.StreamID
+	if id == 0 {
+		return ConnError{ErrCodeProtocol, "HEADERS on stream 0"}
+	}
+	p, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.Has(FlagPriority) {
+		if len(p) < 5 {
+			return ConnError{ErrCodeFrameSize, "HEADERS priority fields"}
+		}
+		p = p[5:]
+	}
+	sc.headerBlock = append(sc.headerBlock[:0], p...)
+	sc.headerEndStream = f.Has(FlagEndStream)
+	if !f.Has(FlagEndHeaders) {
+		sc.headerStream = id
+		return nil
+	}
+	return sc.processHeaderBlock(id)
+}
+
+func (sc *serverConn) processContinuation(f Frame) error {
+	if sc.headerStream == 0 {
+		return ConnError{ErrCodeProtocol, "unexpected CONTINUATION"}
+	}
+	if len(sc.headerBlock)+len(f.Payload) > int(sc.cfg.MaxHeaderListSize)*2 {
+		return ConnError{ErrCodeEnhanceYourCalm, "header block too large"}
+	}
+	sc.headerBlock = append(sc.headerBlock, f.Payload...)
+	if !f.Has(FlagEndHeaders) {
+		return nil
+	}
+	id := sc.headerStream
+	sc.headerStream = 0
+	return sc.processHeaderBlock(id)
+}
+
+// processHeaderBlock handles a complete header block, which either opens
+// a stream or carries its trailers.
+func (sc *serverConn) processHeaderBlock(id uint32) error {
+	// the block has to be decoded even if the stream is refused, to keep
+	// the HPACK state in sync with the client
+	fields, err := sc.dec.Decode(sc.headerBlock)
+	if err != nil {
+		return hpackError{err}
+	}
+	endStream := sc.headerEndStream
+
+	sc.mu.Lock()
+	st := sc.streams[id]
+	if id <= sc.maxStreamID {
+		sc.mu.Unlock()
+		if st == nil {
+			return ConnError{ErrCodeStreamClosed, fmt.Sprintf("HEADERS on closed stream %d", id)}
+		}
+		return sc.processTrailers(st, fields, endStream)
+	}
+	if id%2 == 0 {
+		sc.mu.Unlock()
+		return ConnError{ErrCodeProtocol, "client opened an even stream"}
+	}
+	sc.maxStreamID = id
+	if sc.goingAway {
+		sc.mu.Unlock()
+		return nil
+	}
+	if uint32(sc.active) >= sc.cfg.MaxConcurrentStreams {
+		sc.mu.Unlock()
+		return StreamError{id, ErrCodeRefusedStream, "too many concurrent streams"}
+	}
+	sc.mu.Unlock()
+
+	st = sc.newStream(id)
+	req, status, err := newRequest(fields, sc.cfg.MaxHeaderListSize)
+	if err != nil {
+		sc.closeStream(st)
+		return StreamError{id, ErrCodeProtocol, err.Error()}
+	}
+	req.TLS = sc.opts.TLS
+	st.attach(req)
+	if status == 0 {
+		if st.digest, err = request.NewDigestVerifier(req.Headers); err != nil {
+			status = statusBadRequest
+		}
+	}
+	if status != 0 {
+		st.rejected = true
+		sc.reject(st, status)
+	} else if sc.opts.MaxBodyBytes > 0 && st.declaredLen > int64(sc.opts.MaxBodyBytes) {
+		st.rejected = true
+		sc.reject(st, statusContentTooLarge)
+	}
+	if endStream {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processTrailers(st *stream, fields []hpack.HeaderField, endStream bool) error {
+	if st.remoteClosed {
+		return ConnError{ErrCodeStreamClosed, fmt.Sprintf("HEADERS on half-closed stream %d", st.id)}
+	}
+	if !endStream {
+		return StreamError{st.id, ErrCodeProtocol, "trailers without END_STREAM"}
+	}
+	if err := addTrailers(st.req, fields); err != nil {
+		return StreamError{st.id, ErrCodeProtocol, err.Error()}
+	}
+	return sc.endRequest(st)
+}
+
+// endRequest handles the client's END_STREAM: the request is complete and
+// its handler can run.
+func (sc *serverConn) endRequest(st *stream) error {
+	sc.mu.Lock()
+	st.remoteClosed = true
+	ended := st.localClosed
+	sc.mu.Unlock()
+	if st.rejected {
+		// whichever of this and the rejection's END_STREAM comes last
+		// closes the stream
+		if ended {
+			sc.closeStream(st)
+		}
+		return nil
+	}
+	if st.declaredLen >= 0 && st.declaredLen != int64(len(st.req.Body)) {
+		return StreamError{st.id, ErrCodeProtocol, "body doesn't match content-length"}
+	}
+	if st.digest != nil && st.digest.Verify() != nil {
+		st.rejected = true
+		sc.reject(st, statusBadRequest)
+		return nil
+	}
+	sc.startHandler(st, sc.opts.Handler)
+	return nil
+}
+
+func (sc *serverConn) newStream(id uint32) *stream {
+	ctx, cancel := context.WithCancel(sc.ctx)
+	st := &stream{
+		sc:          sc,
+		id:          id,
+		ctx:         ctx,
+		cancel:      cancel,
+		recvWindow:  int64(sc.cfg.InitialWindowSize),
+		declaredLen: -1,
+	}
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[id] = st
+	sc.active++
+	active := len(sc.streams) == 1
+	sc.setIdleDeadlineLocked()
+	sc.mu.Unlock()
+	if active && sc.opts.IdleChanged != nil {
+		sc.opts.IdleChanged(false)
+	}
+	return st
+}
+
+// closeStream forgets st and cancels its context. It is safe to call more
+// than once.
+func (sc *serverConn) closeStream(st *stream) {
+	sc.mu.Lock()
+	if st.closed {
+		sc.mu.Unlock()
+		return
+	}
+	st.closed = true
+	sc.retireLocked(st)
+	delete(sc.streams, st.id)
+	idle := len(sc.streams) == 0
+	sc.setIdleDeadlineLocked()
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	st.cancel()
+	if idle && sc.opts.IdleChanged != nil {
+		sc.opts.IdleChanged(true)
+	}
+	sc.closeIfDrained()
+}
+
+// retireLocked stops st counting against MaxConcurrentStreams. It is
+// called before END_STREAM is written, as a client may open its next
+// stream the moment it sees that frame.
+func (sc *serverConn) retireLocked(st *stream) {
+	if !st.retired {
+		st.retired = true
+		sc.active--
+	}
+}
+
+// resetStream sends RST_STREAM and closes the stream if it is open.
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.wmu.Lock()
+	sc.writeRSTStream(id, code)
+	sc.flush()
+	sc.wmu.Unlock()
+	sc.mu.Lock()
+	st := sc.streams[id]
+	sc.mu.Unlock()
+	if st != nil {
+		sc.closeStream(st)
+	}
+}
+
+func (sc *serverConn) openStreams() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return len(sc.streams)
+}
+
+func (sc *serverConn) isClosed() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.closed
+}
+
+// goAway tells the client no streams past the last one seen will be
+// processed. Only the first GOAWAY is sent.
+func (sc *serverConn) goAway(code ErrCode) {
+	sc.mu.Lock()
+	if sc.goingAway && code == ErrCodeNo || sc.closed {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goingAway = true
+	sc.goAwayPending = true
+	lastStreamID := sc.maxStreamID
+	sc.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	sc.wmu.Lock()
+	sc.writeFrame(FrameGoAway, 0, 0, payload)
+	sc.flush()
+	sc.wmu.Unlock()
+	sc.mu.Lock()
+	sc.goAwayPending = false
+	sc.mu.Unlock()
+	// streams that finished while the frame was written left closing to us
+	sc.closeIfDrained()
+}
+
+// closeIfDrained closes the connection once GOAWAY was exchanged and the
+// last stream has finished.
+func (sc *serverConn) closeIfDrained() {
+	sc.mu.Lock()
+	drained := sc.goingAway && !sc.goAwayPending && len(sc.streams) == 0 && !sc.closed
+	sc.mu.Unlock()
+	if drained {
+		sc.close()
+	}
+}
+
+// close shuts the connection, failing every pending write.
+func (sc *serverConn) close() {
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		return
+	}
+	sc.closed = true
+	close(sc.done)
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	sc.cancel()
+	sc.conn.Close()
+}
+
+// writeFrame buffers a frame. The caller holds wmu and flushes.
+func (sc *serverConn) writeFrame(t FrameType, flags uint8, streamID uint32, payload []byte) {
+	var hdr [frameHeaderLen]byte
+	sc.bw.Write(appendFrameHeader(hdr[:0], FrameHeader{uint32(len(payload)), t, flags, streamID}))
+	sc.bw.Write(payload)
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID, incr uint32) {
+	sc.writeFrame(FrameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, incr))
+}
+
+func (sc *serverConn) writeRSTStream(streamID uint32, code ErrCode) {
+	sc.writeFrame(FrameRSTStream, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+// flush sends buffered frames. A failed write is fatal to the connection.
+func (sc *serverConn) flush() error {
+	if sc.opts.WriteTimeout > 0 {
+		sc.conn.SetWriteDeadline(time.Now().Add(sc.opts.WriteTimeout))
+	}
+	err := sc.bw.Flush()
+	if err != nil {
+		go sc.close()
+		return errClientDisconnected
+	}
+	return nil
+}
+
+// upgrade sets the connection up as if the client had sent the settings of
+// its HTTP2-Settings header and opened stream 1 with the upgraded request.
+func (sc *serverConn) upgrade() error {
+	settings, err := parseSettings(sc.opts.UpgradeSettings)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	sc.maxStreamID = 1
+	st := sc.newStream(1)
+	req := sc.opts.Upgrade
+	req.RequestLine.HttpVersion = "2"
+	st.attach(req)
+	return sc.endRequest(st)
+}
+
+type hpackError struct {
+	err error
+}
+
+func (e hpackError) Error() string {
+	return e.err.Error()
+}
+
+func (e hpackError) Unwrap() error {
+	return e.err
+}
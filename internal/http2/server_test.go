@@ -0,0 +1,377 @@
+package http2
+
+import (
+	"encoding/binary"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/hpack"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient speaks raw frames to a ServeConn on the other end of a pipe.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	enc    *hpack.Encoder
+	dec    *hpack.Decoder
+	frames chan Frame
+	done   chan error
+}
+
+func newTestClient(t *testing.T, cfg Config, opts ServeConnOpts) *testClient {
+	t.Helper()
+	server, client := net.Pipe()
+	c := &testClient{
+		t:      t,
+		conn:   client,
+		enc:    hpack.NewEncoder(hpack.DefaultTableSize),
+		dec:    hpack.NewDecoder(hpack.DefaultTableSize),
+		frames: make(chan Frame, 100),
+		done:   make(chan error, 1),
+	}
+	go func() {
+		c.done <- ServeConn(server, cfg, opts)
+	}()
+	go func() {
+		defer close(c.frames)
+		for {
+			var buf []byte
+			f, err := ReadFrame(client, &buf, maxMaxFrameSize)
+			if err != nil {
+				return
+			}
+			c.frames <- f
+		}
+	}()
+	t.Cleanup(func() { client.Close() })
+	c.write([]byte(ClientPreface))
+	return c
+}
+
+func (c *testClient) write(p []byte) {
+	_, err := c.conn.Write(p)
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) writeFrame(t FrameType, flags uint8, streamID uint32, payload []byte) {
+	c.write(AppendFrame(nil, t, flags, streamID, payload))
+}
+
+func (c *testClient) writeSettings(settings ...Setting) {
+	c.writeFrame(FrameSettings, 0, 0, appendSettings(nil, settings...))
+}
+
+func (c *testClient) writeRequest(streamID uint32, method, path string, endStream bool) {
+	block := c.enc.AppendBlock(nil, []hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "example.com"},
+	})
+	flags := FlagEndHeaders
+	if endStream {
+		flags |= FlagEndStream
+	}
+	c.writeFrame(FrameHeaders, flags, streamID, block)
+}
+
+// next returns the next frame that isn't part of connection setup.
+func (c *testClient) next() Frame {
+	c.t.Helper()
+	for {
+		select {
+		case f, ok := <-c.frames:
+			require.True(c.t, ok, "connection closed")
+			if f.Type == FrameSettings || (f.Type == FrameWindowUpdate && f.StreamID == 0) {
+				continue
+			}
+			return f
+		case <-time.After(2 * time.Second):
+			require.FailNow(c.t, "timed out waiting for a frame")
+		}
+	}
+}
+
+// readResponse collects the status, header fields and body of streamID.
+func (c *testClient) readResponse(streamID uint32) (int, map[string]string, string) {
+	c.t.Helper()
+	fields := map[string]string{}
+	var body []byte
+	for {
+		f := c.next()
+		require.Equal(c.t, streamID, f.StreamID, "frame %s on unexpected stream", f.Type)
+		switch f.Type {
+		case FrameHeaders:
+			decoded, err := c.dec.Decode(f.Payload)
+			require.NoError(c.t, err)
+			for _, hf := range decoded {
+				fields[hf.Name] = hf.Value
+			}
+		case FrameData:
+			body = append(body, f.Payload...)
+		case FrameRSTStream:
+			require.FailNow(c.t, "stream reset", ErrCode(binary.BigEndian.Uint32(f.Payload)).String())
+		}
+		if f.Has(FlagEndStream) {
+			status, _ := strconv.Atoi(fields[":status"])
+			return status, fields, string(body)
+		}
+	}
+}
+
+func okHandler(w *response.Writter, req *request.Request) {
+	body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + req.Headers.Get("Host") + " " + string(req.Body)
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func TestServeConn(t *testing.T) {
+	// Test: Requests are decoded and answered on their stream
+	c := newTestClient(t, Config{}, ServeConnOpts{Handler: okHandler})
+	c.writeSettings()
+	c.writeRequest(1, "GET", "/a?b=c", true)
+	status, fields, body := c.readResponse(1)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "text/plain", fields["content-type"])
+	assert.Equal(t, "GET /a?b=c example.com ", body)
+
+	// Test: Bodies arrive in DATA frames
+	c.writeRequest(3, "POST", "/", false)
+	c.writeFrame(FrameData, 0, 3, []byte("hel"))
+	c.writeFrame(FrameData, FlagEndStream, 3, []byte("lo"))
+	_, _, body = c.readResponse(3)
+	assert.Equal(t, "POST / example.com hello", body)
+
+	// Test: PING is acknowledged with the same payload
+	c.writeFrame(FramePing, 0, 0, []byte("12345678"))
+	f := c.next()
+	assert.Equal(t, FramePing, f.Type)
+	assert.True(t, f.Has(FlagAck))
+	assert.Equal(t, "12345678", string(f.Payload))
+
+	// Test: HEAD responses carry no body
+	c.writeRequest(5, "HEAD", "/", true)
+	_, fields, body = c.readResponse(5)
+	assert.Equal(t, "", body)
+	assert.Equal(t, "19", fields["content-length"])
+
+	// Test: Bodies not matching their Content-Digest get a 400
+	for _, tt := range []struct {
+		id     uint32
+		data   string
+		status int
+	}{{7, "hello", 200}, {9, "hellO", 400}} {
+		block := c.enc.AppendBlock(nil, []hpack.HeaderField{
+			{Name: ":method", Value: "POST"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"},
+			{Name: ":authority", Value: "example.com"},
+			{Name: "content-digest", Value: "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:"},
+		})
+		c.writeFrame(FrameHeaders, FlagEndHeaders, tt.id, block)
+		c.writeFrame(FrameData, FlagEndStream, tt.id, []byte(tt.data))
+		status, _, _ = c.readResponse(tt.id)
+		assert.Equal(t, tt.status, status)
+	}
+
+	// Test: Without MaxBodyBytes, bodies are capped at DefaultMaxBodyBytes
+	block := c.enc.AppendBlock(nil, []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: "content-length", Value: strconv.Itoa(DefaultMaxBodyBytes + 1)},
+	})
+	c.writeFrame(FrameHeaders, FlagEndHeaders, 11, block)
+	status, _, _ = c.readResponse(11)
+	assert.Equal(t, 413, status)
+	f = c.next()
+	assert.Equal(t, FrameRSTStream, f.Type)
+
+	// Test: A protocol violation ends the connection with GOAWAY
+	c.writeFrame(FrameData, 0, 0, []byte("x"))
+	f = c.next()
+	require.Equal(t, FrameGoAway, f.Type)
+	assert.Equal(t, uint32(11), binary.BigEndian.Uint32(f.Payload))
+	assert.Equal(t, ErrCodeProtocol, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+	assert.Error(t, <-c.done)
+}
+
+func TestServeConnStreams(t *testing.T) {
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+	handler := func(w *response.Writter, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/block":
+			select {
+			case <-release:
+			case <-req.Context().Done():
+				close(cancelled)
+				return
+			}
+		case "/big":
+			body := strings.Repeat("x", 100)
+			w.WriteStatusLine(response.StatusOk)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+			return
+		}
+		okHandler(w, req)
+	}
+	c := newTestClient(t, Config{MaxConcurrentStreams: 1}, ServeConnOpts{Handler: handler, MaxBodyBytes: 4})
+	c.writeSettings(Setting{SettingInitialWindowSize, 30})
+
+	// Test: Streams over MaxConcurrentStreams are refused
+	c.writeRequest(1, "GET", "/block", true)
+	c.writeRequest(3, "GET", "/", true)
+	f := c.next()
+	assert.Equal(t, FrameRSTStream, f.Type)
+	assert.Equal(t, uint32(3), f.StreamID)
+	assert.Equal(t, ErrCodeRefusedStream, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+
+	// Test: RST_STREAM from the client cancels the handler's context
+	c.writeFrame(FrameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("handler context not cancelled")
+	}
+
+	// Test: DATA is held to the stream window until WINDOW_UPDATE
+	c.writeRequest(5, "GET", "/big", true)
+	var got int
+	for got < 30 {
+		f = c.next()
+		switch f.Type {
+		case FrameHeaders:
+			_, err := c.dec.Decode(f.Payload)
+			require.NoError(t, err)
+		case FrameData:
+			got += len(f.Payload)
+		}
+	}
+	assert.Equal(t, 30, got)
+	select {
+	case f := <-c.frames:
+		t.Fatalf("unexpected %s frame past the window", f.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.writeFrame(FrameWindowUpdate, 0, 5, binary.BigEndian.AppendUint32(nil, 100))
+	for !f.Has(FlagEndStream) {
+		f = c.next()
+		got += len(f.Payload)
+	}
+	assert.Equal(t, 100, got)
+
+	// Test: Bodies over MaxBodyBytes get a 413 and the stream is reset
+	c.writeRequest(7, "POST", "/", false)
+	c.writeFrame(FrameData, 0, 7, []byte("too long"))
+	status, _, _ := c.readResponse(7)
+	assert.Equal(t, 413, status)
+	f = c.next()
+	assert.Equal(t, FrameRSTStream, f.Type)
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+	close(release)
+}
+
+func TestServeConnShutdown(t *testing.T) {
+	shutdown := make(chan struct{})
+	release := make(chan struct{})
+	handler := func(w *response.Writter, req *request.Request) {
+		<-release
+		okHandler(w, req)
+	}
+	c := newTestClient(t, Config{}, ServeConnOpts{Handler: handler, Shutdown: shutdown})
+	c.writeSettings()
+	c.writeRequest(1, "GET", "/", true)
+	require.Eventually(t, func() bool { return len(c.frames) > 0 }, time.Second, time.Millisecond)
+
+	// Test: Shutdown sends GOAWAY but lets open streams finish
+	close(shutdown)
+	f := c.next()
+	require.Equal(t, FrameGoAway, f.Type)
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(f.Payload))
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+	close(release)
+	status, _, _ := c.readResponse(1)
+	assert.Equal(t, 200, status)
+	select {
+	case err := <-c.done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed after draining")
+	}
+}
+
+func TestServeConnIdleTimeout(t *testing.T) {
+	idle := make(chan bool, 10)
+	c := newTestClient(t, Config{}, ServeConnOpts{
+		Handler:     okHandler,
+		IdleTimeout: 50 * time.Millisecond,
+		IdleChanged: func(v bool) { idle <- v },
+	})
+	c.writeSettings()
+	c.writeRequest(1, "GET", "/", true)
+	c.readResponse(1)
+	assert.False(t, <-idle)
+	assert.True(t, <-idle)
+
+	// Test: A connection without streams is closed after IdleTimeout
+	f := c.next()
+	assert.Equal(t, FrameGoAway, f.Type)
+	assert.ErrorContains(t, <-c.done, "idle")
+}
+
+func TestNewRequest(t *testing.T) {
+	fields := func(kv ...string) []hpack.HeaderField {
+		var out []hpack.HeaderField
+		for i := 0; i < len(kv); i += 2 {
+			out = append(out, hpack.HeaderField{Name: kv[i], Value: kv[i+1]})
+		}
+		return out
+	}
+	base := []string{":method", "GET", ":scheme", "https", ":path", "/"}
+
+	// Test: Repeated fields are folded, cookies with "; "
+	req, status, err := newRequest(fields(append(base, "cookie", "a=1", "cookie", "b=2", "accept", "x", "accept", "y")...), 1<<20)
+	require.NoError(t, err)
+	assert.Zero(t, status)
+	assert.Equal(t, "a=1; b=2", req.Headers.Get("Cookie"))
+	assert.Equal(t, "x, y", req.Headers.Get("Accept"))
+	assert.Equal(t, "2", req.RequestLine.HttpVersion)
+
+	// Test: Malformed header blocks are rejected
+	for _, bad := range [][]string{
+		{":method", "GET", ":path", "/"},
+		append(base, ":method", "POST"),
+		append([]string{"accept", "x"}, base...),
+		append(base, ":protocol", "x"),
+		append(base, "Accept", "x"),
+		append(base, "connection", "close"),
+		append(base, "te", "gzip"),
+	} {
+		_, _, err := newRequest(fields(bad...), 1<<20)
+		assert.Error(t, err, bad)
+	}
+
+	// Test: Oversized header lists are refused with 431
+	_, status, err = newRequest(fields(append(base, "x-big", strings.Repeat("a", 100))...), 100)
+	require.NoError(t, err)
+	assert.Equal(t, statusHeaderTooLarge, status)
+
+	// Test: Connection-specific response headers are dropped
+	h := headers.NewHeaders()
+	h.Set("Connection", "close")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Content-Type", "text/plain")
+	assert.Equal(t, []hpack.HeaderField{{Name: "content-type", Value: "text/plain"}}, appendFields(nil, h))
+}
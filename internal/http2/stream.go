@@ -0,0 +1,332 @@
+package http2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/hpack"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+const (
+	statusBadRequest      = response.StatusBadRequest
+	statusContentTooLarge = response.StatusContentTooLarge
+	statusHeaderTooLarge  = response.StatusHeaderTooLarge
+)
+
+var errStreamClosed = errors.New("http2: stream closed")
+
+// stream is one request/response exchange. It implements response.Stream
+// for the handler's Writter.
+type stream struct {
+	sc     *serverConn
+	id     uint32
+	ctx    context.Context
+	cancel context.CancelFunc
+	req    *request.Request
+
+	// owned by the serve goroutine
+	recvWindow  int64
+	recvUnacked int64
+	declaredLen int64
+	digest      *request.DigestVerifier
+	// rejected is set when the server answered the request itself, e.g.
+	// with a 413, and no handler runs
+	rejected bool
+
+	// guarded by sc.mu; remoteClosed is only written by the serve
+	// goroutine, which may read it unlocked
+	sendWindow   int64
+	remoteClosed bool
+	localClosed  bool
+	closed       bool
+	// retired is set once st no longer counts as active
+	retired bool
+}
+
+func (st *stream) attach(req *request.Request) {
+	st.req = req.WithContext(st.ctx)
+	if v := req.Headers.Get("Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			st.declaredLen = n
+		}
+	}
+}
+
+// startHandler runs h for st in its own goroutine.
+func (sc *serverConn) startHandler(st *stream, h Handler) {
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		sc.runHandler(st, h)
+	}()
+}
+
+func (sc *serverConn) runHandler(st *stream, h Handler) {
+	w := response.NewStreamWritter(st)
+	if st.req.RequestLine.Method == "HEAD" {
+		w.DiscardBody()
+	}
+	defer func() {
+		defer st.cancel()
+		if rec := recover(); rec != nil {
+			if sc.opts.OnPanic != nil {
+				sc.opts.OnPanic(rec, debug.Stack(), st.req)
+			}
+			if w.StatusCode() != 0 {
+				// part of the response is out; resetting the stream keeps
+				// the client from taking it as complete
+				sc.resetStream(st.id, ErrCodeInternal)
+				return
+			}
+			response.WriteText(w, response.StatusInternalServerError, nil, response.StatusInternalServerError.String()+"\n")
+		}
+		w.Finish()
+		sc.mu.Lock()
+		ended := st.localClosed || st.closed
+		sc.mu.Unlock()
+		if !ended {
+			// the handler didn't write a response at all
+			sc.resetStream(st.id, ErrCodeInternal)
+		}
+	}()
+	h(w, st.req)
+}
+
+// reject answers st with statusCode without involving the handler.
+func (sc *serverConn) reject(st *stream, statusCode response.StatusCode) {
+	sc.startHandler(st, func(w *response.Writter, req *request.Request) {
+		response.WriteText(w, statusCode, nil, statusCode.String()+"\n")
+	})
+}
+
+func (st *stream) WriteHeaders(statusCode int, h headers.Headers, endStream bool) error {
+	fields := make([]hpack.HeaderField, 0, len(h)+1)
+	fields = append(fields, hpack.HeaderField{Name: ":status", Value: strconv.Itoa(statusCode)})
+	fields = appendFields(fields, h)
+	return st.writeHeaderBlock(fields, endStream)
+}
+
+func (st *stream) WriteTrailers(h headers.Headers) error {
+	return st.writeHeaderBlock(appendFields(nil, h), true)
+}
+
+func (st *stream) writeHeaderBlock(fields []hpack.HeaderField, endStream bool) error {
+	sc := st.sc
+	sc.mu.Lock()
+	if st.closed || sc.closed {
+		sc.mu.Unlock()
+		return errStreamClosed
+	}
+	if endStream {
+		sc.retireLocked(st)
+	}
+	maxFrame := int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+
+	sc.wmu.Lock()
+	block := sc.enc.AppendBlock(nil, fields)
+	flags := uint8(0)
+	if endStream {
+		flags |= FlagEndStream
+	}
+	t := FrameHeaders
+	for {
+		chunk := block[:min(len(block), maxFrame)]
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+		sc.writeFrame(t, flags, st.id, chunk)
+		if len(block) == 0 {
+			break
+		}
+		t, flags = FrameContinuation, 0
+	}
+	err := sc.flush()
+	sc.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	if endStream {
+		st.endLocal()
+	}
+	return nil
+}
+
+func (st *stream) WriteData(p []byte, endStream bool) error {
+	if st.req.RequestLine.Method == "HEAD" {
+		p = nil
+	}
+	sc := st.sc
+	for len(p) > 0 || endStream {
+		n, err := st.reserve(len(p))
+		if err != nil {
+			return err
+		}
+		chunk := p[:n]
+		p = p[n:]
+		flags := uint8(0)
+		last := endStream && len(p) == 0
+		if last {
+			flags = FlagEndStream
+			sc.mu.Lock()
+			sc.retireLocked(st)
+			sc.mu.Unlock()
+		}
+		sc.wmu.Lock()
+		sc.writeFrame(FrameData, flags, st.id, chunk)
+		err = sc.flush()
+		sc.wmu.Unlock()
+		if err != nil {
+			return err
+		}
+		if last {
+			st.endLocal()
+			return nil
+		}
+	}
+	return nil
+}
+
+// reserve waits for send window and takes up to want bytes of it, bounded
+// by the peer's frame size.
+func (st *stream) reserve(want int) (int, error) {
+	sc := st.sc
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if st.closed || sc.closed {
+			return 0, errStreamClosed
+		}
+		if want == 0 {
+			return 0, nil
+		}
+		n := min(int64(want), st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrameSize))
+		if n > 0 {
+			st.sendWindow -= n
+			sc.sendWindow -= n
+			return int(n), nil
+		}
+		sc.cond.Wait()
+	}
+}
+
+// endLocal records that END_STREAM went out. If the client is still
+// sending, it is told to stop.
+func (st *stream) endLocal() {
+	sc := st.sc
+	sc.mu.Lock()
+	st.localClosed = true
+	remoteClosed := st.remoteClosed
+	sc.mu.Unlock()
+	if !remoteClosed {
+		sc.resetStream(st.id, ErrCodeNo)
+		return
+	}
+	sc.closeStream(st)
+}
+
+// connectionHeaders are meaningful to a single HTTP/1.1 hop only and must
+// not appear in HTTP/2.
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+func appendFields(fields []hpack.HeaderField, h headers.Headers) []hpack.HeaderField {
+	for _, f := range hpack.FromHeaders(h) {
+		if !connectionHeaders[f.Name] {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// newRequest builds a request from a decoded header block. A non-zero
+// status means the request is well-formed but has to be refused with it.
+func newRequest(fields []hpack.HeaderField, maxHeaderListSize uint32) (*request.Request, response.StatusCode, error) {
+	req := &request.Request{
+		Headers: headers.NewHeaders(),
+		Body:    make([]byte, 0),
+	}
+	req.RequestLine.HttpVersion = "2"
+	var scheme, authority string
+	var size uint32
+	regular := false
+	for _, f := range fields {
+		size += f.Size()
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return nil, 0, fmt.Errorf("pseudo-header %s after regular fields", f.Name)
+			}
+			var dst *string
+			switch f.Name {
+			case ":method":
+				dst = &req.RequestLine.Method
+			case ":path":
+				dst = &req.RequestLine.RequestTarget
+			case ":scheme":
+				dst = &scheme
+			case ":authority":
+				dst = &authority
+			default:
+				return nil, 0, fmt.Errorf("unknown pseudo-header %s", f.Name)
+			}
+			if *dst != "" {
+				return nil, 0, fmt.Errorf("duplicate pseudo-header %s", f.Name)
+			}
+			*dst = f.Value
+			continue
+		}
+		regular = true
+		if err := addField(req.Headers, f); err != nil {
+			return nil, 0, err
+		}
+	}
+	if req.RequestLine.Method == "" || scheme == "" || req.RequestLine.RequestTarget == "" {
+		return nil, 0, errors.New("missing :method, :scheme or :path")
+	}
+	if authority != "" && req.Headers.Get("Host") == "" {
+		req.Headers.Set("host", authority)
+	}
+	if size > maxHeaderListSize {
+		return req, statusHeaderTooLarge, nil
+	}
+	return req, 0, nil
+}
+
+func addTrailers(req *request.Request, fields []hpack.HeaderField) error {
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			return fmt.Errorf("pseudo-header %s in trailers", f.Name)
+		}
+		if err := addField(req.Headers, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addField validates a request field and adds it to h.
+func addField(h headers.Headers, f hpack.HeaderField) error {
+	if f.Name != strings.ToLower(f.Name) {
+		return fmt.Errorf("uppercase field name %q", f.Name)
+	}
+	if connectionHeaders[f.Name] {
+		return fmt.Errorf("connection-specific field %q", f.Name)
+	}
+	if f.Name == "te" && f.Value != "trailers" {
+		return errors.New(`te other than "trailers"`)
+	}
+	hpack.AddHeader(h, f)
+	return nil
+}
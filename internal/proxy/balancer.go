@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"hash/crc32"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy decides which upstream serves a request.
+type Strategy int
+
+const (
+	// RoundRobin takes the upstreams in turn.
+	RoundRobin Strategy = iota
+	// LeastConnections picks the upstream with the fewest requests in
+	// flight.
+	LeastConnections
+	// ConsistentHash maps the value of Config.HashHeader, or the client
+	// IP when it is empty, onto a hash ring so the same key keeps reaching
+	// the same upstream while the set of upstreams changes.
+	ConsistentHash
+)
+
+// ringReplicas is the number of points each upstream gets on the hash
+// ring, which evens out the share of keys each one receives.
+const ringReplicas = 160
+
+const DefaultEjectDuration = 30 * time.Second
+
+type upstream struct {
+	url *url.URL
+	// active counts requests in flight, for LeastConnections
+	active atomic.Int64
+	// healthy is the result of the last active health check
+	healthy atomic.Bool
+
+	mu           sync.Mutex
+	fails        int
+	ejectedUntil time.Time
+}
+
+func newUpstream(u *url.URL) *upstream {
+	up := &upstream{url: u}
+	up.healthy.Store(true)
+	return up
+}
+
+func (u *upstream) available(now time.Time) bool {
+	if !u.healthy.Load() {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.ejectedUntil)
+}
+
+// failed records a failed request, ejecting the upstream for d once
+// maxFails of them happened in a row.
+func (u *upstream) failed(maxFails int, d time.Duration) {
+	if maxFails <= 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fails++
+	if u.fails >= maxFails {
+		u.fails = 0
+		u.ejectedUntil = time.Now().Add(d)
+	}
+}
+
+func (u *upstream) succeeded() {
+	u.mu.Lock()
+	u.fails = 0
+	u.mu.Unlock()
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+type balancer struct {
+	strategy   Strategy
+	hashHeader string
+	upstreams  []*upstream
+	ring       []ringPoint
+	next       atomic.Uint64
+}
+
+func newBalancer(strategy Strategy, hashHeader string, upstreams []*upstream) *balancer {
+	b := &balancer{strategy: strategy, hashHeader: hashHeader, upstreams: upstreams}
+	if strategy == ConsistentHash {
+		for _, u := range upstreams {
+			for i := range ringReplicas {
+				h := crc32.ChecksumIEEE([]byte(u.url.String() + "#" + strconv.Itoa(i)))
+				b.ring = append(b.ring, ringPoint{hash: h, upstream: u})
+			}
+		}
+		sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	}
+	return b
+}
+
+// pick chooses an upstream not in tried. Unavailable upstreams are only
+// used when nothing else is left, so a broken health check degrades to
+// plain balancing instead of failing every request.
+func (b *balancer) pick(req *request.Request, tried map[*upstream]bool) *upstream {
+	now := time.Now()
+	var candidates, fallback []*upstream
+	for _, u := range b.upstreams {
+		switch {
+		case tried[u]:
+		case u.available(now):
+			candidates = append(candidates, u)
+		default:
+			fallback = append(fallback, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = fallback
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch b.strategy {
+	case LeastConnections:
+		return b.leastConnections(candidates)
+	case ConsistentHash:
+		if key := b.hashKey(req); key != "" {
+			return b.lookup(key, candidates)
+		}
+	}
+	return candidates[(b.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+func (b *balancer) leastConnections(candidates []*upstream) *upstream {
+	// start from a rotating offset so ties are spread out
+	start := int((b.next.Add(1) - 1) % uint64(len(candidates)))
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		u := candidates[(start+i)%len(candidates)]
+		if u.active.Load() < best.active.Load() {
+			best = u
+		}
+	}
+	return best
+}
+
+func (b *balancer) hashKey(req *request.Request) string {
+	if b.hashHeader != "" {
+		return req.Headers.Get(b.hashHeader)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// lookup walks the ring clockwise from key's hash to the first point
+// owned by one of candidates.
+func (b *balancer) lookup(key string, candidates []*upstream) *upstream {
+	eligible := make(map[*upstream]bool, len(candidates))
+	for _, u := range candidates {
+		eligible[u] = true
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	for n := 0; n < len(b.ring); n++ {
+		p := b.ring[(i+n)%len(b.ring)]
+		if eligible[p.upstream] {
+			return p.upstream
+		}
+	}
+	return candidates[0]
+}
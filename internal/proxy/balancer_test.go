@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testUpstreams(n int) []*upstream {
+	var ups []*upstream
+	for i := range n {
+		ups = append(ups, newUpstream(&url.URL{Scheme: "http", Host: fmt.Sprintf("10.0.0.%d:80", i+1)}))
+	}
+	return ups
+}
+
+func testRequest(remoteAddr string, h map[string]string) *request.Request {
+	req := &request.Request{Headers: headers.NewHeaders(), RemoteAddr: remoteAddr}
+	for k, v := range h {
+		req.Headers.Set(k, v)
+	}
+	return req
+}
+
+func TestBalancer(t *testing.T) {
+	ups := testUpstreams(3)
+	req := testRequest("192.0.2.1:5000", nil)
+
+	// Test: round robin cycles and skips ejected upstreams
+	b := newBalancer(RoundRobin, "", ups)
+	assert.Equal(t, []*upstream{ups[0], ups[1], ups[2], ups[0]},
+		[]*upstream{b.pick(req, nil), b.pick(req, nil), b.pick(req, nil), b.pick(req, nil)})
+	ups[1].failed(1, time.Minute)
+	for range 4 {
+		assert.NotEqual(t, ups[1], b.pick(req, nil))
+	}
+	ups[1].ejectedUntil = time.Time{}
+
+	// Test: tried upstreams are skipped, nil once all were tried
+	tried := map[*upstream]bool{ups[0]: true, ups[1]: true}
+	assert.Equal(t, ups[2], b.pick(req, tried))
+	tried[ups[2]] = true
+	assert.Nil(t, b.pick(req, tried))
+
+	// Test: when all are unhealthy they are used anyway
+	for _, u := range ups {
+		u.healthy.Store(false)
+	}
+	assert.NotNil(t, b.pick(req, nil))
+	for _, u := range ups {
+		u.healthy.Store(true)
+	}
+
+	// Test: least connections prefers the idle upstream
+	b = newBalancer(LeastConnections, "", ups)
+	ups[0].active.Store(3)
+	ups[1].active.Store(1)
+	ups[2].active.Store(2)
+	for range 3 {
+		assert.Equal(t, ups[1], b.pick(req, nil))
+	}
+	ups[1].active.Store(5)
+	assert.Equal(t, ups[2], b.pick(req, nil))
+
+	// Test: consistent hash is sticky per client IP and per header
+	b = newBalancer(ConsistentHash, "", ups)
+	first := b.pick(req, nil)
+	for range 5 {
+		assert.Equal(t, first, b.pick(testRequest("192.0.2.1:6000", nil), nil))
+	}
+	b = newBalancer(ConsistentHash, "X-User", ups)
+	seen := map[*upstream]bool{}
+	for i := range 50 {
+		u := b.pick(testRequest("", map[string]string{"X-User": fmt.Sprint(i)}), nil)
+		assert.Equal(t, u, b.pick(testRequest("", map[string]string{"x-user": fmt.Sprint(i)}), nil))
+		seen[u] = true
+	}
+	assert.Len(t, seen, 3)
+
+	// Test: consistent hash only moves keys of an ejected upstream
+	keys := map[string]*upstream{}
+	for i := range 50 {
+		keys[fmt.Sprint(i)] = b.pick(testRequest("", map[string]string{"X-User": fmt.Sprint(i)}), nil)
+	}
+	ups[0].failed(1, time.Minute)
+	for k, before := range keys {
+		after := b.pick(testRequest("", map[string]string{"X-User": k}), nil)
+		if before != ups[0] {
+			assert.Equal(t, before, after, k)
+		} else {
+			assert.NotEqual(t, ups[0], after, k)
+		}
+	}
+}
+
+func TestRetriesAndHealthChecks(t *testing.T) {
+	var brokenHits atomic.Int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brokenHits.Add(1)
+		// drop the connection without answering
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer broken.Close()
+	var healthy atomic.Bool
+	healthy.Store(true)
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer good.Close()
+
+	p, err := New(Config{Upstreams: []string{broken.URL, good.URL}, Retries: 1, MaxFails: 3})
+	require.NoError(t, err)
+	base := startProxy(t, p)
+
+	// Test: idempotent requests are retried on the next upstream
+	for range 2 {
+		resp, err := http.Get(base + "/")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "ok", string(body))
+	}
+
+	assert.Equal(t, int32(2), brokenHits.Load())
+
+	// Test: non-idempotent requests are not retried
+	resp, err := http.Post(base+"/", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// Test: the third failure in a row ejects the upstream
+	hits := brokenHits.Load()
+	for range 4 {
+		resp, err := http.Post(base+"/", "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, hits, brokenHits.Load())
+
+	// Test: active health checks take failing upstreams out and back in
+	p2, err := New(Config{
+		Upstreams:   []string{good.URL, broken.URL},
+		HealthCheck: &HealthCheck{Path: "/healthz", Interval: 10 * time.Millisecond},
+	})
+	require.NoError(t, err)
+	defer p2.Close()
+	assert.Eventually(t, func() bool { return !p2.upstreams[1].healthy.Load() }, time.Second, 5*time.Millisecond)
+	assert.True(t, p2.upstreams[0].healthy.Load())
+	healthy.Store(false)
+	assert.Eventually(t, func() bool { return !p2.upstreams[0].healthy.Load() }, time.Second, 5*time.Millisecond)
+	healthy.Store(true)
+	assert.Eventually(t, func() bool { return p2.upstreams[0].healthy.Load() }, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// HealthCheck configures active health checking. Every Interval each
+// upstream is sent a GET for Path; anything but a 2xx or 3xx answer within
+// Timeout takes it out of rotation until a later check passes.
+type HealthCheck struct {
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+func (p *ReverseProxy) runHealthChecks(hc HealthCheck) {
+	defer close(p.healthDone)
+	if hc.Interval <= 0 {
+		hc.Interval = DefaultHealthCheckInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = DefaultHealthCheckTimeout
+	}
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		for _, u := range p.upstreams {
+			healthy := p.check(u, hc)
+			if u.healthy.Swap(healthy) != healthy {
+				if healthy {
+					log.Printf("INFO: upstream %s is healthy again\n", u.url.Host)
+				} else {
+					log.Printf("ERROR: upstream %s failed its health check\n", u.url.Host)
+				}
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *ReverseProxy) check(u *upstream, hc HealthCheck) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+	target := *u.url
+	target.Path = joinPath(u.url.Path, hc.Path)
+	target.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
@@ -0,0 +1,493 @@
+// Package proxy implements a reverse proxy handler that forwards requests
+// to upstream HTTP servers.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDialTimeout           = 10 * time.Second
+	DefaultResponseHeaderTimeout = 30 * time.Second
+)
+
+// hopHeaders only apply to a single connection and are never forwarded
+// (RFC 9110 section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type Config struct {
+	// Upstreams are the base URLs requests are forwarded to. The request
+	// path is appended to the upstream's path.
+	Upstreams []string
+	// Strategy picks the upstream for each request. HashHeader names the
+	// header ConsistentHash keys on; empty means the client IP.
+	Strategy   Strategy
+	HashHeader string
+	// HealthCheck, if set, enables active health checks.
+	HealthCheck *HealthCheck
+	// MaxFails consecutive failed requests eject an upstream for
+	// EjectDuration, which defaults to DefaultEjectDuration. Zero disables
+	// passive ejection. A request fails when no response arrives.
+	MaxFails      int
+	EjectDuration time.Duration
+	// Retries is how many more upstreams an idempotent request is tried on
+	// when one fails to answer.
+	Retries int
+	// StripPrefix is removed from the request path before forwarding.
+	StripPrefix string
+	// PreserveHost sends the client's Host header upstream instead of the
+	// upstream's host.
+	PreserveHost bool
+	// DialTimeout and ResponseHeaderTimeout bound connecting to an
+	// upstream and waiting for its response headers. Timeout, if set,
+	// bounds the whole exchange including the body.
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	Timeout               time.Duration
+	// Digests, if set, adds digest trailers to every proxied body.
+	Digests *response.DigestOptions
+	// Transport replaces the default transport, e.g. in tests.
+	Transport http.RoundTripper
+}
+
+type ReverseProxy struct {
+	cfg       Config
+	upstreams []*upstream
+	balancer  *balancer
+	transport http.RoundTripper
+
+	stop       chan struct{}
+	healthDone chan struct{}
+}
+
+func New(cfg Config) (*ReverseProxy, error) {
+	if len(cfg.Upstreams) == 0 {
+		return nil, errors.New("proxy: no upstreams")
+	}
+	if cfg.EjectDuration <= 0 {
+		cfg.EjectDuration = DefaultEjectDuration
+	}
+	p := &ReverseProxy{cfg: cfg, transport: cfg.Transport, stop: make(chan struct{})}
+	for _, raw := range cfg.Upstreams {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: upstream %q: %w", raw, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("proxy: upstream %q must be an absolute http(s) URL", raw)
+		}
+		p.upstreams = append(p.upstreams, newUpstream(u))
+	}
+	p.balancer = newBalancer(cfg.Strategy, cfg.HashHeader, p.upstreams)
+	if p.transport == nil {
+		dialTimeout := cfg.DialTimeout
+		if dialTimeout <= 0 {
+			dialTimeout = DefaultDialTimeout
+		}
+		headerTimeout := cfg.ResponseHeaderTimeout
+		if headerTimeout <= 0 {
+			headerTimeout = DefaultResponseHeaderTimeout
+		}
+		p.transport = &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: dialTimeout}).DialContext,
+			TLSHandshakeTimeout:   dialTimeout,
+			ResponseHeaderTimeout: headerTimeout,
+			MaxIdleConnsPerHost:   32,
+			IdleConnTimeout:       90 * time.Second,
+			ForceAttemptHTTP2:     true,
+		}
+	}
+	if cfg.HealthCheck != nil {
+		p.healthDone = make(chan struct{})
+		go p.runHealthChecks(*cfg.HealthCheck)
+	}
+	return p, nil
+}
+
+// Close stops the health checks.
+func (p *ReverseProxy) Close() {
+	select {
+	case <-p.stop:
+		return
+	default:
+	}
+	close(p.stop)
+	if p.healthDone != nil {
+		<-p.healthDone
+	}
+}
+
+// ServeRequest is the proxy's Handler.
+func (p *ReverseProxy) ServeRequest(w *response.Writter, req *request.Request) {
+	ctx := req.Context()
+	if p.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.Timeout)
+		defer cancel()
+	}
+	if _, err := url.Parse(req.RequestLine.RequestTarget); err != nil {
+		response.WriteText(w, response.StatusBadRequest, nil, response.StatusBadRequest.String()+"\n")
+		return
+	}
+	attempts := 1
+	if idempotent(req.RequestLine.Method) {
+		attempts += max(p.cfg.Retries, 0)
+	}
+	var streamed *streamedBody
+	if req.BodyStreamed() {
+		streamed = &streamedBody{r: req.BodyReader()}
+		defer streamed.stop()
+	}
+	tried := make(map[*upstream]bool)
+	var err error
+	for range attempts {
+		body := req.BodyReader()
+		if streamed != nil {
+			if streamed.started() {
+				// the body is gone, it can't go to another upstream
+				break
+			}
+			body = streamed
+		}
+		u := p.balancer.pick(req, tried)
+		if u == nil {
+			break
+		}
+		tried[u] = true
+		var resp *http.Response
+		resp, err = p.roundTrip(ctx, req, body, u)
+		if err != nil {
+			if errors.Is(ctx.Err(), context.Canceled) {
+				break
+			}
+			log.Printf("ERROR: upstream %s failed. %s\n", u.url.Host, err.Error())
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		defer u.active.Add(-1)
+		defer resp.Body.Close()
+		if err := p.copyResponse(w, req, resp); err != nil {
+			log.Printf("ERROR: proxying response from %s aborted. %s\n", u.url.Host, err.Error())
+		}
+		return
+	}
+	p.roundTripFailed(w, req, err)
+}
+
+// roundTrip sends req to u, keeping u's active count raised while a
+// response is being relayed.
+func (p *ReverseProxy) roundTrip(ctx context.Context, req *request.Request, body io.Reader, u *upstream) (*http.Response, error) {
+	outreq, err := p.outgoingRequest(ctx, req, body, u.url)
+	if err != nil {
+		return nil, err
+	}
+	u.active.Add(1)
+	resp, err := p.transport.RoundTrip(outreq)
+	if err != nil {
+		u.active.Add(-1)
+		if ctx.Err() == nil || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			u.failed(p.cfg.MaxFails, p.cfg.EjectDuration)
+		}
+		return nil, err
+	}
+	u.succeeded()
+	return resp, nil
+}
+
+// streamedBody is a request body read from the client connection as it is
+// sent upstream. It can only be sent once, and stop keeps the transport,
+// which may still be writing it after a failed round trip, from reading
+// the connection once the handler is done.
+type streamedBody struct {
+	mu      sync.Mutex
+	r       io.Reader
+	n       int64
+	stopped bool
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *streamedBody) started() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n > 0
+}
+
+func (b *streamedBody) stop() {
+	b.mu.Lock()
+	b.stopped = true
+	b.mu.Unlock()
+}
+
+// idempotent methods can safely be sent again to another upstream.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (p *ReverseProxy) outgoingRequest(ctx context.Context, req *request.Request, body io.Reader, upstream *url.URL) (*http.Request, error) {
+	target, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+	u := *upstream
+	u.Path = joinPath(upstream.Path, strings.TrimPrefix(target.Path, p.cfg.StripPrefix))
+	u.RawPath = ""
+	switch {
+	case upstream.RawQuery == "":
+		u.RawQuery = target.RawQuery
+	case target.RawQuery != "":
+		u.RawQuery = upstream.RawQuery + "&" + target.RawQuery
+	}
+
+	outreq, err := http.NewRequestWithContext(ctx, req.RequestLine.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := strconv.ParseInt(req.Headers.Get("Content-Length"), 10, 64); err == nil && n > 0 {
+		outreq.Body = io.NopCloser(body)
+		outreq.ContentLength = n
+	} else if req.Headers.Get("Transfer-Encoding") != "" {
+		// a chunked upload, of unknown length until it ends
+		outreq.Body = io.NopCloser(body)
+		outreq.ContentLength = -1
+	}
+	for k, v := range req.Headers {
+		for _, line := range headers.Lines(v) {
+			outreq.Header.Add(k, line)
+		}
+	}
+	removeHopHeaders(outreq.Header)
+	outreq.Header.Del("Host")
+	outreq.Header.Del("Content-Length")
+	if p.cfg.PreserveHost {
+		outreq.Host = req.Headers.Get("Host")
+	}
+	setForwarded(outreq.Header, req)
+	return outreq, nil
+}
+
+// setForwarded records the client, the host it asked for and the scheme
+// it used, both as X-Forwarded-* and as Forwarded (RFC 7239). Values added
+// by proxies in front of this one are kept.
+func setForwarded(h http.Header, req *request.Request) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	host := req.Headers.Get("Host")
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+
+	if clientIP != "" {
+		if prior := h.Get("X-Forwarded-For"); prior != "" {
+			h.Set("X-Forwarded-For", prior+", "+clientIP)
+		} else {
+			h.Set("X-Forwarded-For", clientIP)
+		}
+	}
+	if host != "" {
+		h.Set("X-Forwarded-Host", host)
+	}
+	h.Set("X-Forwarded-Proto", proto)
+
+	var elem []string
+	if clientIP != "" {
+		node := clientIP
+		if strings.Contains(node, ":") {
+			node = "[" + node + "]"
+		}
+		elem = append(elem, "for="+quoteForwarded(node))
+	}
+	if host != "" {
+		elem = append(elem, "host="+quoteForwarded(host))
+	}
+	elem = append(elem, "proto="+proto)
+	forwarded := strings.Join(elem, ";")
+	if prior := h.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	h.Set("Forwarded", forwarded)
+}
+
+// quoteForwarded quotes v unless it is a plain token.
+func quoteForwarded(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// roundTripFailed answers the client after every attempt failed, err
+// being the last failure.
+func (p *ReverseProxy) roundTripFailed(w *response.Writter, req *request.Request, err error) {
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		log.Printf("INFO: client went away before %s was answered\n", req.RequestLine.RequestTarget)
+		return
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		response.WriteText(w, response.StatusGatewayTimeout, nil, response.StatusGatewayTimeout.String()+"\n")
+		return
+	}
+	response.WriteText(w, response.StatusBadGateway, nil, response.StatusBadGateway.String()+"\n")
+}
+
+// copyResponse relays resp to the client as it arrives. Bodies are sent
+// chunked so they can be streamed whatever their length, followed by the
+// upstream's trailers.
+func (p *ReverseProxy) copyResponse(w *response.Writter, req *request.Request, resp *http.Response) error {
+	removeHopHeaders(resp.Header)
+	h := headers.NewHeaders()
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+	if err := w.WriteStatusLine(response.StatusCode(resp.StatusCode)); err != nil {
+		return err
+	}
+	if !hasBody(req.RequestLine.Method, resp.StatusCode) {
+		if err := w.WriteHeaders(h); err != nil {
+			return err
+		}
+		// the length of a HEAD response is the upstream's to tell
+		return w.Flush()
+	}
+	h.Del("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	if len(resp.Trailer) > 0 {
+		names := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
+			names = append(names, k)
+		}
+		h.Set("Trailer", strings.Join(names, ", "))
+	}
+	if p.cfg.Digests != nil {
+		if err := w.EnableDigests(*p.cfg.Digests); err != nil {
+			return err
+		}
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteChunkedBody(buf[:n]); werr != nil {
+				return werr
+			}
+			if werr := w.Flush(); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	if len(resp.Trailer) == 0 {
+		return nil
+	}
+	trailers := headers.NewHeaders()
+	for k, vs := range resp.Trailer {
+		for _, v := range vs {
+			trailers.Add(k, v)
+		}
+	}
+	return w.WriteTrailers(trailers)
+}
+
+func hasBody(method string, statusCode int) bool {
+	if method == "HEAD" {
+		return false
+	}
+	return statusCode >= 200 && statusCode != 204 && statusCode != 304
+}
+
+// removeHopHeaders drops hopHeaders and any field named in Connection.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+func joinPath(a, b string) string {
+	switch {
+	case b == "":
+		if a == "" {
+			return "/"
+		}
+		return a
+	case strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/"):
+		return a + b[1:]
+	case !strings.HasSuffix(a, "/") && !strings.HasPrefix(b, "/"):
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"github/Flarenzy/learn-http-protocol-golang/internal/server"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startProxy(t *testing.T, p *ReverseProxy) string {
+	s, err := server.Serve(0, p.ServeRequest)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	_, port, err := net.SplitHostPort(s.Addr().String())
+	require.NoError(t, err)
+	return "http://127.0.0.1:" + port
+}
+
+func newProxy(t *testing.T, cfg Config) string {
+	p, err := New(cfg)
+	require.NoError(t, err)
+	return startProxy(t, p)
+}
+
+func TestReverseProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Add("X-Multi", "one")
+		w.Header().Add("X-Multi", "two")
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "secret")
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Path", r.URL.RequestURI())
+		w.Header().Set("X-Host", r.Host)
+		for _, k := range []string{"X-Custom", "X-Client-Hop", "Proxy-Authorization", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded"} {
+			w.Header().Set("Echo-"+k, r.Header.Get(k))
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer upstream.Close()
+	base := newProxy(t, Config{
+		Upstreams:   []string{upstream.URL + "/base"},
+		StripPrefix: "/api",
+		Digests:     &response.DigestOptions{},
+	})
+
+	req, err := http.NewRequest("POST", base+"/api/items?q=1", strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Header.Set("X-Custom", "kept")
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "dropped")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// Test: method, body, path and query are forwarded
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "payload", string(body))
+	assert.Equal(t, "POST", resp.Header.Get("X-Method"))
+	assert.Equal(t, "/base/items?q=1", resp.Header.Get("X-Path"))
+	assert.Equal(t, strings.TrimPrefix(upstream.URL, "http://"), resp.Header.Get("X-Host"))
+
+	// Test: end-to-end headers pass, hop-by-hop ones don't
+	assert.Equal(t, "kept", resp.Header.Get("Echo-X-Custom"))
+	assert.Empty(t, resp.Header.Get("Echo-X-Client-Hop"))
+	assert.Empty(t, resp.Header.Get("Echo-Proxy-Authorization"))
+	assert.Empty(t, resp.Header.Get("X-Hop"))
+
+	// Test: forwarding headers describe the client
+	proxyHost := strings.TrimPrefix(base, "http://")
+	assert.Equal(t, "203.0.113.7, 127.0.0.1", resp.Header.Get("Echo-X-Forwarded-For"))
+	assert.Equal(t, proxyHost, resp.Header.Get("Echo-X-Forwarded-Host"))
+	assert.Equal(t, "http", resp.Header.Get("Echo-X-Forwarded-Proto"))
+	assert.Equal(t, `for=127.0.0.1;host="`+proxyHost+`";proto=http`, resp.Header.Get("Echo-Forwarded"))
+
+	// Test: multi-value response headers and trailers survive
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"}, resp.Header.Values("Set-Cookie"))
+	assert.Equal(t, "one, two", resp.Header.Get("X-Multi"))
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+	sum := sha256.Sum256(body)
+	assert.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":", resp.Trailer.Get("Content-Digest"))
+}
+
+func TestReverseProxyStreamsBody(t *testing.T) {
+	got := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		head := make([]byte, 5)
+		io.ReadFull(r.Body, head)
+		got <- string(head)
+		rest, _ := io.ReadAll(r.Body)
+		w.Header().Set("Echo-Cookie", r.Header.Get("Cookie"))
+		w.Header().Set("Echo-Length", strconv.FormatInt(r.ContentLength, 10))
+		w.Write(append(head, rest...))
+	}))
+	defer upstream.Close()
+	p, err := New(Config{Upstreams: []string{upstream.URL}})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := server.New(server.Config{
+		Listener:          l,
+		Handler:           p.ServeRequest,
+		StreamRequestBody: func(*request.Request) bool { return true },
+	})
+	require.NoError(t, err)
+	go s.ListenAndServe()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\n"+
+		"Cookie: a=1\r\nCookie: b=2\r\nContent-Length: 10\r\n\r\nhello")
+	require.NoError(t, err)
+
+	// Test: the upstream gets the body while the client is still sending it
+	select {
+	case head := <-got:
+		assert.Equal(t, "hello", head)
+	case <-time.After(5 * time.Second):
+		t.Fatal("body wasn't forwarded before it was complete")
+	}
+	_, err = io.WriteString(conn, "world")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "helloworld", string(body))
+	assert.Equal(t, "10", resp.Header.Get("Echo-Length"))
+
+	// Test: repeated Cookie fields reach the upstream as one cookie list
+	assert.Equal(t, "a=1; b=2", resp.Header.Get("Echo-Cookie"))
+
+	// Test: chunked uploads are forwarded as they arrive
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\n"+
+		"Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n")
+	require.NoError(t, err)
+	select {
+	case head := <-got:
+		assert.Equal(t, "hello", head)
+	case <-time.After(5 * time.Second):
+		t.Fatal("chunked body wasn't forwarded before it was complete")
+	}
+	_, err = io.WriteString(conn, "3\r\n!!!\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "hello!!!", string(body))
+	assert.Equal(t, "-1", resp.Header.Get("Echo-Length"))
+}
+
+func TestReverseProxyRoundRobin(t *testing.T) {
+	var upstreams []string
+	for _, name := range []string{"a", "b"} {
+		u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		defer u.Close()
+		upstreams = append(upstreams, u.URL)
+	}
+	base := newProxy(t, Config{Upstreams: upstreams})
+
+	var got []string
+	for range 4 {
+		resp, err := http.Get(base + "/")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		got = append(got, string(body))
+	}
+	assert.Equal(t, []string{"a", "b", "a", "b"}, got)
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	// Test: unreachable upstream is a 502
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	base := newProxy(t, Config{Upstreams: []string{"http://" + addr}})
+	resp, err := http.Get(base + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// Test: slow upstream is a 504
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	base = newProxy(t, Config{Upstreams: []string{slow.URL}, ResponseHeaderTimeout: 50 * time.Millisecond})
+	resp, err = http.Get(base + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+	// Test: invalid upstreams are rejected
+	_, err = New(Config{})
+	assert.Error(t, err)
+	_, err = New(Config{Upstreams: []string{"localhost:8080"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,116 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"strconv"
+	"strings"
+)
+
+// maxChunkLineBytes bounds a chunk size line, extensions included.
+const maxChunkLineBytes = 4096
+
+// chunkedState is where the decoding of a chunked body is at.
+type chunkedState struct {
+	// left is what remains of the current chunk's data
+	left int64
+	// crlf is set when the CRLF ending the chunk's data is due
+	crlf bool
+	// trailers is set once the last chunk has been read
+	trailers headers.Headers
+}
+
+// setupFraming works out how the body is delimited. Transfer-Encoding wins
+// over Content-Length, but a request with both is refused as a smuggling
+// attempt (RFC 9112 section 6.3), and only the chunked coding is known.
+func (r *Request) setupFraming() error {
+	te := r.Headers.Get("Transfer-Encoding")
+	if te == "" {
+		return nil
+	}
+	if r.Headers.Get("Content-Length") != "" {
+		return errors.New("both Transfer-Encoding and Content-Length")
+	}
+	if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+		return fmt.Errorf("%w: %s", ErrUnsupportedTransferEncoding, te)
+	}
+	r.chunked = &chunkedState{}
+	return nil
+}
+
+// parseChunked parses the next piece of a chunked body: a size line, chunk
+// data, the CRLF after it, or a line of the trailer section. Trailer
+// fields are parsed but dropped.
+func (r *Request) parseChunked(data []byte) (int, error) {
+	c := r.chunked
+	switch {
+	case c.trailers != nil:
+		n, done, err := c.trailers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			r.state = requestStateDone
+			return n, r.verifyDigest()
+		}
+		return n, nil
+	case c.left > 0:
+		take := min(int64(len(data)), c.left)
+		r.appendBody(data[:take])
+		c.left -= take
+		c.crlf = c.left == 0
+		return int(take), nil
+	case c.crlf:
+		if len(data) < len(crlf) {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, []byte(crlf)) {
+			return 0, errors.New("chunk data not followed by CRLF")
+		}
+		c.crlf = false
+		return len(crlf), nil
+	}
+	idx := bytes.Index(data, []byte(crlf))
+	if idx == -1 {
+		if len(data) > maxChunkLineBytes {
+			return 0, errors.New("chunk size line too long")
+		}
+		return 0, nil
+	}
+	// chunk extensions are ignored
+	sizeText, _, _ := strings.Cut(string(data[:idx]), ";")
+	size, err := parseChunkSize(strings.TrimSpace(sizeText))
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		c.trailers = headers.NewHeaders()
+	} else if r.maxBody > 0 && int64(r.received)+size > int64(r.maxBody) {
+		return 0, ErrBodyTooLarge
+	}
+	c.left = size
+	return idx + len(crlf), nil
+}
+
+func parseChunkSize(s string) (int64, error) {
+	if s == "" || len(s) > 15 {
+		return 0, fmt.Errorf("invalid chunk size %q", s)
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return 0, fmt.Errorf("invalid chunk size %q", s)
+		}
+	}
+	return strconv.ParseInt(s, 16, 64)
+}
+
+// appendBody adds body bytes as they are parsed, whatever the framing.
+func (r *Request) appendBody(p []byte) {
+	r.Body = append(r.Body, p...)
+	r.received += len(p)
+	if r.digest != nil {
+		r.digest.Write(p)
+	}
+}
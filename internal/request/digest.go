@@ -0,0 +1,119 @@
+package request
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"hash"
+	"strings"
+)
+
+var ErrDigestMismatch = errors.New("body doesn't match its digest")
+
+// digestFields are the integrity fields from RFC 9530 a request body is
+// checked against. Without Content-Range the content of a request is its
+// whole representation, so both are verified the same way.
+var digestFields = []string{"Content-Digest", "Repr-Digest"}
+
+type digestCheck struct {
+	field string
+	alg   string
+	want  []byte
+}
+
+// DigestVerifier hashes a request body as it arrives and checks it
+// against the digests the client sent.
+type DigestVerifier struct {
+	hashes map[string]hash.Hash
+	checks []digestCheck
+}
+
+// NewDigestVerifier returns a verifier for the digests in h, or nil if h
+// has none with a supported algorithm. Unsupported algorithms are ignored.
+func NewDigestVerifier(h headers.Headers) (*DigestVerifier, error) {
+	v := &DigestVerifier{hashes: map[string]hash.Hash{}}
+	for _, field := range digestFields {
+		value := h.Get(field)
+		if value == "" {
+			continue
+		}
+		digests, err := ParseDigests(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		for alg, want := range digests {
+			hf := newHash(alg)
+			if hf == nil {
+				continue
+			}
+			if _, ok := v.hashes[alg]; !ok {
+				v.hashes[alg] = hf
+			}
+			v.checks = append(v.checks, digestCheck{field: field, alg: alg, want: want})
+		}
+	}
+	if len(v.checks) == 0 {
+		return nil, nil
+	}
+	return v, nil
+}
+
+func (v *DigestVerifier) Write(p []byte) {
+	for _, h := range v.hashes {
+		h.Write(p)
+	}
+}
+
+// Verify reports ErrDigestMismatch if the body written so far doesn't
+// match every supported digest.
+func (v *DigestVerifier) Verify() error {
+	sums := map[string][]byte{}
+	for alg, h := range v.hashes {
+		sums[alg] = h.Sum(nil)
+	}
+	for _, c := range v.checks {
+		if !bytes.Equal(sums[c.alg], c.want) {
+			return fmt.Errorf("%w: %s %s", ErrDigestMismatch, c.field, c.alg)
+		}
+	}
+	return nil
+}
+
+func newHash(alg string) hash.Hash {
+	switch alg {
+	case "sha-256":
+		return sha256.New()
+	case "sha-512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// ParseDigests parses a Content-Digest or Repr-Digest value, a structured
+// dictionary of algorithms to byte sequences such as
+// "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:". Algorithm names
+// are lowercased and parameters ignored.
+func ParseDigests(value string) (map[string][]byte, error) {
+	digests := map[string][]byte{}
+	for _, member := range strings.Split(value, ",") {
+		member, _, _ = strings.Cut(member, ";")
+		alg, v, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || alg == "" {
+			return nil, fmt.Errorf("invalid digest member %q", member)
+		}
+		v = strings.TrimSpace(v)
+		if len(v) < 2 || v[0] != ':' || v[len(v)-1] != ':' {
+			return nil, fmt.Errorf("digest for %s isn't a byte sequence", alg)
+		}
+		sum, err := base64.StdEncoding.DecodeString(v[1 : len(v)-1])
+		if err != nil {
+			return nil, fmt.Errorf("digest for %s: %w", alg, err)
+		}
+		digests[strings.ToLower(alg)] = sum
+	}
+	return digests, nil
+}
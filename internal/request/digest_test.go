@@ -0,0 +1,65 @@
+package request
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func digestRequest(field, value, body string) string {
+	return "POST /upload HTTP/1.1\r\nHost: localhost\r\n" +
+		field + ": " + value + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+}
+
+func TestRequestDigest(t *testing.T) {
+	body := "hello world"
+	sum256 := sha256.Sum256([]byte(body))
+	sum512 := sha512.Sum512([]byte(body))
+	good256 := "sha-256=:" + base64.StdEncoding.EncodeToString(sum256[:]) + ":"
+	good512 := "sha-512=:" + base64.StdEncoding.EncodeToString(sum512[:]) + ":"
+
+	// Test: matching digest read in small pieces
+	r, err := NewReader(&chunkReader{data: digestRequest("Content-Digest", good256+", "+good512, body), numBytesPerRead: 3}).ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, body, string(r.Body))
+
+	// Test: Repr-Digest is checked too, unknown algorithms are ignored
+	_, err = RequestFromReader(strings.NewReader(digestRequest("Repr-Digest", "md5=:AAAA:, "+good512, body)))
+	require.NoError(t, err)
+	_, err = RequestFromReader(strings.NewReader(digestRequest("Content-Digest", "md5=:AAAA:", body)))
+	require.NoError(t, err)
+
+	// Test: mismatching body fails the read as a malformed request
+	_, err = RequestFromReader(strings.NewReader(digestRequest("Content-Digest", good256, "hello worle")))
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+	assert.ErrorIs(t, err, ErrMalformedRequest)
+	_, err = RequestFromReader(strings.NewReader(digestRequest("Content-Digest", good256+", sha-512=:"+base64.StdEncoding.EncodeToString(sum256[:])+":", body)))
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+
+	// Test: a digest on a request without a body covers the empty body
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nContent-Digest: " + good256 + "\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+
+	// Test: malformed digest fields are rejected
+	_, err = RequestFromReader(strings.NewReader(digestRequest("Content-Digest", "sha-256=abc", body)))
+	assert.ErrorIs(t, err, ErrMalformedRequest)
+	assert.NotErrorIs(t, err, ErrDigestMismatch)
+}
+
+func TestParseDigests(t *testing.T) {
+	digests, err := ParseDigests("SHA-256=:AQID:;param=1, sha-512=::")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"sha-256": {1, 2, 3}, "sha-512": {}}, digests)
+
+	for _, v := range []string{"sha-256", "sha-256=:AQID", "=:AQID:", "sha-256=:!!:"} {
+		_, err := ParseDigests(v)
+		assert.Error(t, err, v)
+	}
+}
@@ -2,6 +2,9 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
@@ -14,7 +17,26 @@ type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
-	state       reqState
+	// PathParams holds the values captured by the router for {name}
+	// segments of the matched route.
+	PathParams map[string]string
+	// TLS is the state of the connection the request arrived on, nil for
+	// cleartext connections.
+	TLS *tls.ConnectionState
+	// RemoteAddr is the network address of the client, set by the server.
+	RemoteAddr string
+	state      reqState
+	// digest checks the body against the client's Content-Digest
+	digest *DigestVerifier
+	// received counts the body bytes parsed so far
+	received int
+	// body streams a body left on the connection, see Reader.StreamBody
+	body *bodyReader
+	// chunked tracks the decoding of a chunked body
+	chunked *chunkedState
+	// maxBody is the reader's MaxBodyBytes, for bodies of unknown length
+	maxBody int
+	ctx     context.Context
 }
 
 type RequestLine struct {
@@ -39,41 +61,277 @@ func (r reqState) String() string {
 const crlf = "\r\n"
 const bufferSize = 8
 
+// streamBufferSize is the least the read buffer grows to for a streamed
+// body.
+const streamBufferSize = 32 * 1024
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize, bufferSize)
-	readToIndex := 0
+	return NewReader(reader).ReadRequest()
+}
+
+// Reader reads consecutive requests from a connection. Bytes read past the
+// end of one request are kept for the next, so pipelined and keep-alive
+// requests aren't lost.
+type Reader struct {
+	r   io.Reader
+	buf []byte
+	n   int
+	err error
+
+	// OnHeaders, if set, is called once the header section of a request
+	// has been parsed and before its body is read.
+	OnHeaders func()
+	// MaxHeaderBytes and MaxBodyBytes limit the size of a request's
+	// header section and body. Zero means no limit.
+	MaxHeaderBytes int
+	MaxBodyBytes   int
+	// StreamBody, if set, is asked once the header section of a request
+	// with a body has been parsed. When it returns true the request is
+	// returned right away and its body read from the connection through
+	// BodyReader, e.g. to forward it, rather than into Body.
+	StreamBody func(*Request) bool
+
+	// body is the last streamed body, drained before the next request
+	body *bodyReader
+}
+
+var (
+	ErrMalformedRequest = errors.New("malformed request")
+	ErrHeaderTooLarge   = errors.New("request header too large")
+	ErrBodyTooLarge     = errors.New("request body too large")
+	// ErrUnsupportedTransferEncoding is returned for a transfer coding
+	// other than chunked, which the server should answer with 501.
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer encoding")
+)
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		r:   reader,
+		buf: make([]byte, bufferSize),
+	}
+}
+
+// ReadRequest reads the next request. It returns io.EOF if the connection
+// was closed cleanly before a new request started.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	if rr.body != nil {
+		// whatever the handler left of the body precedes the next request
+		_, err := io.Copy(io.Discard, rr.body)
+		rr.body = nil
+		if err != nil {
+			return nil, err
+		}
+	}
 	req := &Request{
 		state:   reqStateInitialized,
 		Headers: headers.NewHeaders(),
 		Body:    make([]byte, 0),
+		maxBody: rr.MaxBodyBytes,
 	}
-	for req.state != requestStateDone {
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+	headersDone := false
+	headerBytes := 0
+	for {
+		if rr.n > 0 {
+			numBytesParsed, err := req.parse(rr.buf[:rr.n])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrMalformedRequest, err)
+			}
+			copy(rr.buf, rr.buf[numBytesParsed:rr.n])
+			rr.n -= numBytesParsed
+			if !headersDone {
+				headerBytes += numBytesParsed
+			}
+			if !headersDone && (req.state == requestStateParsingBody || req.state == requestStateDone) {
+				headersDone = true
+				if err := rr.checkBodySize(req); err != nil {
+					return nil, err
+				}
+				if rr.OnHeaders != nil {
+					rr.OnHeaders()
+				}
+				if req.state == requestStateParsingBody && rr.StreamBody != nil && rr.StreamBody(req) {
+					return rr.streamBody(req), nil
+				}
+			}
+			if !headersDone && rr.MaxHeaderBytes > 0 && headerBytes+rr.n > rr.MaxHeaderBytes {
+				return nil, ErrHeaderTooLarge
+			}
+			if req.state == requestStateDone {
+				return req, nil
+			}
 		}
-
-		numBytesRead, err := reader.Read(buf[readToIndex:])
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				if req.state != requestStateDone {
-					return nil, fmt.Errorf("incomplete request, in state %d, read n bytes %d", req.state, numBytesRead)
+		if rr.err != nil {
+			if errors.Is(rr.err, io.EOF) {
+				if req.state == reqStateInitialized && rr.n == 0 {
+					return nil, io.EOF
 				}
-				break
+				return nil, fmt.Errorf("incomplete request, in state %d, read n bytes %d", req.state, rr.n)
 			}
-			return nil, err
+			return nil, rr.err
+		}
+		if rr.n >= len(rr.buf) {
+			newBuf := make([]byte, len(rr.buf)*2)
+			copy(newBuf, rr.buf)
+			rr.buf = newBuf
 		}
-		readToIndex += numBytesRead
-		numBytesParsed, err := req.parse(buf[:readToIndex])
+		numBytesRead, err := rr.r.Read(rr.buf[rr.n:])
+		rr.n += numBytesRead
+		rr.err = err
+	}
+}
+
+// streamBody returns a copy of req, whose header section has just been
+// parsed, that reads the rest of its body from the connection.
+func (rr *Reader) streamBody(req *Request) *Request {
+	rr.body = &bodyReader{rr: rr, req: req}
+	out := *req
+	out.Body = nil
+	out.body = rr.body
+	return &out
+}
+
+// readBody parses more of req's body, reading from the connection when
+// what is buffered doesn't get it any further, e.g. half a chunk size line.
+func (rr *Reader) readBody(req *Request) error {
+	if rr.n > 0 {
+		n, err := req.parse(rr.buf[:rr.n])
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("%w: %w", ErrMalformedRequest, err)
+		}
+		copy(rr.buf, rr.buf[n:rr.n])
+		rr.n -= n
+		if n > 0 || req.state == requestStateDone {
+			return nil
+		}
+	}
+	if rr.err != nil {
+		if errors.Is(rr.err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return rr.err
+	}
+	if size := max(streamBufferSize, 2*rr.n); len(rr.buf) < size {
+		buf := make([]byte, size)
+		copy(buf, rr.buf[:rr.n])
+		rr.buf = buf
+	}
+	n, err := rr.r.Read(rr.buf[rr.n:])
+	rr.n += n
+	rr.err = err
+	return nil
+}
+
+// bodyReader hands out a streamed body as the parser takes it off the
+// connection, so its length and digest are checked as for any other.
+type bodyReader struct {
+	rr  *Reader
+	req *Request
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	for len(b.req.Body) == 0 {
+		if b.err != nil {
+			return 0, b.err
 		}
+		if b.req.state == requestStateDone {
+			return 0, io.EOF
+		}
+		b.err = b.rr.readBody(b.req)
+	}
+	n := copy(p, b.req.Body)
+	if n == len(b.req.Body) {
+		b.req.Body = b.req.Body[:0]
+	} else {
+		b.req.Body = b.req.Body[n:]
+	}
+	return n, nil
+}
+
+// Buffered returns the bytes read past the end of the last request, for
+// handing the connection over to another protocol.
+func (rr *Reader) Buffered() []byte {
+	return rr.buf[:rr.n]
+}
 
-		copy(buf, buf[numBytesParsed:])
-		readToIndex -= numBytesParsed
+func (rr *Reader) checkBodySize(req *Request) error {
+	if rr.MaxBodyBytes <= 0 {
+		return nil
+	}
+	v := req.Headers.Get("Content-Length")
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err == nil && n > rr.MaxBodyBytes {
+		return ErrBodyTooLarge
 	}
-	return req, nil
+	return nil
+}
+
+// Context returns the request's context. The server cancels it when the
+// client disconnects or the server shuts down.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r using ctx. Middleware uses it to
+// attach values or deadlines before calling the next handler.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// PeerCertificate returns the client's certificate if it was verified
+// against the server's client CAs, or nil.
+func (r *Request) PeerCertificate() *x509.Certificate {
+	chain := r.VerifiedChain()
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain[0]
+}
+
+// VerifiedChain returns the client's certificate chain as verified during
+// the handshake, leaf first.
+func (r *Request) VerifiedChain() []*x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0]
+}
+
+// BodyReader returns the body as a stream. It reads Body, unless the body
+// was left on the connection by Reader.StreamBody, in which case Body is
+// empty and the body can be read only once.
+func (r *Request) BodyReader() io.Reader {
+	if r.body != nil {
+		return r.body
+	}
+	return bytes.NewReader(r.Body)
+}
+
+// BodyStreamed reports whether the body is read from the connection
+// through BodyReader rather than held in Body.
+func (r *Request) BodyStreamed() bool {
+	return r.body != nil
+}
+
+// Path returns the request target without its query string.
+func (r *Request) Path() string {
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return path
+}
+
+func (r *Request) PathValue(name string) string {
+	return r.PathParams[name]
 }
 
 func parseRequestLine(line []byte) (*RequestLine, int, error) {
@@ -124,6 +382,13 @@ func requestLineFromString(requestLine string) (*RequestLine, error) {
 	}, nil
 }
 
+func (r *Request) verifyDigest() error {
+	if r.digest == nil {
+		return nil
+	}
+	return r.digest.Verify()
+}
+
 func (r *Request) parseHeadersLine(data []byte) (int, bool, error) {
 	n, done, err := r.Headers.Parse(data)
 	if err != nil {
@@ -173,28 +438,42 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		}
 		if done {
 			r.state = requestStateParsingBody
+			if err := r.setupFraming(); err != nil {
+				return 0, err
+			}
+			r.digest, err = NewDigestVerifier(r.Headers)
+			if err != nil {
+				return 0, err
+			}
 		}
 		return n, nil
 
 	case requestStateParsingBody:
+		if r.chunked != nil {
+			return r.parseChunked(data)
+		}
 		v := r.Headers.Get("Content-Length")
 		if v == "" {
 			r.state = requestStateDone
-			return 0, nil
+			return 0, r.verifyDigest()
 		}
-		r.Body = append(r.Body, data...)
-		n, err := strconv.Atoi(r.Headers.Get("Content-Length"))
+		n, err := strconv.Atoi(v)
 		if err != nil {
 			return 0, err
 		}
-		if len(r.Body) > n {
-			return 0, fmt.Errorf("len of body greater than reported, reported %d expected %d, body %s", n, len(r.Body), string(r.Body))
+		if n < 0 {
+			return 0, fmt.Errorf("invalid Content-Length: %d", n)
 		}
-		if len(r.Body) == n {
+		// anything past Content-Length belongs to the next request
+		take := min(len(data), n-r.received)
+		r.appendBody(data[:take])
+		if r.received == n {
 			r.state = requestStateDone
-			return 0, nil
+			if err := r.verifyDigest(); err != nil {
+				return 0, err
+			}
 		}
-		return len(data), nil
+		return take, nil
 
 	default:
 		return 0, fmt.Errorf("unknown state")
@@ -2,6 +2,7 @@ package request
 
 import (
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -120,6 +121,146 @@ func TestRequestWithBody(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestReaderPipelined(t *testing.T) {
+	reader := &chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 64,
+	}
+	rr := NewReader(reader)
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Equal(t, "localhost:42069", r.Headers.Get("Host"))
+
+	_, err = rr.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReaderStreamBody(t *testing.T) {
+	body := strings.Repeat("0123456789", 10)
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 100\r\n" +
+			"\r\n" +
+			body +
+			"POST /skipped HTTP/1.1\r\n" +
+			"Content-Length: 100\r\n" +
+			"\r\n" +
+			body +
+			"GET /last HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	}
+	rr := NewReader(reader)
+	rr.StreamBody = func(req *Request) bool { return req.RequestLine.Method == "POST" }
+
+	// Test: the body is left for BodyReader
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/upload", r.RequestLine.RequestTarget)
+	assert.True(t, r.BodyStreamed())
+	assert.Empty(t, r.Body)
+	data, err := io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, body, string(data))
+
+	// Test: a body the handler doesn't read is skipped
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/skipped", r.RequestLine.RequestTarget)
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(r.BodyReader(), buf)
+	require.NoError(t, err)
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/last", r.RequestLine.RequestTarget)
+	assert.False(t, r.BodyStreamed())
+
+	// Test: a streamed body cut short is an error
+	rr = NewReader(&chunkReader{data: "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nshort", numBytesPerRead: 3})
+	rr.StreamBody = func(*Request) bool { return true }
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader())
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: a streamed body is checked against its Content-Digest
+	rr = NewReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Digest: sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:\r\n\r\nhellO",
+		numBytesPerRead: 3,
+	})
+	rr.StreamBody = func(*Request) bool { return true }
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader())
+	assert.ErrorIs(t, err, ErrMalformedRequest)
+}
+
+func TestChunkedBody(t *testing.T) {
+	// Test: chunks, extensions and trailers, read a byte at a time
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5;name=value\r\nhello\r\n" +
+			"7\r\n, world\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n" +
+			"GET /next HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 1,
+	}
+	rr := NewReader(reader)
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", string(r.Body))
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+
+	// Test: streamed chunked bodies
+	rr = NewReader(&chunkReader{data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\na\r\n0123456789\r\n0\r\n\r\n", numBytesPerRead: 4})
+	rr.StreamBody = func(*Request) bool { return true }
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	data, err := io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+
+	// Test: malformed framing is rejected
+	for _, raw := range []string{
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n0\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nz\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n-1\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabcX\r\n",
+	} {
+		_, err = RequestFromReader(&chunkReader{data: raw, numBytesPerRead: 64})
+		assert.ErrorIs(t, err, ErrMalformedRequest, raw)
+	}
+
+	// Test: only the chunked coding is understood
+	_, err = RequestFromReader(&chunkReader{data: "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", numBytesPerRead: 64})
+	assert.ErrorIs(t, err, ErrUnsupportedTransferEncoding)
+
+	// Test: chunks are held to MaxBodyBytes
+	rr = NewReader(&chunkReader{data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nabcd\r\n4\r\nefgh\r\n0\r\n\r\n", numBytesPerRead: 64})
+	rr.MaxBodyBytes = 6
+	_, err = rr.ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
 type chunkReader struct {
 	data            string
 	numBytesPerRead int
@@ -0,0 +1,252 @@
+package response
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type CompressOptions struct {
+	// MinSize is the smallest Content-Length worth compressing. Bodies
+	// without a Content-Length (chunked streams) are always compressed.
+	MinSize int
+	Level   int
+	// SkipTypes lists media types that are already compressed. An entry
+	// ending in "/" matches the whole top-level type.
+	SkipTypes []string
+}
+
+var DefaultCompressOptions = CompressOptions{
+	MinSize: 1024,
+	Level:   gzip.DefaultCompression,
+	SkipTypes: []string{
+		"image/",
+		"video/",
+		"audio/",
+		"font/woff",
+		"font/woff2",
+		"application/zip",
+		"application/gzip",
+		"application/x-gzip",
+		"application/x-bzip2",
+		"application/x-7z-compressed",
+		"application/x-rar-compressed",
+		"application/pdf",
+	},
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// NegotiateEncoding picks the content-coding to use for a response given the
+// request's Accept-Encoding value. It returns "" when the body should be
+// sent as is.
+func NegotiateEncoding(acceptEncoding string) string {
+	supported := []string{"gzip", "deflate"}
+	best := ""
+	bestQ := 0.0
+	wildcard := -1.0
+	explicit := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q := parseQuality(part)
+		if coding == "" {
+			continue
+		}
+		if coding == "*" {
+			wildcard = q
+			continue
+		}
+		explicit[coding] = q
+	}
+	for _, coding := range supported {
+		q, ok := explicit[coding]
+		if !ok {
+			if wildcard < 0 {
+				continue
+			}
+			q = wildcard
+		}
+		if q > bestQ {
+			best = coding
+			bestQ = q
+		}
+	}
+	return best
+}
+
+func parseQuality(part string) (string, float64) {
+	params := strings.Split(part, ";")
+	coding := strings.ToLower(strings.TrimSpace(params[0]))
+	q := 1.0
+	for _, p := range params[1:] {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || strings.ToLower(strings.TrimSpace(k)) != "q" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return coding, 0
+		}
+		q = parsed
+	}
+	return coding, q
+}
+
+// EnableCompression makes the writer compress the body with the best coding
+// from acceptEncoding, provided the response turns out to be worth it. It
+// must be called before WriteHeaders.
+func (w *Writter) EnableCompression(acceptEncoding string, opts CompressOptions) {
+	w.compressOpts = &opts
+	w.encoding = NegotiateEncoding(acceptEncoding)
+}
+
+// Flush pushes any body bytes buffered by the compressor out to the client
+// as a chunk, and sends a header block held back for the body's length or
+// digests. It is a no-op otherwise.
+func (w *Writter) Flush() error {
+	if w.held != nil {
+		// a HEAD response still streaming: its length can't be waited for
+		return w.releaseHeaders(false)
+	}
+	if w.digestHeld != nil {
+		// the body can't be hashed before the headers go, so they go
+		// without digests
+		w.digest = nil
+		return w.sendDigestHeaders()
+	}
+	if w.compress == nil {
+		return nil
+	}
+	return w.compress.Flush()
+}
+
+func (w *Writter) setupCompression(h headers.Headers) {
+	if w.compressOpts == nil {
+		return
+	}
+	addVary(h, "Accept-Encoding")
+	if w.encoding == "" || h.Get("Content-Encoding") != "" {
+		return
+	}
+	// discard is only set by failed preconditions here; HEAD is marked
+	// after this and negotiates like GET
+	if !hasBody(w.statusCode) || w.discard {
+		return
+	}
+	if h.Get("Content-Range") != "" {
+		// ranges count bytes of the unencoded representation
+		return
+	}
+	if skipMediaType(h.Get("Content-Type"), w.compressOpts.SkipTypes) {
+		return
+	}
+	if v := h.Get("Content-Length"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n < w.compressOpts.MinSize {
+			return
+		}
+	}
+	if w.head {
+		// the fields GET would get, with no body to compress
+		w.setEncoded(h)
+		w.headEncoded = true
+		return
+	}
+	cw := &chunkWriter{w: w}
+	var c compressor
+	var err error
+	switch w.encoding {
+	case "gzip":
+		c, err = gzip.NewWriterLevel(cw, w.compressOpts.Level)
+	case "deflate":
+		c, err = zlib.NewWriterLevel(cw, w.compressOpts.Level)
+	}
+	if err != nil || c == nil {
+		return
+	}
+	if h.Get("Transfer-Encoding") == "" {
+		w.chunkedConverted = true
+	}
+	w.setEncoded(h)
+	h.Set("Transfer-Encoding", "chunked")
+	w.compress = c
+}
+
+// setEncoded gives h the fields of a body encoded with w.encoding.
+func (w *Writter) setEncoded(h headers.Headers) {
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", w.encoding)
+	if etag := encodedETag(h.Get("ETag"), w.encoding); etag != "" {
+		h.Set("ETag", etag)
+	}
+}
+
+// encodedETag returns the entity tag of the representation tagged etag
+// once encoded with coding. A strong tag names exact bytes, so it gets
+// the coding appended; weak and missing tags give "".
+func encodedETag(etag, coding string) string {
+	if coding == "" || len(etag) < 2 || !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		return ""
+	}
+	return etag[:len(etag)-1] + "-" + coding + `"`
+}
+
+// hasBody reports whether responses with statusCode may carry a body at
+// all. Compressing a 101 would garble the protocol switched to.
+func hasBody(statusCode StatusCode) bool {
+	return statusCode >= 200 && statusCode != StatusNoContent && statusCode != StatusNotModified
+}
+
+func skipMediaType(contentType string, skip []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "image/svg+xml" {
+		return false
+	}
+	for _, s := range skip {
+		if strings.HasSuffix(s, "/") && strings.HasPrefix(mediaType, s) {
+			return true
+		}
+		if mediaType == s {
+			return true
+		}
+	}
+	return false
+}
+
+func addVary(h headers.Headers, field string) {
+	v := h.Get("Vary")
+	if v == "" {
+		h.Set("Vary", field)
+		return
+	}
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if f == "*" || strings.EqualFold(f, field) {
+			return
+		}
+	}
+	h.Set("Vary", v+", "+field)
+}
+
+// chunkWriter frames whatever the compressor emits as chunks on the
+// connection.
+type chunkWriter struct {
+	w *Writter
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	_, err := c.w.writeChunk(p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
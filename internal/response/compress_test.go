@@ -0,0 +1,195 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	assert.Equal(t, "gzip", NegotiateEncoding("gzip, deflate, br"))
+	assert.Equal(t, "deflate", NegotiateEncoding("gzip;q=0.5, deflate"))
+	assert.Equal(t, "gzip", NegotiateEncoding("*"))
+	assert.Equal(t, "deflate", NegotiateEncoding("gzip;q=0, *;q=0.3"))
+	assert.Equal(t, "", NegotiateEncoding("br, identity"))
+	assert.Equal(t, "", NegotiateEncoding(""))
+	assert.Equal(t, "", NegotiateEncoding("gzip;q=0"))
+}
+
+func TestCompressedBody(t *testing.T) {
+	// Test: Fixed length body gets converted to chunked gzip
+	conn := &bufConn{}
+	w := NewWritter(conn)
+	w.EnableCompression("gzip", DefaultCompressOptions)
+	body := strings.Repeat("hello compressed world\n", 200)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(body))))
+	_, err := w.WriteBody([]byte(body))
+	require.NoError(t, err)
+
+	h, raw := splitResponse(t, conn.buf.String())
+	assert.Equal(t, "gzip", h["content-encoding"])
+	assert.Equal(t, "chunked", h["transfer-encoding"])
+	assert.Equal(t, "Accept-Encoding", h["vary"])
+	assert.NotContains(t, h, "content-length")
+	zr, err := gzip.NewReader(bytes.NewReader(decodeChunked(t, raw)))
+	require.NoError(t, err)
+	got, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(got))
+
+	// Test: Streaming deflate with flush between chunks
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	w.EnableCompression("deflate", DefaultCompressOptions)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	hdrs := GetDefaultHeaders(0)
+	hdrs.Del("Content-Length")
+	hdrs.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(hdrs))
+	_, err = w.WriteChunkedBody([]byte("first "))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Contains(t, conn.buf.String(), "\r\n\r\n")
+	_, err = w.WriteChunkedBody([]byte("second"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(map[string]string{}))
+	h, raw = splitResponse(t, conn.buf.String())
+	assert.Equal(t, "deflate", h["content-encoding"])
+	zr2, err := zlib.NewReader(bytes.NewReader(decodeChunked(t, raw)))
+	require.NoError(t, err)
+	got, err = io.ReadAll(zr2)
+	require.NoError(t, err)
+	assert.Equal(t, "first second", string(got))
+
+	// Test: Small bodies are left alone
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	w.EnableCompression("gzip", DefaultCompressOptions)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("small"))
+	require.NoError(t, err)
+	h, raw = splitResponse(t, conn.buf.String())
+	assert.NotContains(t, h, "content-encoding")
+	assert.Equal(t, "5", h["content-length"])
+	assert.Equal(t, "Accept-Encoding", h["vary"])
+	assert.Equal(t, "small", raw)
+
+	// Test: Already compressed media types are left alone
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	w.EnableCompression("gzip", DefaultCompressOptions)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	hdrs = GetDefaultHeaders(len(body))
+	hdrs.Set("Content-Type", "video/mp4")
+	require.NoError(t, w.WriteHeaders(hdrs))
+	_, err = w.WriteBody([]byte(body))
+	require.NoError(t, err)
+	h, raw = splitResponse(t, conn.buf.String())
+	assert.NotContains(t, h, "content-encoding")
+	assert.Equal(t, body, raw)
+}
+
+func TestCompressedETag(t *testing.T) {
+	body := strings.Repeat("hello compressed world\n", 200)
+	send := func(etag, vary string, reqHeaders map[string]string) map[string]string {
+		t.Helper()
+		conn := &bufConn{}
+		w := NewWritter(conn)
+		w.EnableCompression("gzip", DefaultCompressOptions)
+		if reqHeaders != nil {
+			w.EnablePreconditions("GET", reqHeaders)
+		}
+		require.NoError(t, w.WriteStatusLine(StatusOk))
+		hdrs := GetDefaultHeaders(len(body))
+		hdrs.Set("ETag", etag)
+		if vary != "" {
+			hdrs.Set("Vary", vary)
+		}
+		require.NoError(t, w.WriteHeaders(hdrs))
+		_, err := w.WriteBody([]byte(body))
+		require.NoError(t, err)
+		h, _ := splitResponse(t, conn.buf.String())
+		h["status"], _, _ = strings.Cut(conn.buf.String(), "\r\n")
+		return h
+	}
+
+	// Test: a strong ETag is made specific to the encoding
+	h := send(`"abc"`, "Origin", nil)
+	assert.Equal(t, "gzip", h["content-encoding"])
+	assert.Equal(t, `"abc-gzip"`, h["etag"])
+	assert.Equal(t, "Origin, Accept-Encoding", h["vary"])
+
+	// Test: a weak ETag already allows for the encoding
+	h = send(`W/"abc"`, "", nil)
+	assert.Equal(t, `W/"abc"`, h["etag"])
+	assert.Equal(t, "Accept-Encoding", h["vary"])
+
+	// Test: the encoded tag revalidates the cached copy
+	h = send(`"abc"`, "", map[string]string{"If-None-Match": `"abc-gzip"`})
+	assert.Equal(t, "HTTP/1.1 304 Not Modified", h["status"])
+	assert.Equal(t, `"abc-gzip"`, h["etag"])
+	h = send(`"abc"`, "", map[string]string{"If-None-Match": `"abc"`})
+	assert.Equal(t, "HTTP/1.1 304 Not Modified", h["status"])
+	assert.Equal(t, `"abc"`, h["etag"])
+	h = send(`"abc"`, "", map[string]string{"If-Match": `"abc-gzip"`})
+	assert.Equal(t, "HTTP/1.1 200 OK", h["status"])
+	h = send(`"abc"`, "", map[string]string{"If-None-Match": `"abc-deflate"`})
+	assert.Equal(t, "HTTP/1.1 200 OK", h["status"])
+}
+
+type bufConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+// splitResponse returns the headers of a raw response, keyed lowercase, and
+// everything after the blank line.
+func splitResponse(t *testing.T, raw string) (map[string]string, string) {
+	t.Helper()
+	head, body, ok := strings.Cut(raw, "\r\n\r\n")
+	require.True(t, ok)
+	lines := strings.Split(head, "\r\n")
+	h := map[string]string{}
+	for _, l := range lines[1:] {
+		k, v, ok := strings.Cut(l, ": ")
+		require.True(t, ok)
+		h[strings.ToLower(k)] = v
+	}
+	return h, body
+}
+
+func decodeChunked(t *testing.T, raw string) []byte {
+	t.Helper()
+	r := bufio.NewReader(strings.NewReader(raw))
+	var out []byte
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		require.NoError(t, err)
+		if size == 0 {
+			return out
+		}
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(r, chunk)
+		require.NoError(t, err)
+		out = append(out, chunk[:size]...)
+	}
+}
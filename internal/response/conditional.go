@@ -0,0 +1,177 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// preconditions are the conditional fields of the request being answered.
+type preconditions struct {
+	method            string
+	ifMatch           string
+	ifNoneMatch       string
+	ifModifiedSince   string
+	ifUnmodifiedSince string
+}
+
+// StrongETag returns a strong entity tag derived from a hash of the
+// content read from r.
+func StrongETag(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`, nil
+}
+
+// WeakETag returns a weak entity tag for content of the given size and
+// modification time. Changes within the same size and time go unnoticed,
+// hence weak.
+func WeakETag(size int64, modTime time.Time) string {
+	return fmt.Sprintf(`W/"%x-%x"`, modTime.UnixNano(), size)
+}
+
+// EnablePreconditions makes the response conditional on the If-Match,
+// If-None-Match, If-Modified-Since and If-Unmodified-Since fields of
+// reqHeaders. When WriteHeaders is called with a 2xx status they are
+// checked against the ETag and Last-Modified being sent, and the response
+// turns into a 304 or 412 without a body if they fail. This is only done
+// for GET and HEAD; handlers of other methods have to call
+// CheckPreconditions before acting.
+func (w *Writter) EnablePreconditions(method string, reqHeaders headers.Headers) {
+	if method != "GET" && method != "HEAD" {
+		return
+	}
+	p := newPreconditions(method, reqHeaders)
+	if p.ifMatch == "" && p.ifNoneMatch == "" && p.ifModifiedSince == "" && p.ifUnmodifiedSince == "" {
+		return
+	}
+	w.cond = p
+}
+
+// CheckPreconditions evaluates the conditional fields of a request in the
+// order of RFC 9110 section 13.2.2 against the current etag and
+// lastModified of the target, either of which may be empty or zero. It
+// returns StatusNotModified or StatusPreconditionFailed when the request
+// should be answered with that instead, and 0 otherwise.
+func CheckPreconditions(method string, reqHeaders headers.Headers, etag string, lastModified time.Time) StatusCode {
+	return newPreconditions(method, reqHeaders).check(etag, lastModified)
+}
+
+func newPreconditions(method string, reqHeaders headers.Headers) *preconditions {
+	return &preconditions{
+		method:            method,
+		ifMatch:           reqHeaders.Get("If-Match"),
+		ifNoneMatch:       reqHeaders.Get("If-None-Match"),
+		ifModifiedSince:   reqHeaders.Get("If-Modified-Since"),
+		ifUnmodifiedSince: reqHeaders.Get("If-Unmodified-Since"),
+	}
+}
+
+func (p *preconditions) check(etag string, lastModified time.Time) StatusCode {
+	if p.ifMatch != "" {
+		if !matchETag(p.ifMatch, etag, true) {
+			return StatusPreconditionFailed
+		}
+	} else if t, ok := parseDate(p.ifUnmodifiedSince); ok && !lastModified.IsZero() {
+		if lastModified.Unix() > t.Unix() {
+			return StatusPreconditionFailed
+		}
+	}
+	safe := p.method == "GET" || p.method == "HEAD"
+	if p.ifNoneMatch != "" {
+		if matchETag(p.ifNoneMatch, etag, false) {
+			if safe {
+				return StatusNotModified
+			}
+			return StatusPreconditionFailed
+		}
+	} else if t, ok := parseDate(p.ifModifiedSince); ok && safe && !lastModified.IsZero() {
+		if lastModified.Unix() <= t.Unix() {
+			return StatusNotModified
+		}
+	}
+	return 0
+}
+
+// applyPreconditions is called by WriteHeaders. It turns a 2xx response
+// whose preconditions fail into a bodiless 304 or 412 and returns the
+// headers to send instead.
+func (w *Writter) applyPreconditions(h headers.Headers) headers.Headers {
+	p := w.cond
+	w.cond = nil
+	if w.statusCode < 200 || w.statusCode > 299 {
+		return h
+	}
+	lastModified, _ := parseDate(h.Get("Last-Modified"))
+	status := p.check(h.Get("ETag"), lastModified)
+	if etag := encodedETag(h.Get("ETag"), w.encoding); etag != "" && status != StatusNotModified {
+		// the client may hold the compressed representation's tag
+		if alt := p.check(etag, lastModified); alt != StatusPreconditionFailed {
+			status = alt
+		}
+		if status == StatusNotModified {
+			h.Set("ETag", etag)
+		}
+	}
+	switch status {
+	case StatusNotModified:
+		w.statusCode = StatusNotModified
+		w.discard = true
+		// a 304 describes the representation the client already has
+		for _, k := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding", "Trailer"} {
+			h.Del(k)
+		}
+		return h
+	case StatusPreconditionFailed:
+		w.statusCode = StatusPreconditionFailed
+		w.discard = true
+		return GetDefaultHeaders(0)
+	}
+	return h
+}
+
+// matchETag reports whether etag is in list, an If-Match or If-None-Match
+// value. "*" matches any current representation.
+func matchETag(list, etag string, strong bool) bool {
+	list = strings.TrimSpace(list)
+	if list == "*" {
+		return true
+	}
+	if etag == "" || (strong && strings.HasPrefix(etag, "W/")) {
+		return false
+	}
+	opaque := strings.TrimPrefix(etag, "W/")
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+		weak := strings.HasPrefix(list, "W/")
+		list = strings.TrimPrefix(list, "W/")
+		if !strings.HasPrefix(list, `"`) {
+			return false
+		}
+		end := strings.IndexByte(list[1:], '"')
+		if end < 0 {
+			return false
+		}
+		tag := list[:end+2]
+		list = list[end+2:]
+		if tag == opaque && !(strong && weak) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDate(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(v)
+	return t, err == nil
+}
@@ -0,0 +1,111 @@
+package response
+
+import (
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	etag := `"abc"`
+	tests := []struct {
+		name   string
+		method string
+		fields map[string]string
+		etag   string
+		want   StatusCode
+	}{
+		{"none", "GET", nil, etag, 0},
+		{"if-none-match hit", "GET", map[string]string{"If-None-Match": `"x", "abc"`}, etag, StatusNotModified},
+		{"if-none-match weak hit", "GET", map[string]string{"If-None-Match": `W/"abc"`}, etag, StatusNotModified},
+		{"if-none-match star", "HEAD", map[string]string{"If-None-Match": "*"}, etag, StatusNotModified},
+		{"if-none-match miss", "GET", map[string]string{"If-None-Match": `"x"`}, etag, 0},
+		{"if-none-match unsafe", "PUT", map[string]string{"If-None-Match": `"abc"`}, etag, StatusPreconditionFailed},
+		{"if-match hit", "PUT", map[string]string{"If-Match": `"abc"`}, etag, 0},
+		{"if-match miss", "PUT", map[string]string{"If-Match": `"x"`}, etag, StatusPreconditionFailed},
+		{"if-match weak", "GET", map[string]string{"If-Match": `W/"abc"`}, etag, StatusPreconditionFailed},
+		{"if-match weak etag", "GET", map[string]string{"If-Match": `"abc"`}, `W/"abc"`, StatusPreconditionFailed},
+		{"if-modified-since same", "GET", map[string]string{"If-Modified-Since": "Wed, 01 May 2024 12:00:00 GMT"}, etag, StatusNotModified},
+		{"if-modified-since older", "GET", map[string]string{"If-Modified-Since": "Tue, 30 Apr 2024 12:00:00 GMT"}, etag, 0},
+		{"if-modified-since bad date", "GET", map[string]string{"If-Modified-Since": "yesterday"}, etag, 0},
+		{"if-none-match wins over date", "GET", map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": "Wed, 01 May 2024 12:00:00 GMT"}, etag, 0},
+		{"if-unmodified-since older", "GET", map[string]string{"If-Unmodified-Since": "Tue, 30 Apr 2024 12:00:00 GMT"}, etag, StatusPreconditionFailed},
+		{"if-unmodified-since same", "GET", map[string]string{"If-Unmodified-Since": "Wed, 01 May 2024 12:00:00 GMT"}, etag, 0},
+		{"if-match wins over date", "GET", map[string]string{"If-Match": `"abc"`, "If-Unmodified-Since": "Tue, 30 Apr 2024 12:00:00 GMT"}, etag, 0},
+	}
+	for _, tt := range tests {
+		h := headers.NewHeaders()
+		for k, v := range tt.fields {
+			h.Set(k, v)
+		}
+		assert.Equal(t, tt.want, CheckPreconditions(tt.method, h, tt.etag, modTime), tt.name)
+	}
+}
+
+func TestETags(t *testing.T) {
+	etag, err := StrongETag(strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, `"2cf24dba5fb0a30e26e83b2ac5b9e29e"`, etag)
+	assert.Equal(t, `W/"3e8-5"`, WeakETag(5, time.Unix(0, 1000)))
+}
+
+func TestPreconditionResponses(t *testing.T) {
+	send := func(fields map[string]string) (string, *Writter) {
+		conn := &bufConn{}
+		w := NewWritter(conn)
+		req := headers.NewHeaders()
+		for k, v := range fields {
+			req.Set(k, v)
+		}
+		w.EnablePreconditions("GET", req)
+		require.NoError(t, w.WriteStatusLine(StatusOk))
+		h := GetDefaultHeaders(5)
+		h.Set("ETag", `"abc"`)
+		require.NoError(t, w.WriteHeaders(h))
+		n, err := w.WriteBody([]byte("hello"))
+		require.NoError(t, err)
+		assert.Equal(t, 5, n)
+		require.NoError(t, w.Finish())
+		return conn.buf.String(), w
+	}
+
+	// Test: a matching If-None-Match becomes a bodiless 304
+	raw, w := send(map[string]string{"If-None-Match": `"abc"`})
+	assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 304 Not Modified\r\n"))
+	h, body := splitResponse(t, raw)
+	assert.Equal(t, `"abc"`, h["etag"])
+	assert.NotContains(t, h, "content-length")
+	assert.NotContains(t, h, "content-type")
+	assert.Empty(t, body)
+	assert.Equal(t, StatusNotModified, w.StatusCode())
+	assert.True(t, w.KeepAlive())
+
+	// Test: a failed If-Match becomes 412
+	raw, w = send(map[string]string{"If-Match": `"x"`})
+	assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 412 Precondition Failed\r\n"))
+	h, body = splitResponse(t, raw)
+	assert.Equal(t, "0", h["content-length"])
+	assert.Empty(t, body)
+	assert.True(t, w.KeepAlive())
+
+	// Test: passing preconditions leave the response alone
+	raw, _ = send(map[string]string{"If-None-Match": `"x"`})
+	assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 200 OK\r\n"))
+	_, body = splitResponse(t, raw)
+	assert.Equal(t, "hello", body)
+
+	// Test: other methods are never rewritten
+	conn := &bufConn{}
+	w = NewWritter(conn)
+	req := headers.NewHeaders()
+	req.Set("If-Match", `"x"`)
+	w.EnablePreconditions("POST", req)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	assert.True(t, strings.HasPrefix(conn.buf.String(), "HTTP/1.1 200 OK\r\n"))
+}
@@ -0,0 +1,263 @@
+package response
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Digest algorithms from the HTTP Digest Algorithm Values registry.
+const (
+	DigestSHA256 = "sha-256"
+	DigestSHA512 = "sha-512"
+)
+
+// Integrity fields from RFC 9530.
+const (
+	ContentDigest = "Content-Digest"
+	ReprDigest    = "Repr-Digest"
+)
+
+type DigestOptions struct {
+	// Algorithms are the digests to compute. Defaults to sha-256.
+	Algorithms []string
+	// Fields are the fields to send them in, ContentDigest and/or
+	// ReprDigest. Defaults to ContentDigest. Repr-Digest is left out of
+	// partial responses since only part of the representation went out.
+	Fields []string
+	// LegacyFields also sends the hex sha-256 and the body length as
+	// X-Content-Sha256 and X-Content-Length.
+	LegacyFields bool
+}
+
+func newHash(alg string) (hash.Hash, error) {
+	switch alg {
+	case DigestSHA256:
+		return sha256.New(), nil
+	case DigestSHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported digest algorithm %q", alg)
+}
+
+// digester hashes the body as it goes out.
+type digester struct {
+	opts   DigestOptions
+	algs   []string
+	hashes []hash.Hash
+	n      int64
+}
+
+func newDigester(opts DigestOptions) (*digester, error) {
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = []string{DigestSHA256}
+	}
+	if len(opts.Fields) == 0 {
+		opts.Fields = []string{ContentDigest}
+	}
+	for _, f := range opts.Fields {
+		if f != ContentDigest && f != ReprDigest {
+			return nil, fmt.Errorf("unsupported digest field %q", f)
+		}
+	}
+	d := &digester{opts: opts}
+	algs := opts.Algorithms
+	if opts.LegacyFields && !containsFold(algs, DigestSHA256) {
+		algs = append(algs[:len(algs):len(algs)], DigestSHA256)
+	}
+	for _, alg := range algs {
+		alg = strings.ToLower(alg)
+		h, err := newHash(alg)
+		if err != nil {
+			return nil, err
+		}
+		d.algs = append(d.algs, alg)
+		d.hashes = append(d.hashes, h)
+	}
+	return d, nil
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	for _, h := range d.hashes {
+		h.Write(p)
+	}
+	d.n += int64(len(p))
+	return len(p), nil
+}
+
+// fieldNames lists the fields the digester will send, e.g. for the Trailer
+// header.
+func (d *digester) fieldNames(statusCode StatusCode) []string {
+	var names []string
+	for _, f := range d.opts.Fields {
+		if f == ReprDigest && statusCode == StatusPartialContent {
+			continue
+		}
+		names = append(names, f)
+	}
+	if d.opts.LegacyFields {
+		names = append(names, "X-Content-Sha256", "X-Content-Length")
+	}
+	return names
+}
+
+func (d *digester) setFields(h headers.Headers, statusCode StatusCode) {
+	var members []string
+	for i, alg := range d.algs {
+		if !containsFold(d.opts.Algorithms, alg) {
+			continue
+		}
+		members = append(members, alg+"=:"+base64.StdEncoding.EncodeToString(d.hashes[i].Sum(nil))+":")
+	}
+	value := strings.Join(members, ", ")
+	for _, f := range d.fieldNames(statusCode) {
+		switch f {
+		case ContentDigest, ReprDigest:
+			h.Set(f, value)
+		case "X-Content-Sha256":
+			for i, alg := range d.algs {
+				if alg == DigestSHA256 {
+					h.Set(f, hex.EncodeToString(d.hashes[i].Sum(nil)))
+				}
+			}
+		case "X-Content-Length":
+			h.Set(f, strconv.FormatInt(d.n, 10))
+		}
+	}
+}
+
+// ParseWantDigest returns the supported algorithms a Want-Content-Digest
+// or Want-Repr-Digest value asks for, most preferred first. Weights of 0
+// mean "not acceptable".
+func ParseWantDigest(value string) []string {
+	type pref struct {
+		alg    string
+		weight int
+	}
+	var prefs []pref
+	for _, member := range strings.Split(value, ",") {
+		member, _, _ = strings.Cut(member, ";")
+		alg, v, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			continue
+		}
+		alg = strings.ToLower(strings.TrimSpace(alg))
+		weight, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || weight <= 0 || weight > 10 {
+			continue
+		}
+		if _, err := newHash(alg); err != nil {
+			continue
+		}
+		prefs = append(prefs, pref{alg, weight})
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].weight > prefs[j].weight })
+	algs := make([]string, 0, len(prefs))
+	for _, p := range prefs {
+		algs = append(algs, p.alg)
+	}
+	return algs
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableDigests makes the writer send digests of the body. A chunked body
+// is hashed as it is sent and the digests appended as trailers, announced
+// in the Trailer header. A body with a Content-Length is hashed before the
+// header block, which carries the digests and is held back until then;
+// one of over 64KiB sent with WriteBodyFrom goes chunked instead, so it
+// never has to be held in memory.
+// The digests cover the body as sent, i.e. after compression. It must be
+// called before WriteHeaders and has no effect on responses of unknown
+// length that aren't chunked.
+func (w *Writter) EnableDigests(opts DigestOptions) error {
+	if w.state != writeStatusLine && w.state != writeHeaders {
+		return fmt.Errorf("digests must be enabled before the headers are written")
+	}
+	d, err := newDigester(opts)
+	if err != nil {
+		return err
+	}
+	w.digest = d
+	return nil
+}
+
+// setupDigests announces the digest trailers of a chunked response, or
+// drops the digester when the response has no body to hash. Fixed-length
+// bodies are left to WriteHeaders to hold back.
+func (w *Writter) setupDigests(h headers.Headers) {
+	if w.digest == nil {
+		return
+	}
+	if w.discard || !hasBody(w.statusCode) || (!w.chunked && w.contentLength < 0) {
+		w.digest = nil
+		return
+	}
+	if !w.chunked {
+		return
+	}
+	w.announceDigests(h)
+}
+
+// announceDigests adds the digest trailers to the Trailer header.
+func (w *Writter) announceDigests(h headers.Headers) {
+	names := strings.Join(w.digest.fieldNames(w.statusCode), ", ")
+	if v := h.Get("Trailer"); v != "" {
+		names = v + ", " + names
+	}
+	h.Set("Trailer", names)
+}
+
+// maxHeldDigestBody is the longest body read from an io.Reader that is
+// buffered so its digests can go in the header block.
+const maxHeldDigestBody = 64 << 10
+
+// digestBody hashes a short fixed-length body in r and sends the held back
+// header block, returning the body as read into memory. A longer body
+// isn't held: the response goes chunked instead, with the digests as
+// trailers, and r is returned to be hashed as it is sent.
+func (w *Writter) digestBody(r io.Reader) (io.Reader, error) {
+	if w.contentLength > maxHeldDigestBody {
+		h := w.digestHeld
+		w.digestHeld = nil
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.announceDigests(h)
+		w.chunked = true
+		return r, w.sendHeaders(h, w.digestStatus)
+	}
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	w.digest.Write(buf)
+	return bytes.NewReader(buf), w.sendDigestHeaders()
+}
+
+// sendDigestHeaders sends the header block held back for the digests of a
+// fixed-length body, once it has been hashed.
+func (w *Writter) sendDigestHeaders() error {
+	h := w.digestHeld
+	w.digestHeld = nil
+	if w.digest != nil {
+		w.digest.setFields(h, w.statusCode)
+		w.digest = nil
+	}
+	return w.sendHeaders(h, w.digestStatus)
+}
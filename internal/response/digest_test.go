@@ -0,0 +1,183 @@
+package response
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkedTrailers returns the trailer section following the last chunk.
+func chunkedTrailers(t *testing.T, raw string) map[string]string {
+	t.Helper()
+	_, tail, ok := strings.Cut(raw, "\r\n0\r\n")
+	require.True(t, ok)
+	h := map[string]string{}
+	for _, l := range strings.Split(strings.TrimSuffix(tail, "\r\n\r\n"), "\r\n") {
+		if l == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(l, ": ")
+		require.True(t, ok)
+		h[strings.ToLower(k)] = v
+	}
+	return h
+}
+
+func chunkedHeaders() map[string]string {
+	return map[string]string{"Content-Type": "text/plain", "Transfer-Encoding": "chunked"}
+}
+
+func TestDigestTrailers(t *testing.T) {
+	sum256 := sha256.Sum256([]byte("hello world"))
+	sum512 := sha512.Sum512([]byte("hello world"))
+	b64 := base64.StdEncoding.EncodeToString
+
+	// Test: both fields with both algorithms, merged with the handler's trailers
+	conn := &bufConn{}
+	w := NewWritter(conn)
+	require.NoError(t, w.EnableDigests(DigestOptions{
+		Algorithms: []string{DigestSHA256, DigestSHA512},
+		Fields:     []string{ContentDigest, ReprDigest},
+	}))
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	hdrs := chunkedHeaders()
+	hdrs["Trailer"] = "X-Done"
+	require.NoError(t, w.WriteHeaders(hdrs))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(map[string]string{"X-Done": "yes"}))
+
+	h, _ := splitResponse(t, conn.buf.String())
+	assert.Equal(t, "X-Done, Content-Digest, Repr-Digest", h["trailer"])
+	want := "sha-256=:" + b64(sum256[:]) + ":, sha-512=:" + b64(sum512[:]) + ":"
+	trailers := chunkedTrailers(t, conn.buf.String())
+	assert.Equal(t, map[string]string{"x-done": "yes", "content-digest": want, "repr-digest": want}, trailers)
+	assert.True(t, w.KeepAlive())
+
+	// Test: Finish sends the trailers and legacy fields for handlers that don't
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	require.NoError(t, w.EnableDigests(DigestOptions{LegacyFields: true}))
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders()))
+	_, err = w.WriteChunkedBody([]byte("hello world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, map[string]string{
+		"content-digest":   "sha-256=:" + b64(sum256[:]) + ":",
+		"x-content-sha256": hex.EncodeToString(sum256[:]),
+		"x-content-length": "11",
+	}, chunkedTrailers(t, conn.buf.String()))
+
+	// Test: compressed bodies are hashed as sent
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	w.EnableCompression("gzip", DefaultCompressOptions)
+	require.NoError(t, w.EnableDigests(DigestOptions{}))
+	body := strings.Repeat("hello compressed world\n", 200)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(body))))
+	_, err = w.WriteBody([]byte(body))
+	require.NoError(t, err)
+	h, raw := splitResponse(t, conn.buf.String())
+	assert.Equal(t, "Content-Digest", h["trailer"])
+	sent := sha256.Sum256(decodeChunked(t, raw))
+	assert.Equal(t, "sha-256=:"+b64(sent[:])+":", chunkedTrailers(t, conn.buf.String())["content-digest"])
+
+	// Test: partial responses leave out Repr-Digest
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	require.NoError(t, w.EnableDigests(DigestOptions{Fields: []string{ContentDigest, ReprDigest}}))
+	require.NoError(t, w.WriteStatusLine(StatusPartialContent))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders()))
+	h, _ = splitResponse(t, conn.buf.String())
+	assert.Equal(t, "Content-Digest", h["trailer"])
+
+	// Test: fixed length bodies get the digests as header fields
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	require.NoError(t, w.EnableDigests(DigestOptions{Fields: []string{ContentDigest, ReprDigest}}))
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(11)))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", conn.buf.String(), "header fields wait for the body")
+	_, err = w.WriteBody([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	h, raw = splitResponse(t, conn.buf.String())
+	assert.Equal(t, "sha-256=:"+b64(sum256[:])+":", h["content-digest"])
+	assert.Equal(t, "sha-256=:"+b64(sum256[:])+":", h["repr-digest"])
+	assert.NotContains(t, h, "trailer")
+	assert.Equal(t, "hello world", raw)
+	assert.True(t, w.KeepAlive())
+
+	// Test: fixed length bodies read from seekable and plain readers
+	for _, r := range []io.Reader{strings.NewReader("hello world"), io.MultiReader(strings.NewReader("hello world"))} {
+		conn = &bufConn{}
+		w = NewWritter(conn)
+		require.NoError(t, w.EnableDigests(DigestOptions{}))
+		require.NoError(t, w.WriteStatusLine(StatusOk))
+		require.NoError(t, w.WriteHeaders(GetDefaultHeaders(11)))
+		n, err := w.WriteBodyFrom(r)
+		require.NoError(t, err)
+		assert.Equal(t, int64(11), n)
+		h, raw = splitResponse(t, conn.buf.String())
+		assert.Equal(t, "sha-256=:"+b64(sum256[:])+":", h["content-digest"])
+		assert.Equal(t, "hello world", raw)
+	}
+
+	// Test: long bodies from a reader go chunked with digest trailers
+	long := strings.Repeat("0123456789abcdef", 8<<10)
+	longSum := sha256.Sum256([]byte(long))
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	require.NoError(t, w.EnableDigests(DigestOptions{}))
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(long))))
+	n, err := w.WriteBodyFrom(io.MultiReader(strings.NewReader(long)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(long)), n)
+	require.NoError(t, w.Finish())
+	h, raw = splitResponse(t, conn.buf.String())
+	assert.Equal(t, "chunked", h["transfer-encoding"])
+	assert.Equal(t, "Content-Digest", h["trailer"])
+	assert.NotContains(t, h, "content-length")
+	assert.Equal(t, long, string(decodeChunked(t, raw)))
+	assert.Equal(t, "sha-256=:"+b64(longSum[:])+":", chunkedTrailers(t, conn.buf.String())["content-digest"])
+	assert.True(t, w.KeepAlive())
+
+	// Test: an empty body never written still gets its digest
+	empty := sha256.Sum256(nil)
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	require.NoError(t, w.EnableDigests(DigestOptions{}))
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.NoError(t, w.Finish())
+	h, _ = splitResponse(t, conn.buf.String())
+	assert.Equal(t, "sha-256=:"+b64(empty[:])+":", h["content-digest"])
+
+	// Test: unknown algorithms and fields are rejected
+	w = NewWritter(&bufConn{})
+	assert.Error(t, w.EnableDigests(DigestOptions{Algorithms: []string{"md5"}}))
+	assert.Error(t, w.EnableDigests(DigestOptions{Fields: []string{"Digest"}}))
+}
+
+func TestParseWantDigest(t *testing.T) {
+	assert.Equal(t, []string{"sha-512", "sha-256"}, ParseWantDigest("sha-256=1, SHA-512=3, md5=10"))
+	assert.Equal(t, []string{"sha-256"}, ParseWantDigest("sha-512=0, sha-256=2;x=1"))
+	assert.Empty(t, ParseWantDigest("sha-256, sha-512=11, sha-256=a"))
+	assert.Empty(t, ParseWantDigest(""))
+}
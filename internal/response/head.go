@@ -0,0 +1,44 @@
+package response
+
+import (
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"strconv"
+)
+
+// DiscardBody makes the response header-only, as a HEAD request wants.
+// Handlers write the response they would for GET; the body is counted but
+// never sent. A response framed without a Content-Length has its header
+// block held back until the body ends, so it can report the length, and
+// no chunked framing is ever sent.
+func (w *Writter) DiscardBody() {
+	w.head = true
+}
+
+func (w *Writter) holdHeaders(h headers.Headers) {
+	h.Del("Transfer-Encoding")
+	h.Del("Trailer")
+	w.held = h
+	w.digest = nil
+	w.chunked = false
+	w.contentLength = 0
+	w.trailersDone = true
+	w.state = writeBody
+}
+
+// releaseHeaders sends a header block held back by holdHeaders, with the
+// counted body length if withLength is set. It does nothing when there
+// is none.
+func (w *Writter) releaseHeaders(withLength bool) error {
+	h := w.held
+	if h == nil {
+		return nil
+	}
+	w.held = nil
+	if withLength {
+		h.Set("Content-Length", strconv.Itoa(w.heldLen))
+	}
+	state := w.state
+	err := w.sendHeaders(h, true)
+	w.state = state
+	return err
+}
@@ -0,0 +1,50 @@
+package response
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+var (
+	ErrNotHijackable = errors.New("connection can't be hijacked")
+	ErrHijacked      = errors.New("connection already hijacked")
+)
+
+// Hijacker hands over the connection behind a Writter. The reader yields
+// any bytes the server already read past the request before reading from
+// the connection itself.
+type Hijacker func() (net.Conn, io.Reader, error)
+
+// SetHijacker is used by the server to let handlers take the connection
+// over, e.g. for WebSockets.
+func (w *Writter) SetHijacker(fn Hijacker) {
+	w.hijacker = fn
+}
+
+// Hijack hands the connection to the caller, who from then on does all
+// reading and writing on it. Anything written through w before is already
+// on the wire; w can't be used afterwards. The server closes the
+// connection when the handler returns and counts it as active until then,
+// so long-lived handlers should watch for Shutdown themselves.
+func (w *Writter) Hijack() (net.Conn, io.Reader, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	conn, r, err := w.hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	w.closeAfter = true
+	w.state = writeDone
+	return conn, r, nil
+}
+
+// Hijacked reports whether the handler took the connection over.
+func (w *Writter) Hijacked() bool {
+	return w.hijacked
+}
@@ -1,17 +1,69 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"io"
+	"maps"
 	"net"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type writterState int
 
 type Writter struct {
-	conn  net.Conn
-	state writterState
+	conn net.Conn
+	// stream, when set, replaces conn and does its own framing
+	stream Stream
+	state  writterState
+
+	statusCode   StatusCode
+	bytesWritten int
+
+	// framing of the response, recorded by WriteHeaders so the server can
+	// tell whether the connection can carry another request
+	contentLength int
+	chunked       bool
+	trailersDone  bool
+	closeAfter    bool
+	// err is the first error returned by the connection
+	err error
+
+	compressOpts *CompressOptions
+	encoding     string
+	compress     compressor
+	// chunkedConverted is set when compression turned a Content-Length
+	// response into a chunked one, so WriteBody has to terminate it.
+	chunkedConverted bool
+
+	hijacker Hijacker
+	hijacked bool
+
+	// digest hashes the body for its digest fields: trailers of a chunked
+	// body, or header fields of a fixed-length one. The header block of
+	// the latter is held in digestHeld, status line too if digestStatus is
+	// set, until the body has been hashed.
+	digest       *digester
+	digestHeld   headers.Headers
+	digestStatus bool
+
+	// cond holds the request's preconditions until WriteHeaders checks
+	// them; the status line is held back meanwhile as it may change.
+	cond *preconditions
+	// discard is set for responses that must not have a body. Body
+	// writes then succeed without sending anything.
+	discard bool
+	// head is set by DiscardBody. held is a HEAD response's header block
+	// waiting for heldLen to be known. headEncoded is set when HEAD got
+	// the coding GET would, so there is no length to report.
+	head        bool
+	held        headers.Headers
+	heldLen     int
+	headEncoded bool
 }
 
 const (
@@ -24,19 +76,73 @@ const (
 type StatusCode int
 
 const (
+	StatusSwitchingProtocols  StatusCode = 101
 	StatusOk                  StatusCode = 200
+	StatusNoContent           StatusCode = 204
+	StatusPartialContent      StatusCode = 206
+	StatusMovedPermanently    StatusCode = 301
+	StatusNotModified         StatusCode = 304
 	StatusBadRequest          StatusCode = 400
+	StatusForbidden           StatusCode = 403
+	StatusNotFound            StatusCode = 404
+	StatusMethodNotAllowed    StatusCode = 405
+	StatusRequestTimeout      StatusCode = 408
+	StatusPreconditionFailed  StatusCode = 412
+	StatusContentTooLarge     StatusCode = 413
+	StatusRangeNotSatisfiable StatusCode = 416
+	StatusUpgradeRequired     StatusCode = 426
+	StatusHeaderTooLarge      StatusCode = 431
 	StatusInternalServerError StatusCode = 500
+	StatusNotImplemented      StatusCode = 501
+	StatusBadGateway          StatusCode = 502
+	StatusServiceUnavailable  StatusCode = 503
+	StatusGatewayTimeout      StatusCode = 504
 )
 
 func (s StatusCode) String() string {
 	switch s {
+	case StatusSwitchingProtocols:
+		return "Switching Protocols"
 	case StatusOk:
 		return "OK"
+	case StatusNoContent:
+		return "No Content"
+	case StatusPartialContent:
+		return "Partial Content"
+	case StatusMovedPermanently:
+		return "Moved Permanently"
+	case StatusNotModified:
+		return "Not Modified"
 	case StatusBadRequest:
 		return "Bad Request"
+	case StatusForbidden:
+		return "Forbidden"
+	case StatusNotFound:
+		return "Not Found"
+	case StatusMethodNotAllowed:
+		return "Method Not Allowed"
+	case StatusRequestTimeout:
+		return "Request Timeout"
+	case StatusPreconditionFailed:
+		return "Precondition Failed"
+	case StatusContentTooLarge:
+		return "Content Too Large"
+	case StatusRangeNotSatisfiable:
+		return "Range Not Satisfiable"
+	case StatusUpgradeRequired:
+		return "Upgrade Required"
+	case StatusHeaderTooLarge:
+		return "Request Header Fields Too Large"
 	case StatusInternalServerError:
 		return "Internal Server Error"
+	case StatusNotImplemented:
+		return "Not Implemented"
+	case StatusBadGateway:
+		return "Bad Gateway"
+	case StatusServiceUnavailable:
+		return "Service Unavailable"
+	case StatusGatewayTimeout:
+		return "Gateway Timeout"
 	default:
 		return ""
 	}
@@ -46,23 +152,65 @@ func (w *Writter) WriteStatusLine(statusCode StatusCode) error {
 	if w.state != writeStatusLine {
 		return fmt.Errorf("error status line already written")
 	}
-	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, statusCode)
-	_, err := w.conn.Write([]byte(statusLine))
-	if err != nil {
+	if w.stream != nil || w.cond != nil || w.head {
+		// sent along with the headers
+		w.statusCode = statusCode
+		w.state = writeHeaders
+		return nil
+	}
+	if err := w.writeStatusLine(statusCode); err != nil {
 		return err
 	}
+	w.statusCode = statusCode
 	w.state = writeHeaders
 	return nil
 }
 
+func (w *Writter) writeStatusLine(statusCode StatusCode) error {
+	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, statusCode)
+	_, err := w.write([]byte(statusLine))
+	return err
+}
+
+// StatusCode returns the status sent to the client, or 0 if the status line
+// hasn't been written yet.
+func (w *Writter) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns the number of body bytes sent so far, not counting
+// chunk framing. For compressed responses this is the compressed size.
+func (w *Writter) BytesWritten() int {
+	return w.bytesWritten
+}
+
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	h := headers.NewHeaders()
 	h.Set("Content-Length", strconv.Itoa(contentLen))
-	h.Set("Connection", "close")
 	h.Set("Content-Type", "text/plain")
 	return h
 }
 
+// WriteText writes a complete text/plain response. Entries in h are added
+// to, and override, the default headers.
+func WriteText(w *Writter, statusCode StatusCode, h headers.Headers, body string) error {
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+	respHeaders := GetDefaultHeaders(len(body))
+	for k, v := range h {
+		respHeaders.Set(k, v)
+	}
+	if err := w.WriteHeaders(respHeaders); err != nil {
+		return err
+	}
+	if body == "" {
+		return nil
+	}
+	_, err := w.WriteBody([]byte(body))
+	return err
+}
+
 func (w *Writter) WriteHeaders(headers headers.Headers) error {
 	if w.state != writeHeaders {
 		return fmt.Errorf("error headers already written")
@@ -70,27 +218,122 @@ func (w *Writter) WriteHeaders(headers headers.Headers) error {
 	if headers == nil {
 		return fmt.Errorf("empty headers")
 	}
-	for k, v := range headers {
-		fieldLine := fmt.Sprintf("%s: %s\r\n", k, v)
-		_, err := w.conn.Write([]byte(fieldLine))
-		if err != nil {
+	deferred := w.cond != nil || w.head
+	if w.cond != nil {
+		headers = w.applyPreconditions(headers)
+	}
+	w.setupCompression(headers)
+	if w.head {
+		w.discard = true
+	}
+	if w.closeAfter && headers.Get("Connection") == "" {
+		headers.Set("Connection", "close")
+	}
+	w.recordFraming(headers)
+	w.setupDigests(headers)
+	if w.discard {
+		if w.head && hasBody(w.statusCode) && (w.chunked || w.contentLength < 0) && !w.headEncoded {
+			w.holdHeaders(headers)
+			return nil
+		}
+		// nothing follows the header block
+		w.digest = nil
+		w.chunked = false
+		w.contentLength = 0
+		w.trailersDone = true
+	}
+	if w.digest != nil && !w.chunked {
+		// the digests of a fixed-length body go in the header block
+		w.digestHeld = headers
+		w.digestStatus = deferred
+		w.state = writeBody
+		return nil
+	}
+	return w.sendHeaders(headers, deferred)
+}
+
+// sendHeaders writes the header block, preceded by the status line if
+// WriteStatusLine held it back.
+func (w *Writter) sendHeaders(h headers.Headers, withStatus bool) error {
+	if w.stream != nil {
+		if err := w.streamErr(w.stream.WriteHeaders(int(w.statusCode), h, w.discard)); err != nil {
 			return err
 		}
+		w.state = writeBody
+		return nil
+	}
+	if withStatus {
+		if err := w.writeStatusLine(w.statusCode); err != nil {
+			return err
+		}
+	}
+	if err := w.writeFields(h); err != nil {
+		return err
 	}
-	_, err := w.conn.Write([]byte("\r\n"))
+	_, err := w.write([]byte("\r\n"))
 	if err != nil {
 		return err
 	}
 	w.state = writeBody
 	return nil
+}
 
+func (w *Writter) writeFields(h headers.Headers) error {
+	for k, v := range h {
+		for _, line := range headers.Lines(v) {
+			if _, err := w.write([]byte(fmt.Sprintf("%s: %s\r\n", k, line))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (w *Writter) WriteBody(p []byte) (int, error) {
 	if w.state != writeBody {
 		return 0, fmt.Errorf("error, writting body after close or before headers")
 	}
-	n, err := w.conn.Write(p)
+	if w.discard {
+		w.heldLen += len(p)
+		w.state = writeDone
+		if err := w.releaseHeaders(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.digestHeld != nil {
+		w.digest.Write(p[:min(len(p), w.contentLength)])
+		if err := w.sendDigestHeaders(); err != nil {
+			return 0, err
+		}
+	}
+	if w.compress != nil {
+		n, err := w.compress.Write(p)
+		if err != nil {
+			return 0, err
+		}
+		if w.chunkedConverted {
+			if err := w.compress.Close(); err != nil {
+				return 0, err
+			}
+			if err := w.endStream(); err != nil {
+				return 0, err
+			}
+		}
+		w.state = writeDone
+		return n, nil
+	}
+	if w.stream != nil {
+		if err := w.streamErr(w.stream.WriteData(p, true)); err != nil {
+			return 0, err
+		}
+		w.bytesWritten += len(p)
+		w.trailersDone = true
+		w.state = writeDone
+		return len(p), nil
+	}
+	n, err := w.write(p)
+	w.bytesWritten += n
 	if err != nil {
 		return 0, err
 	}
@@ -98,10 +341,165 @@ func (w *Writter) WriteBody(p []byte) (int, error) {
 	return n, nil
 }
 
+// WriteBodyFrom sends the body read from r until EOF without holding it in
+// memory, e.g. from a file. With a Content-Length exactly that many bytes
+// are sent, and running short is an error. Like WriteBody it completes the
+// body; a chunked one can still be followed by trailers.
+//
+// An *os.File sent as is on a plain TCP connection is handed to the
+// kernel (sendfile or splice) without passing through user space.
+func (w *Writter) WriteBodyFrom(r io.Reader) (int64, error) {
+	if w.state != writeBody {
+		return 0, fmt.Errorf("error, writting body after close or before headers")
+	}
+	if w.discard {
+		w.state = writeDone
+		if w.held == nil {
+			return 0, nil
+		}
+		n, err := io.Copy(io.Discard, r)
+		w.heldLen += int(n)
+		if err != nil {
+			return n, err
+		}
+		return n, w.releaseHeaders(true)
+	}
+	fixed := !w.chunked && w.contentLength >= 0
+	if fixed {
+		r = io.LimitReader(r, int64(w.contentLength))
+	}
+	if w.digestHeld != nil {
+		var err error
+		if r, err = w.digestBody(r); err != nil {
+			return 0, err
+		}
+	}
+	var written int64
+	var err error
+	if rf, ok := w.zeroCopy(r); ok {
+		written, err = rf.ReadFrom(r)
+		w.bytesWritten += int(written)
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+	} else {
+		written, err = w.copyBuffered(r)
+	}
+	if err != nil {
+		return written, err
+	}
+	if fixed && written < int64(w.contentLength) {
+		return written, io.ErrUnexpectedEOF
+	}
+	return written, w.endBody()
+}
+
+// zeroCopy returns the connection as an io.ReaderFrom when the body in r
+// is a file going out unchanged over plain TCP. Compressed, chunked or
+// digested bodies, TLS and streams go through copyBuffered.
+func (w *Writter) zeroCopy(r io.Reader) (io.ReaderFrom, bool) {
+	if w.stream != nil || w.compress != nil || w.chunked || w.digest != nil {
+		return nil, false
+	}
+	if lr, ok := r.(*io.LimitedReader); ok {
+		r = lr.R
+	}
+	if _, ok := r.(*os.File); !ok {
+		return nil, false
+	}
+	tc, ok := w.conn.(*net.TCPConn)
+	return tc, ok
+}
+
+func (w *Writter) copyBuffered(r io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if err := w.writeBodyPart(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if errors.Is(rerr, io.EOF) {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+func (w *Writter) writeBodyPart(p []byte) error {
+	switch {
+	case w.compress != nil:
+		_, err := w.compress.Write(p)
+		return err
+	case w.chunked:
+		_, err := w.writeChunk(p)
+		return err
+	case w.stream != nil:
+		if err := w.streamErr(w.stream.WriteData(p, false)); err != nil {
+			return err
+		}
+		w.bytesWritten += len(p)
+		return nil
+	}
+	n, err := w.write(p)
+	w.bytesWritten += n
+	return err
+}
+
+// endBody completes a body written in parts.
+func (w *Writter) endBody() error {
+	switch {
+	case w.chunkedConverted:
+		w.state = writeDone
+		if err := w.compress.Close(); err != nil {
+			return err
+		}
+		return w.endStream()
+	case w.chunked:
+		_, err := w.WriteChunkedBodyDone()
+		return err
+	case w.stream != nil:
+		w.state = writeDone
+		return w.endStream()
+	}
+	w.state = writeDone
+	return nil
+}
+
+func (w *Writter) write(p []byte) (int, error) {
+	n, err := w.conn.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// SetWriteDeadline moves the connection's write deadline, e.g. for a
+// long-lived stream that would otherwise hit the server's write timeout.
+// Streams manage their own deadlines, so it is a no-op there.
+func (w *Writter) SetWriteDeadline(t time.Time) error {
+	if w.stream != nil {
+		return nil
+	}
+	return w.conn.SetWriteDeadline(t)
+}
+
+// Err returns the first error hit while writing to the connection, e.g. a
+// write deadline being exceeded.
+func (w *Writter) Err() error {
+	return w.err
+}
+
 func NewWritter(conn net.Conn) *Writter {
 	return &Writter{
-		conn:  conn,
-		state: writeStatusLine,
+		conn:          conn,
+		state:         writeStatusLine,
+		contentLength: -1,
 	}
 }
 
@@ -109,22 +507,57 @@ func (w *Writter) WriteChunkedBody(p []byte) (int, error) {
 	if w.state != writeBody {
 		return 0, fmt.Errorf("error, writting body after close or before headers")
 	}
+	if w.discard {
+		w.heldLen += len(p)
+		return len(p), nil
+	}
+	if w.compress != nil {
+		return w.compress.Write(p)
+	}
+	return w.writeChunk(p)
+}
+
+func (w *Writter) writeChunk(p []byte) (int, error) {
+	if w.digest != nil {
+		w.digest.Write(p)
+	}
+	if w.stream != nil {
+		if err := w.streamErr(w.stream.WriteData(p, false)); err != nil {
+			return 0, err
+		}
+		w.bytesWritten += len(p)
+		return len(p), nil
+	}
 	chunLen := len(p)
 	chunkLenHex := fmt.Sprintf("%X\r\n", chunLen)
 	var buf []byte
 	buf = append(buf, []byte(chunkLenHex)...)
 	buf = append(buf, p...)
 	buf = append(buf, []byte("\r\n")...)
-	n, err := w.conn.Write(buf)
+	n, err := w.write(buf)
 	if err != nil {
 		return 0, err
 	}
+	w.bytesWritten += chunLen
 	return n, nil
 }
 
 func (w *Writter) WriteChunkedBodyDone() (int, error) {
+	if w.discard {
+		w.state = writeDone
+		return 0, w.releaseHeaders(true)
+	}
+	if w.compress != nil && w.state == writeBody {
+		if err := w.compress.Close(); err != nil {
+			return 0, err
+		}
+	}
 	w.state = writeDone
-	w.conn.Write([]byte("0\r\n"))
+	if w.stream != nil {
+		// the stream is ended by the trailers or Finish
+		return 0, nil
+	}
+	w.write([]byte("0\r\n"))
 	return 0, nil
 }
 
@@ -132,13 +565,92 @@ func (w *Writter) WriteTrailers(h headers.Headers) error {
 	if h == nil {
 		return fmt.Errorf("no trailers to write")
 	}
-	for k, v := range h {
-		line := []byte(fmt.Sprintf("%s: %s\r\n", k, v))
-		_, err := w.conn.Write(line)
-		if err != nil {
+	if w.discard {
+		return nil
+	}
+	if w.digest != nil {
+		h = maps.Clone(h)
+		w.digest.setFields(h, w.statusCode)
+		w.digest = nil
+	}
+	if w.stream != nil {
+		if err := w.streamErr(w.stream.WriteTrailers(h)); err != nil {
 			return err
 		}
+		w.trailersDone = true
+		return nil
+	}
+	if err := w.writeFields(h); err != nil {
+		return err
 	}
-	w.conn.Write([]byte("\r\n"))
+	_, err := w.write([]byte("\r\n"))
+	if err != nil {
+		return err
+	}
+	w.trailersDone = true
 	return nil
 }
+
+// CloseConnection asks for the connection to be closed once this response
+// is done. If the headers haven't been written yet they will carry
+// Connection: close.
+func (w *Writter) CloseConnection() {
+	w.closeAfter = true
+}
+
+// Finish terminates a chunked body whose handler ended it without writing
+// trailers. On a stream it ends any response whose headers went out.
+func (w *Writter) Finish() error {
+	if err := w.releaseHeaders(true); err != nil {
+		return err
+	}
+	if w.digestHeld != nil {
+		// the handler never wrote the body, which had better be empty
+		if err := w.sendDigestHeaders(); err != nil {
+			return err
+		}
+	}
+	if w.stream != nil {
+		if w.trailersDone || (w.state != writeBody && w.state != writeDone) {
+			return nil
+		}
+		return w.endStream()
+	}
+	if w.state != writeDone || !w.chunked || w.trailersDone {
+		return nil
+	}
+	return w.WriteTrailers(headers.NewHeaders())
+}
+
+// KeepAlive reports whether the response was completely and unambiguously
+// framed, so the connection can be reused for another request.
+func (w *Writter) KeepAlive() bool {
+	if w.closeAfter || w.statusCode == 0 {
+		return false
+	}
+	if w.state != writeBody && w.state != writeDone {
+		return false
+	}
+	if w.chunked {
+		return w.trailersDone
+	}
+	return w.contentLength >= 0 && w.bytesWritten == w.contentLength
+}
+
+func (w *Writter) recordFraming(h headers.Headers) {
+	for _, v := range strings.Split(h.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "close") {
+			w.closeAfter = true
+		}
+	}
+	if strings.EqualFold(h.Get("Transfer-Encoding"), "chunked") {
+		w.chunked = true
+		return
+	}
+	if v := h.Get("Content-Length"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil {
+			w.contentLength = n
+		}
+	}
+}
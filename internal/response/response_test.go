@@ -0,0 +1,281 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBodyFrom(t *testing.T) {
+	body := strings.Repeat("streamed body ", 5000)
+
+	// Test: fixed length body streamed in parts
+	conn := &bufConn{}
+	w := NewWritter(conn)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(body))))
+	n, err := w.WriteBodyFrom(strings.NewReader(body + "extra"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(body)), n)
+	_, raw := splitResponse(t, conn.buf.String())
+	assert.Equal(t, body, raw)
+	assert.True(t, w.KeepAlive())
+
+	// Test: running short of Content-Length is an error
+	w = NewWritter(&bufConn{})
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(10)))
+	_, err = w.WriteBodyFrom(strings.NewReader("short"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.False(t, w.KeepAlive())
+
+	// Test: chunked body ends with the last chunk
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(map[string]string{"Transfer-Encoding": "chunked"}))
+	_, err = w.WriteBodyFrom(strings.NewReader(body))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	_, raw = splitResponse(t, conn.buf.String())
+	assert.Equal(t, body, string(decodeChunked(t, raw)))
+	assert.True(t, strings.HasSuffix(raw, "0\r\n\r\n"))
+	assert.True(t, w.KeepAlive())
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	server := <-accepted
+	require.NotNil(t, server)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server.(*net.TCPConn), client.(*net.TCPConn)
+}
+
+// sendFile writes body from a file over loopback TCP after setup has
+// configured the writer, and returns the writer and what the client read.
+func sendFile(t *testing.T, body string, setup func(w *Writter)) (*Writter, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "body")
+	require.NoError(t, os.WriteFile(path, []byte(body), 0o644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	server, client := tcpPair(t)
+	received := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(client)
+		received <- string(out)
+	}()
+	w := NewWritter(server)
+	setup(w)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(body))))
+	_, err = w.WriteBodyFrom(f)
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	server.CloseWrite()
+	return w, <-received
+}
+
+func TestWriteBodyFromFile(t *testing.T) {
+	body := strings.Repeat("sent by the kernel ", 100000)
+
+	// Test: a file on plain TCP arrives intact
+	w, out := sendFile(t, body, func(w *Writter) {})
+	h, raw := splitResponse(t, out)
+	assert.Equal(t, strconv.Itoa(len(body)), h["content-length"])
+	assert.Equal(t, body, raw)
+	assert.Equal(t, len(body), w.BytesWritten())
+	assert.True(t, w.KeepAlive())
+
+	// Test: HEAD reports the length without sending the file
+	_, out = sendFile(t, body, func(w *Writter) { w.DiscardBody() })
+	h, raw = splitResponse(t, out)
+	assert.Equal(t, strconv.Itoa(len(body)), h["content-length"])
+	assert.Empty(t, raw)
+
+	// Test: compressed responses are encoded rather than sent as is
+	_, out = sendFile(t, body, func(w *Writter) {
+		w.EnableCompression("gzip", DefaultCompressOptions)
+	})
+	h, raw = splitResponse(t, out)
+	assert.Equal(t, "gzip", h["content-encoding"])
+	zr, err := gzip.NewReader(bytes.NewReader(decodeChunked(t, raw)))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(decoded))
+
+	// Test: digested responses are hashed on the way out
+	_, out = sendFile(t, body, func(w *Writter) {
+		require.NoError(t, w.EnableDigests(DigestOptions{}))
+	})
+	_, raw = splitResponse(t, out)
+	assert.Equal(t, body, string(decodeChunked(t, raw)))
+	sum := sha256.Sum256([]byte(body))
+	assert.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":", chunkedTrailers(t, out)["content-digest"])
+}
+
+// BenchmarkWriteBodyFrom sends a multi-GB file over loopback TCP, with
+// and without the zero-copy path. The file is sparse, so it takes no disk
+// space.
+func BenchmarkWriteBodyFrom(b *testing.B) {
+	const size = 4 << 30
+	path := filepath.Join(b.TempDir(), "big")
+	f, err := os.Create(path)
+	require.NoError(b, err)
+	defer f.Close()
+	require.NoError(b, f.Truncate(size))
+
+	for _, bc := range []struct {
+		name string
+		body func() io.Reader
+	}{
+		{"sendfile", func() io.Reader { return f }},
+		// hiding the *os.File forces the buffered copy
+		{"buffered", func() io.Reader { return struct{ io.Reader }{f} }},
+	} {
+		b.Run(fmt.Sprintf("%s/%dGiB", bc.name, size>>30), func(b *testing.B) {
+			server, client := tcpPair(b)
+			go io.Copy(io.Discard, client)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := f.Seek(0, io.SeekStart)
+				require.NoError(b, err)
+				w := NewWritter(server)
+				require.NoError(b, w.WriteStatusLine(StatusOk))
+				require.NoError(b, w.WriteHeaders(GetDefaultHeaders(size)))
+				n, err := w.WriteBodyFrom(bc.body())
+				require.NoError(b, err)
+				require.Equal(b, int64(size), n)
+			}
+		})
+	}
+}
+
+func TestDiscardBody(t *testing.T) {
+	// Test: a fixed length body is left out but its length reported
+	conn := &bufConn{}
+	w := NewWritter(conn)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(conn.buf.String(), "HTTP/1.1 200 OK\r\n"))
+	h, raw := splitResponse(t, conn.buf.String())
+	assert.Equal(t, "5", h["content-length"])
+	assert.Empty(t, raw)
+	assert.True(t, w.KeepAlive())
+
+	// Test: a chunked body is counted and reported without chunked framing
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(map[string]string{"Transfer-Encoding": "chunked", "Trailer": "X-Sum"}))
+	assert.Empty(t, conn.buf.String())
+	_, err = w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(map[string]string{"X-Sum": "1"}))
+	require.NoError(t, w.Finish())
+	h, raw = splitResponse(t, conn.buf.String())
+	assert.Equal(t, "11", h["content-length"])
+	assert.NotContains(t, h, "transfer-encoding")
+	assert.NotContains(t, h, "trailer")
+	assert.Empty(t, raw)
+	assert.True(t, w.KeepAlive())
+
+	// Test: a body streamed from a reader is counted too
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(map[string]string{"Transfer-Encoding": "chunked"}))
+	_, err = w.WriteBodyFrom(strings.NewReader("streamed"))
+	require.NoError(t, err)
+	h, raw = splitResponse(t, conn.buf.String())
+	assert.Equal(t, "8", h["content-length"])
+	assert.Empty(t, raw)
+
+	// Test: flushing a stream sends the headers without a length
+	conn = &bufConn{}
+	w = NewWritter(conn)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(map[string]string{"Transfer-Encoding": "chunked", "Content-Type": "text/event-stream"}))
+	require.NoError(t, w.Flush())
+	h, raw = splitResponse(t, conn.buf.String())
+	assert.Equal(t, "text/event-stream", h["content-type"])
+	assert.NotContains(t, h, "content-length")
+	assert.NotContains(t, h, "transfer-encoding")
+	assert.Empty(t, raw)
+	_, err = w.WriteChunkedBody([]byte("data: x\n\n"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	_, raw = splitResponse(t, conn.buf.String())
+	assert.Empty(t, raw)
+
+	// Test: HEAD gets the same coding and fields as GET
+	body := strings.Repeat("hello compressed world\n", 200)
+	send := func(head bool) (map[string]string, string, *Writter) {
+		conn := &bufConn{}
+		w := NewWritter(conn)
+		w.EnableCompression("gzip", DefaultCompressOptions)
+		if head {
+			w.DiscardBody()
+		}
+		require.NoError(t, w.WriteStatusLine(StatusOk))
+		hdrs := GetDefaultHeaders(len(body))
+		hdrs.Set("ETag", `"v1"`)
+		require.NoError(t, w.WriteHeaders(hdrs))
+		_, err := w.WriteBody([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, w.Finish())
+		h, raw := splitResponse(t, conn.buf.String())
+		return h, raw, w
+	}
+	getHeaders, _, _ := send(false)
+	h, raw, w = send(true)
+	assert.Empty(t, raw)
+	assert.True(t, w.KeepAlive())
+	for _, k := range []string{"content-encoding", "vary", "etag", "content-type"} {
+		assert.Equal(t, getHeaders[k], h[k], k)
+	}
+	assert.Equal(t, "gzip", h["content-encoding"])
+	assert.NotContains(t, h, "content-length")
+}
@@ -0,0 +1,50 @@
+package response
+
+import "github/Flarenzy/learn-http-protocol-golang/internal/headers"
+
+// Stream is a response channel that frames messages itself, such as an
+// HTTP/2 stream. A Writter built on one never writes HTTP/1.1 syntax.
+type Stream interface {
+	// WriteHeaders sends the status and header fields.
+	WriteHeaders(statusCode int, h headers.Headers, endStream bool) error
+	// WriteData sends body bytes, ending the response if endStream is set.
+	WriteData(p []byte, endStream bool) error
+	// WriteTrailers sends trailer fields and ends the response.
+	WriteTrailers(h headers.Headers) error
+}
+
+// NewStreamWritter returns a Writter that sends the response on s. Handlers
+// use it exactly like one writing to a connection.
+func NewStreamWritter(s Stream) *Writter {
+	return &Writter{
+		stream:        s,
+		state:         writeStatusLine,
+		contentLength: -1,
+	}
+}
+
+// endStream terminates the body of a chunked or stream response, with the
+// digest trailers if there are any.
+func (w *Writter) endStream() error {
+	if w.digest != nil {
+		if w.stream == nil {
+			if _, err := w.write([]byte("0\r\n")); err != nil {
+				return err
+			}
+		}
+		return w.WriteTrailers(headers.NewHeaders())
+	}
+	w.trailersDone = true
+	if w.stream != nil {
+		return w.streamErr(w.stream.WriteData(nil, true))
+	}
+	_, err := w.write([]byte("0\r\n\r\n"))
+	return err
+}
+
+func (w *Writter) streamErr(err error) error {
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return err
+}
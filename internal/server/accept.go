@@ -0,0 +1,50 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
+
+// isTemporaryAcceptError reports whether an Accept failure is worth
+// retrying, like running out of file descriptors or a peer resetting the
+// connection before it was accepted.
+func isTemporaryAcceptError(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	temporary := []error{
+		syscall.EMFILE,
+		syscall.ENFILE,
+		syscall.ENOBUFS,
+		syscall.ENOMEM,
+		syscall.ECONNABORTED,
+		syscall.ECONNRESET,
+		syscall.EAGAIN,
+		syscall.EINTR,
+	}
+	for _, t := range temporary {
+		if errors.Is(err, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextBackoff doubles delay within the accept backoff bounds.
+func nextBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return acceptBackoffMin
+	}
+	return min(delay*2, acceptBackoffMax)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"io"
+	"log"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedListener returns the queued results from Accept in order.
+type scriptedListener struct {
+	results chan acceptResult
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	r, ok := <-l.results
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return r.conn, r.err
+}
+
+func (l *scriptedListener) Close() error   { return nil }
+func (l *scriptedListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestAcceptLoop(t *testing.T) {
+	handled := make(chan struct{}, 1)
+	newServer := func() *Server {
+		s, err := New(Config{
+			Handler: func(w *response.Writter, req *request.Request) {
+				response.WriteText(w, response.StatusOk, nil, "")
+				handled <- struct{}{}
+			},
+			Logger:   log.New(io.Discard, "", 0),
+			ErrorLog: log.New(io.Discard, "", 0),
+		})
+		require.NoError(t, err)
+		return s
+	}
+
+	// Test: Temporary errors are retried and serving continues
+	l := &scriptedListener{results: make(chan acceptResult, 4)}
+	s := newServer()
+	server, client := net.Pipe()
+	l.results <- acceptResult{err: fmt.Errorf("accept: %w", syscall.EMFILE)}
+	l.results <- acceptResult{err: &net.OpError{Op: "accept", Err: syscall.ECONNABORTED}}
+	l.results <- acceptResult{conn: server}
+	serveErr := make(chan error)
+	go func() { serveErr <- s.Serve(l) }()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\nConnection: close\r\n\r\n"))
+		io.Copy(io.Discard, client)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request after temporary errors was not served")
+	}
+	assert.Equal(t, uint64(2), s.Metrics().AcceptRetries)
+
+	// Test: A permanent error ends Serve with that error
+	l.results <- acceptResult{err: errors.New("listener exploded")}
+	select {
+	case err := <-serveErr:
+		assert.ErrorContains(t, err, "listener exploded")
+		assert.NotErrorIs(t, err, ErrServerClosed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+
+	// Test: A listener closed by Shutdown ends Serve with ErrServerClosed
+	l = &scriptedListener{results: make(chan acceptResult)}
+	s = newServer()
+	go func() { serveErr <- s.Serve(l) }()
+	require.Eventually(t, func() bool { return s.Addr() != nil }, time.Second, time.Millisecond)
+	s.Close()
+	close(l.results)
+	assert.ErrorIs(t, <-serveErr, ErrServerClosed)
+}
+
+func TestNextBackoff(t *testing.T) {
+	assert.Equal(t, acceptBackoffMin, nextBackoff(0))
+	assert.Equal(t, 2*acceptBackoffMin, nextBackoff(acceptBackoffMin))
+	assert.Equal(t, acceptBackoffMax, nextBackoff(acceptBackoffMax))
+}
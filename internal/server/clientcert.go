@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/x509"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"log"
+	"path"
+)
+
+// CertRule matches a verified client certificate. Fields are glob
+// patterns in path.Match syntax; empty fields are ignored, and a rule
+// matches when every set field matches. For SAN fields it is enough that
+// one of the certificate's entries matches.
+type CertRule struct {
+	CommonName   string
+	Organization string
+	DNSName      string
+	URI          string
+	Email        string
+}
+
+// RequireClientCert only lets requests through whose verified client
+// certificate matches at least one of rules, answering 403 otherwise. With
+// no rules any verified certificate is accepted.
+func RequireClientCert(rules ...CertRule) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writter, req *request.Request) {
+			cert := req.PeerCertificate()
+			if cert == nil || !certAllowed(cert, rules) {
+				forbidden(w)
+				return
+			}
+			next(w, req)
+		}
+	}
+}
+
+func certAllowed(cert *x509.Certificate, rules []CertRule) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	for _, rule := range rules {
+		if rule.matches(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r CertRule) matches(cert *x509.Certificate) bool {
+	if r.CommonName != "" && !globMatch(r.CommonName, cert.Subject.CommonName) {
+		return false
+	}
+	if r.Organization != "" && !anyGlobMatch(r.Organization, cert.Subject.Organization) {
+		return false
+	}
+	if r.DNSName != "" && !anyGlobMatch(r.DNSName, cert.DNSNames) {
+		return false
+	}
+	if r.Email != "" && !anyGlobMatch(r.Email, cert.EmailAddresses) {
+		return false
+	}
+	if r.URI != "" {
+		uris := make([]string, 0, len(cert.URIs))
+		for _, u := range cert.URIs {
+			uris = append(uris, u.String())
+		}
+		if !anyGlobMatch(r.URI, uris) {
+			return false
+		}
+	}
+	return true
+}
+
+func globMatch(pattern, value string) bool {
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
+}
+
+func anyGlobMatch(pattern string, values []string) bool {
+	for _, v := range values {
+		if globMatch(pattern, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func forbidden(w *response.Writter) {
+	if err := response.WriteText(w, response.StatusForbidden, headers.NewHeaders(), "Forbidden\n"); err != nil {
+		log.Printf("ERROR: unable to write 403 response. %s\n", err.Error())
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/tls"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, "test-ca", nil, true)
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pemCert(ca), 0o600))
+	serverCert := newTestCert(t, ca, "server", []string{"localhost"}, false).writeFiles(t, dir, "server")
+
+	rt := NewRouter()
+	rt.Get("/public", func(w *response.Writter, req *request.Request) {
+		response.WriteText(w, response.StatusOk, nil, "public")
+	})
+	rt.With(RequireClientCert(
+		CertRule{CommonName: "billing-*"},
+		CertRule{DNSName: "*.ops.internal", Organization: "learn-http"},
+	)).Get("/admin", func(w *response.Writter, req *request.Request) {
+		response.WriteText(w, response.StatusOk, nil, "hello "+req.PeerCertificate().Subject.CommonName)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := New(Config{
+		Listener: listener,
+		Handler:  rt.ServeRequest,
+		TLS: &TLSConfig{
+			Certificates:  []CertFile{serverCert},
+			ClientCAFiles: []string{caFile},
+			ClientAuth:    tls.VerifyClientCertIfGiven,
+		},
+		Logger:   log.New(io.Discard, "", 0),
+		ErrorLog: log.New(io.Discard, "", 0),
+	})
+	require.NoError(t, err)
+	go s.ListenAndServe()
+	defer s.Close()
+	require.Eventually(t, func() bool { return s.Addr() != nil }, time.Second, time.Millisecond)
+
+	get := func(client *testCert, target string) (string, error) {
+		cfg := &tls.Config{ServerName: "localhost", InsecureSkipVerify: true}
+		if client != nil {
+			cfg.Certificates = []tls.Certificate{client.tlsCertificate()}
+		}
+		conn, err := tls.Dial("tcp", s.Addr().String(), cfg)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET " + target + " HTTP/1.1\r\nConnection: close\r\n\r\n"))
+		if err != nil {
+			return "", err
+		}
+		out, err := io.ReadAll(conn)
+		return string(out), err
+	}
+
+	// Test: Matching common name is authorized and visible to the handler
+	out, err := get(newTestCert(t, ca, "billing-api", nil, false), "/admin")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "hello billing-api"))
+
+	// Test: Matching SAN and organization is authorized
+	out, err = get(newTestCert(t, ca, "ops", []string{"node1.ops.internal"}, false), "/admin")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Verified but unmatched certificate gets 403
+	out, err = get(newTestCert(t, ca, "reporting", []string{"reporting.svc"}, false), "/admin")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+
+	// Test: No certificate gets 403 on protected routes but can use public ones
+	out, err = get(nil, "/admin")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+	out, err = get(nil, "/public")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Certificate from an untrusted CA fails the handshake
+	rogue := newTestCert(t, nil, "rogue-ca", nil, true)
+	out, _ = get(newTestCert(t, rogue, "billing-api", nil, false), "/admin")
+	assert.False(t, strings.HasPrefix(out, "HTTP/1.1 200"))
+}
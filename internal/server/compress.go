@@ -0,0 +1,23 @@
+package server
+
+import (
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+)
+
+// Compress wraps next so its responses are gzip or deflate encoded when the
+// client advertises support for it in Accept-Encoding.
+func Compress(next Handler) Handler {
+	return CompressWith(response.DefaultCompressOptions)(next)
+}
+
+// CompressWith is Compress with its size threshold, level and skipped
+// media types taken from opts.
+func CompressWith(opts response.CompressOptions) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writter, req *request.Request) {
+			w.EnableCompression(req.Headers.Get("Accept-Encoding"), opts)
+			next(w, req)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"github/Flarenzy/learn-http-protocol-golang/internal/http2"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"log"
+	"net"
+)
+
+// Config holds everything needed to build a Server. Only Handler is
+// required.
+type Config struct {
+	// Addr is the TCP address to listen on, ":42069" style. It is ignored
+	// when Listener is set.
+	Addr string
+	// Listener, if set, is served instead of listening on Addr.
+	Listener net.Listener
+	Handler  Handler
+
+	// MaxHeaderBytes caps the size of a request's line and headers.
+	// Zero means DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+	// MaxBodyBytes caps the size of a request body. Zero means no limit for
+	// HTTP/1.1 and http2.DefaultMaxBodyBytes for HTTP/2, whose bodies are
+	// always buffered.
+	MaxBodyBytes int
+	// StreamRequestBody, if set, picks the HTTP/1.1 requests whose body
+	// the handler reads from the connection with BodyReader, e.g. to
+	// forward it, instead of it being read into Body first.
+	StreamRequestBody func(*request.Request) bool
+
+	Timeouts Timeouts
+	Limits   Limits
+	// TLS, if set, makes the server speak HTTPS only.
+	TLS *TLSConfig
+	// HTTP2, if set, turns on HTTP/2: over TLS through ALPN, and over
+	// cleartext too when its H2C field is set.
+	HTTP2 *http2.Config
+
+	// Logger receives informational messages and ErrorLog receives
+	// errors. Both default to the standard logger.
+	Logger   *log.Logger
+	ErrorLog *log.Logger
+
+	// ConnState is called whenever a connection changes state.
+	ConnState func(net.Conn, ConnState)
+	PanicHook PanicHook
+}
+
+const DefaultMaxHeaderBytes = 1 << 20
+
+const defaultAddr = ":42069"
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerConfig(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var mu sync.Mutex
+	var states []ConnState
+	logs := &syncBuffer{}
+	s, err := New(Config{
+		Listener: listener,
+		Handler: func(w *response.Writter, req *request.Request) {
+			response.WriteText(w, response.StatusOk, nil, string(req.Body))
+		},
+		MaxHeaderBytes: 64,
+		MaxBodyBytes:   8,
+		Logger:         log.New(logs, "", 0),
+		ErrorLog:       log.New(logs, "", 0),
+		ConnState: func(conn net.Conn, state ConnState) {
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+		},
+	})
+	require.NoError(t, err)
+	serveErr := make(chan error)
+	go func() { serveErr <- s.ListenAndServe() }()
+	require.Eventually(t, func() bool { return s.Addr() != nil }, time.Second, time.Millisecond)
+	assert.Equal(t, listener.Addr(), s.Addr())
+
+	// Test: Request within limits
+	out := roundTrip(t, s, "POST / HTTP/1.1\r\nContent-Length: 4\r\nConnection: close\r\n\r\nbody")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "body"))
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(states) == 3
+	}, time.Second, time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateClosed}, states)
+	mu.Unlock()
+
+	// Test: Oversized headers get 431
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nX-Filler: "+strings.Repeat("a", 100)+"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 431 Request Header Fields Too Large\r\n"))
+
+	// Test: Oversized body gets 413
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n123456789")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+
+	// Test: Garbage gets 400
+	out = roundTrip(t, s, "NOT HTTP\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+
+	// Test: Logs went to the configured loggers
+	assert.Contains(t, logs.String(), "accepted conn")
+
+	// Test: Serve returns ErrServerClosed after Close
+	require.NoError(t, s.Close())
+	select {
+	case err := <-serveErr:
+		assert.True(t, errors.Is(err, ErrServerClosed))
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe didn't return")
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
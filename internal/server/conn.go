@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, used to unblock a pending Read.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader reads from a connection and, while a handler runs, keeps a
+// single background Read outstanding so a client hanging up is noticed
+// immediately. A byte picked up by that Read is handed to the next Read
+// call instead of being lost.
+type connReader struct {
+	conn net.Conn
+	// onRead is called after every Read that returned data.
+	onRead func()
+	// prefix holds bytes already taken from conn, served before it.
+	prefix []byte
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	inRead  bool
+	aborted bool
+	hasByte bool
+	byteBuf [1]byte
+}
+
+func newConnReader(conn net.Conn) *connReader {
+	cr := &connReader{conn: conn}
+	cr.cond = sync.NewCond(&cr.mu)
+	return cr
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	if cr.inRead {
+		cr.mu.Unlock()
+		return 0, errors.New("concurrent read on connection")
+	}
+	if len(p) == 0 {
+		cr.mu.Unlock()
+		return 0, nil
+	}
+	if cr.hasByte {
+		p[0] = cr.byteBuf[0]
+		cr.hasByte = false
+		cr.mu.Unlock()
+		cr.notifyRead(1)
+		return 1, nil
+	}
+	if len(cr.prefix) > 0 {
+		n := copy(p, cr.prefix)
+		cr.prefix = cr.prefix[n:]
+		cr.mu.Unlock()
+		cr.notifyRead(n)
+		return n, nil
+	}
+	cr.mu.Unlock()
+	n, err := cr.conn.Read(p)
+	cr.notifyRead(n)
+	return n, err
+}
+
+func (cr *connReader) notifyRead(n int) {
+	if n > 0 && cr.onRead != nil {
+		cr.onRead()
+	}
+}
+
+// startBackgroundRead starts watching the connection. onClose is called if
+// the peer goes away before abortPendingRead is called.
+func (cr *connReader) startBackgroundRead(onClose func()) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.inRead || cr.hasByte {
+		return
+	}
+	cr.inRead = true
+	go cr.backgroundRead(onClose)
+}
+
+func (cr *connReader) backgroundRead(onClose func()) {
+	n, err := cr.conn.Read(cr.byteBuf[:])
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if n == 1 {
+		cr.hasByte = true
+	}
+	if err != nil && !(cr.aborted && errors.Is(err, os.ErrDeadlineExceeded)) {
+		onClose()
+	}
+	cr.aborted = false
+	cr.inRead = false
+	cr.cond.Broadcast()
+}
+
+// abortPendingRead stops the background Read started by startBackgroundRead
+// and waits for it to return.
+func (cr *connReader) abortPendingRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.inRead {
+		return
+	}
+	cr.aborted = true
+	cr.conn.SetReadDeadline(aLongTimeAgo)
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.conn.SetReadDeadline(time.Time{})
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/http2"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+func (s *Server) h2c() bool {
+	return s.cfg.HTTP2 != nil && s.cfg.HTTP2.H2C
+}
+
+// serveHTTP2 hands conn over to the HTTP/2 implementation until the client
+// goes away. r, if set, replaces conn for reading because the caller has
+// already consumed bytes from it.
+func (s *Server) serveHTTP2(conn net.Conn, r io.Reader, tlsState *tls.ConnectionState, upgrade *request.Request, settings []byte) {
+	t := s.getTimeouts()
+	idleTimeout := t.Idle
+	if idleTimeout <= 0 {
+		idleTimeout = t.Read
+	}
+	conn.SetDeadline(time.Time{})
+	err := http2.ServeConn(conn, *s.cfg.HTTP2, http2.ServeConnOpts{
+		Handler: func(w *response.Writter, req *request.Request) {
+			req.RemoteAddr = conn.RemoteAddr().String()
+			s.serveStream(w, req)
+		},
+		Context:         s.ctx,
+		Reader:          r,
+		TLS:             tlsState,
+		Shutdown:        s.shutdownCh,
+		IdleTimeout:     idleTimeout,
+		WriteTimeout:    t.Write,
+		MaxBodyBytes:    s.cfg.MaxBodyBytes,
+		Upgrade:         upgrade,
+		UpgradeSettings: settings,
+		IdleChanged: func(idle bool) {
+			if idle {
+				s.setState(conn, StateIdle)
+			} else {
+				s.setState(conn, StateActive)
+			}
+		},
+		OnPanic: func(recovered any, stack []byte, req *request.Request) {
+			s.reportPanic(conn, req, recovered, stack)
+		},
+	})
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		s.metrics.idleTimeouts.Add(1)
+		s.logf("INFO: idle timeout on conn %s\n", conn.RemoteAddr())
+	case err != nil:
+		s.errorf("ERROR: HTTP/2 connection %s failed. %s\n", conn.RemoteAddr(), err.Error())
+	}
+}
+
+// serveStream runs the handler for an HTTP/2 request under the same
+// request limits as HTTP/1.1.
+func (s *Server) serveStream(w *response.Writter, req *request.Request) {
+	if !s.acquireRequest() {
+		s.shed(w)
+		return
+	}
+	defer s.releaseRequest()
+	s.handler(w, req)
+}
+
+// sniffPreface reads from conn for as long as what arrives could be the
+// HTTP/2 client preface, and reports whether all of it did. The bytes read
+// are returned either way.
+func sniffPreface(conn net.Conn) ([]byte, bool) {
+	buf := make([]byte, len(http2.ClientPreface))
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if string(buf[:n]) != http2.ClientPreface[:n] || err != nil {
+			// a read error shows up again for whoever reads next
+			return buf[:n], false
+		}
+	}
+	return buf, true
+}
+
+// h2cUpgrade reports whether req asks to switch to cleartext HTTP/2 and
+// returns the decoded settings it carries.
+func h2cUpgrade(req *request.Request) ([]byte, bool) {
+	if !headers.HasToken(req.Headers.Get("Upgrade"), "h2c") {
+		return nil, false
+	}
+	conn := req.Headers.Get("Connection")
+	if !headers.HasToken(conn, "upgrade") || !headers.HasToken(conn, "http2-settings") {
+		return nil, false
+	}
+	v := req.Headers.Get("HTTP2-Settings")
+	if strings.Contains(v, ",") {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+	if err != nil {
+		return nil, false
+	}
+	return settings, true
+}
+
+// upgradeH2C accepts an h2c upgrade and serves req as the first HTTP/2
+// stream.
+func (s *Server) upgradeH2C(conn net.Conn, r io.Reader, req *request.Request, settings []byte) {
+	w := response.NewWritter(conn)
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return
+	}
+	h := headers.NewHeaders()
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "h2c")
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	for _, k := range []string{"Connection", "Upgrade", "HTTP2-Settings"} {
+		req.Headers.Del(k)
+	}
+	s.serveHTTP2(conn, r, nil, req, settings)
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/hpack"
+	"github/Flarenzy/learn-http-protocol-golang/internal/http2"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newHTTP2Server(t *testing.T, tlsConfig *TLSConfig) *Server {
+	t.Helper()
+	router := NewRouter()
+	router.Get("/hello", func(w *response.Writter, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("X-Proto", req.RequestLine.HttpVersion)
+		response.WriteText(w, response.StatusOk, h, "hello "+req.Headers.Get("Host"))
+	})
+	router.Post("/echo", func(w *response.Writter, req *request.Request) {
+		response.WriteText(w, response.StatusOk, nil, string(req.Body))
+	})
+	router.Get("/big/{n}", func(w *response.Writter, req *request.Request) {
+		n, _ := strconv.Atoi(req.PathValue("n"))
+		response.WriteText(w, response.StatusOk, nil, strings.Repeat("x", n))
+	})
+	router.Get("/chunked", func(w *response.Writter, req *request.Request) {
+		w.WriteStatusLine(response.StatusOk)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Done")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("one,"))
+		w.WriteChunkedBody([]byte("two"))
+		w.WriteChunkedBodyDone()
+		t := headers.NewHeaders()
+		t.Set("X-Done", "yes")
+		w.WriteTrailers(t)
+	})
+	router.Get("/panic", func(w *response.Writter, req *request.Request) {
+		panic("boom")
+	})
+	router.Get("/wait", func(w *response.Writter, req *request.Request) {
+		<-req.Context().Done()
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := New(Config{
+		Listener:     listener,
+		Handler:      router.ServeRequest,
+		TLS:          tlsConfig,
+		HTTP2:        &http2.Config{H2C: tlsConfig == nil, MaxConcurrentStreams: 10},
+		MaxBodyBytes: 1 << 20,
+		Logger:       log.New(io.Discard, "", 0),
+		ErrorLog:     log.New(io.Discard, "", 0),
+	})
+	require.NoError(t, err)
+	go s.ListenAndServe()
+	t.Cleanup(func() { s.Close() })
+	require.Eventually(t, func() bool { return s.Addr() != nil }, time.Second, time.Millisecond)
+	return s
+}
+
+func checkHTTP2Client(t *testing.T, client *http.Client, base string) {
+	get := func(path string) (*http.Response, string) {
+		resp, err := client.Get(base + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	// Test: Requests reach the handler as HTTP/2 with the authority as Host
+	resp, body := get("/hello")
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-Proto"))
+	assert.True(t, strings.HasPrefix(body, "hello 127.0.0.1:"))
+
+	// Test: Request bodies are delivered
+	resp, err := client.Post(base+"/echo", "text/plain", strings.NewReader("ping"))
+	require.NoError(t, err)
+	echoed, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ping", string(echoed))
+
+	// Test: Bodies bigger than the initial window are flow controlled
+	resp, body = get("/big/200000")
+	assert.Equal(t, 200000, len(body))
+	assert.Equal(t, int64(200000), resp.ContentLength)
+
+	// Test: Chunked responses become DATA frames with trailers
+	resp, body = get("/chunked")
+	assert.Equal(t, "one,two", body)
+	assert.Equal(t, "yes", resp.Trailer.Get("X-Done"))
+	assert.Empty(t, resp.Header.Get("Transfer-Encoding"))
+
+	// Test: A panic before the response becomes a 500 on that stream only
+	resp, _ = get("/panic")
+	assert.Equal(t, 500, resp.StatusCode)
+	resp, _ = get("/hello")
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: Concurrent requests are multiplexed
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(base + "/big/50000")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			n, _ := io.Copy(io.Discard, resp.Body)
+			assert.Equal(t, int64(50000), n)
+		}()
+	}
+	wg.Wait()
+
+	// Test: Cancelling a request cancels the handler's context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", base+"/wait", nil)
+	_, err = client.Do(req)
+	assert.Error(t, err)
+}
+
+func TestHTTP2(t *testing.T) {
+	// Test: h2 is negotiated through ALPN
+	t.Run("TLS", func(t *testing.T) {
+		dir := t.TempDir()
+		cert := newTestCert(t, nil, "localhost", []string{"localhost"}, false).writeFiles(t, dir, "cert")
+		s := newHTTP2Server(t, &TLSConfig{Certificates: []CertFile{cert}})
+		transport := &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}
+		defer transport.CloseIdleConnections()
+		checkHTTP2Client(t, &http.Client{Transport: transport}, "https://"+s.Addr().String())
+
+		// Test: Clients without h2 still get HTTP/1.1
+		conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+	})
+
+	// Test: Cleartext HTTP/2 with prior knowledge
+	t.Run("H2C", func(t *testing.T) {
+		s := newHTTP2Server(t, nil)
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		transport := &http.Transport{Protocols: protocols}
+		defer transport.CloseIdleConnections()
+		checkHTTP2Client(t, &http.Client{Transport: transport}, "http://"+s.Addr().String())
+
+		// Test: HTTP/1.1 keeps working on the same port
+		resp := roundTrip(t, s, "GET /hello HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+		assert.True(t, strings.HasSuffix(resp, "hello localhost"))
+	})
+
+	// Test: Upgrade: h2c answers the upgrading request on stream 1
+	t.Run("Upgrade", func(t *testing.T) {
+		s := newHTTP2Server(t, nil)
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte("GET /hello HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n"))
+		require.NoError(t, err)
+		br := newFrameConn(conn)
+		status := br.readLine(t)
+		assert.Equal(t, "HTTP/1.1 101 Switching Protocols", status)
+		for br.readLine(t) != "" {
+		}
+		_, err = conn.Write(append([]byte(http2.ClientPreface), http2.AppendFrame(nil, http2.FrameSettings, 0, 0, nil)...))
+		require.NoError(t, err)
+
+		dec := hpack.NewDecoder(hpack.DefaultTableSize)
+		var fields []hpack.HeaderField
+		var body []byte
+		for {
+			f, err := http2.ReadFrame(br, &br.buf, 1<<24)
+			require.NoError(t, err)
+			if f.StreamID != 1 {
+				continue
+			}
+			switch f.Type {
+			case http2.FrameHeaders:
+				fields, err = dec.Decode(f.Payload)
+				require.NoError(t, err)
+			case http2.FrameData:
+				body = append(body, f.Payload...)
+			}
+			if f.Has(http2.FlagEndStream) {
+				break
+			}
+		}
+		assert.Equal(t, hpack.HeaderField{Name: ":status", Value: "200"}, fields[0])
+		assert.Equal(t, "hello localhost", string(body))
+	})
+}
+
+// frameConn reads the HTTP/1.1 response to an upgrade and then frames
+// from the same buffer.
+type frameConn struct {
+	net.Conn
+	pending []byte
+	buf     []byte
+}
+
+func newFrameConn(conn net.Conn) *frameConn {
+	return &frameConn{Conn: conn}
+}
+
+func (c *frameConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *frameConn) readLine(t *testing.T) string {
+	for {
+		if i := bytes.Index(c.pending, []byte("\r\n")); i >= 0 {
+			line := string(c.pending[:i])
+			c.pending = c.pending[i+2:]
+			return line
+		}
+		buf := make([]byte, 1024)
+		n, err := c.Conn.Read(buf)
+		require.NoError(t, err)
+		c.pending = append(c.pending, buf[:n]...)
+	}
+}
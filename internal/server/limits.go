@@ -0,0 +1,112 @@
+package server
+
+import (
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Limits bounds how much work the server takes on at once. A zero value
+// means unlimited.
+type Limits struct {
+	// MaxConns is the maximum number of open client connections.
+	MaxConns int
+	// MaxActiveRequests is the maximum number of requests being handled
+	// at the same time, across all connections.
+	MaxActiveRequests int
+	// QueueTimeout is how long a connection or request waits for a free
+	// slot before it is shed. Zero sheds immediately.
+	QueueTimeout time.Duration
+	// RetryAfter is advertised to shed clients. Zero means one second.
+	RetryAfter time.Duration
+}
+
+// semaphore is a counting semaphore, nil meaning unlimited.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire takes a slot, waiting at most timeout for one to free up. The
+// second result reports whether it had to wait.
+func (sem semaphore) acquire(timeout time.Duration) (ok bool, waited bool) {
+	if sem == nil {
+		return true, false
+	}
+	select {
+	case sem <- struct{}{}:
+		return true, false
+	default:
+	}
+	if timeout <= 0 {
+		return false, false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return true, true
+	case <-timer.C:
+		return false, true
+	}
+}
+
+func (sem semaphore) release() {
+	if sem != nil {
+		<-sem
+	}
+}
+
+func (s *Server) retryAfter() string {
+	d := s.cfg.Limits.RetryAfter
+	if d <= 0 {
+		d = time.Second
+	}
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
+
+// acquireRequest reserves an active request slot, queueing for up to
+// QueueTimeout.
+func (s *Server) acquireRequest() bool {
+	s.metrics.queuedRequests.Add(1)
+	ok, _ := s.requestSem.acquire(s.cfg.Limits.QueueTimeout)
+	s.metrics.queuedRequests.Add(-1)
+	if !ok {
+		s.metrics.shedRequests.Add(1)
+		return false
+	}
+	s.metrics.activeRequests.Add(1)
+	return true
+}
+
+func (s *Server) releaseRequest() {
+	s.metrics.activeRequests.Add(-1)
+	s.requestSem.release()
+}
+
+// shed answers w with 503 and a Retry-After hint.
+func (s *Server) shed(w *response.Writter) {
+	h := headers.NewHeaders()
+	h.Set("Retry-After", s.retryAfter())
+	err := response.WriteText(w, response.StatusServiceUnavailable, h, "Service Unavailable\n")
+	if err != nil {
+		s.errorf("ERROR: unable to write 503. %s\n", err.Error())
+	}
+}
+
+// shedConn turns away a connection accepted over MaxConns.
+func (s *Server) shedConn(conn net.Conn) {
+	s.metrics.shedConns.Add(1)
+	s.logf("INFO: too many connections, shedding %s\n", conn.RemoteAddr())
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	w := response.NewWritter(conn)
+	w.CloseConnection()
+	s.shed(w)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits(t *testing.T) {
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := New(Config{
+		Listener: listener,
+		Handler: func(w *response.Writter, req *request.Request) {
+			if req.Path() == "/block" {
+				started <- struct{}{}
+				<-release
+			}
+			response.WriteText(w, response.StatusOk, nil, "ok")
+		},
+		Limits: Limits{
+			MaxConns:          2,
+			MaxActiveRequests: 1,
+			QueueTimeout:      50 * time.Millisecond,
+			RetryAfter:        3 * time.Second,
+		},
+		Logger:   log.New(io.Discard, "", 0),
+		ErrorLog: log.New(io.Discard, "", 0),
+	})
+	require.NoError(t, err)
+	go s.ListenAndServe()
+	defer s.Close()
+	require.Eventually(t, func() bool { return s.Addr() != nil }, time.Second, time.Millisecond)
+
+	// one request occupies the only active request slot
+	blocked := make(chan string)
+	go func() {
+		blocked <- roundTrip(t, s, "GET /block HTTP/1.1\r\nConnection: close\r\n\r\n")
+	}()
+	<-started
+	m := s.Metrics()
+	assert.Equal(t, int64(1), m.ActiveRequests)
+	assert.Equal(t, 1, m.MaxActiveRequests)
+
+	// Test: A second request queues, then is shed with 503 and Retry-After
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n"))
+	assert.Contains(t, out, "Retry-After: 3\r\n")
+	assert.Equal(t, uint64(1), s.Metrics().ShedRequests)
+
+	// Test: Connections over MaxConns are shed
+	held, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer held.Close()
+	require.Eventually(t, func() bool { return s.Metrics().ActiveConns == 2 }, time.Second, time.Millisecond)
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n"))
+	assert.Equal(t, uint64(1), s.Metrics().ShedConns)
+
+	// Test: Queued work proceeds once capacity frees up
+	held.Close()
+	close(release)
+	assert.Contains(t, <-blocked, "HTTP/1.1 200 OK\r\n")
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+}
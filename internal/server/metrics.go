@@ -0,0 +1,54 @@
+package server
+
+import "sync/atomic"
+
+// Metrics is a snapshot of the server's counters and gauges.
+type Metrics struct {
+	ReadTimeouts  uint64
+	WriteTimeouts uint64
+	IdleTimeouts  uint64
+	// AcceptRetries counts temporary Accept errors that were retried.
+	AcceptRetries uint64
+
+	// ActiveConns, ActiveRequests and QueuedRequests are current values;
+	// MaxConns and MaxActiveRequests are the configured limits (0 when
+	// unlimited) to compare them against.
+	ActiveConns       int64
+	MaxConns          int
+	ActiveRequests    int64
+	MaxActiveRequests int
+	QueuedRequests    int64
+	// ShedConns and ShedRequests count clients turned away with a 503.
+	ShedConns    uint64
+	ShedRequests uint64
+}
+
+type serverMetrics struct {
+	readTimeouts  atomic.Uint64
+	writeTimeouts atomic.Uint64
+	idleTimeouts  atomic.Uint64
+	acceptRetries atomic.Uint64
+
+	activeConns    atomic.Int64
+	activeRequests atomic.Int64
+	queuedRequests atomic.Int64
+	shedConns      atomic.Uint64
+	shedRequests   atomic.Uint64
+}
+
+func (s *Server) Metrics() Metrics {
+	return Metrics{
+		ReadTimeouts:  s.metrics.readTimeouts.Load(),
+		WriteTimeouts: s.metrics.writeTimeouts.Load(),
+		IdleTimeouts:  s.metrics.idleTimeouts.Load(),
+		AcceptRetries: s.metrics.acceptRetries.Load(),
+
+		ActiveConns:       s.metrics.activeConns.Load(),
+		MaxConns:          s.cfg.Limits.MaxConns,
+		ActiveRequests:    s.metrics.activeRequests.Load(),
+		MaxActiveRequests: s.cfg.Limits.MaxActiveRequests,
+		QueuedRequests:    s.metrics.queuedRequests.Load(),
+		ShedConns:         s.metrics.shedConns.Load(),
+		ShedRequests:      s.metrics.shedRequests.Load(),
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"log"
+	"slices"
+	"time"
+)
+
+// Middleware wraps a Handler with behaviour that runs before and/or after
+// it. A middleware short-circuits by writing a response itself and not
+// calling next.
+type Middleware func(next Handler) Handler
+
+// Chain composes mws into one Middleware. The first middleware is the
+// outermost, so it sees the request first and the response last.
+func Chain(mws ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](next)
+		}
+		return next
+	}
+}
+
+// Logger logs the request line, final status, body bytes and duration of
+// every request.
+func Logger(next Handler) Handler {
+	return func(w *response.Writter, req *request.Request) {
+		start := time.Now()
+		next(w, req)
+		log.Printf("INFO: %s %s -> %d, %d bytes in %s\n",
+			req.RequestLine.Method,
+			req.RequestLine.RequestTarget,
+			w.StatusCode(),
+			w.BytesWritten(),
+			time.Since(start),
+		)
+	}
+}
+
+// Timeout gives each request a context that expires after d. Handlers doing
+// slow work should watch req.Context() and give up once it is done.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writter, req *request.Request) {
+			ctx, cancel := context.WithTimeout(req.Context(), d)
+			defer cancel()
+			next(w, req.WithContext(ctx))
+		}
+	}
+}
+
+type requestIDKey struct{}
+
+// RequestID stores an ID for the request in its context, reusing the
+// client's X-Request-Id when one was sent.
+func RequestID(next Handler) Handler {
+	return func(w *response.Writter, req *request.Request) {
+		id := req.Headers.Get("X-Request-Id")
+		if id == "" {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		ctx := context.WithValue(req.Context(), requestIDKey{}, id)
+		next(w, req.WithContext(ctx))
+	}
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// WantDigest adds digest fields to responses when the client
+// asks for them with Want-Content-Digest or Want-Repr-Digest (RFC 9530),
+// using its most preferred algorithm we support.
+func WantDigest(next Handler) Handler {
+	return func(w *response.Writter, req *request.Request) {
+		var opts response.DigestOptions
+		for _, f := range []struct{ want, field string }{
+			{"Want-Content-Digest", response.ContentDigest},
+			{"Want-Repr-Digest", response.ReprDigest},
+		} {
+			algs := response.ParseWantDigest(req.Headers.Get(f.want))
+			if len(algs) == 0 {
+				continue
+			}
+			opts.Fields = append(opts.Fields, f.field)
+			if !slices.Contains(opts.Algorithms, algs[0]) {
+				opts.Algorithms = append(opts.Algorithms, algs[0])
+			}
+		}
+		if len(opts.Fields) > 0 {
+			if err := w.EnableDigests(opts); err != nil {
+				log.Printf("ERROR: unable to enable digests. %s\n", err.Error())
+			}
+		}
+		next(w, req)
+	}
+}
+
+// Conditional answers GET and HEAD requests with 304 Not Modified or 412
+// Precondition Failed when their If-* fields don't hold for the ETag and
+// Last-Modified the handler responds with.
+func Conditional(next Handler) Handler {
+	return func(w *response.Writter, req *request.Request) {
+		w.EnablePreconditions(req.RequestLine.Method, req.Headers)
+		next(w, req)
+	}
+}
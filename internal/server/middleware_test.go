@@ -0,0 +1,169 @@
+package server
+
+import (
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddlewareChain(t *testing.T) {
+	var trace []string
+	tag := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writter, req *request.Request) {
+				trace = append(trace, name+">")
+				next(w, req)
+				trace = append(trace, "<"+name)
+			}
+		}
+	}
+	final := func(w *response.Writter, req *request.Request) {
+		trace = append(trace, "handler")
+		response.WriteText(w, response.StatusOk, nil, "hello")
+	}
+
+	// Test: Chain runs the first middleware outermost
+	serve(t, Chain(tag("a"), tag("b"))(final), "GET", "/")
+	assert.Equal(t, []string{"a>", "b>", "handler", "<b", "<a"}, trace)
+
+	// Test: Short-circuit and inspect the result
+	var status response.StatusCode
+	var written int
+	inspect := func(next Handler) Handler {
+		return func(w *response.Writter, req *request.Request) {
+			next(w, req)
+			status = w.StatusCode()
+			written = w.BytesWritten()
+		}
+	}
+	deny := func(next Handler) Handler {
+		return func(w *response.Writter, req *request.Request) {
+			if req.Headers.Get("Authorization") == "" {
+				response.WriteText(w, response.StatusBadRequest, nil, "no auth\n")
+				return
+			}
+			next(w, req)
+		}
+	}
+	trace = nil
+	out := serve(t, Chain(inspect, deny)(final), "GET", "/")
+	assert.Empty(t, trace)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Equal(t, response.StatusBadRequest, status)
+	assert.Equal(t, len("no auth\n"), written)
+
+	// Test: Router applies global, group and route middleware in order
+	trace = nil
+	rt := NewRouter()
+	rt.Use(tag("global"))
+	api := rt.Group("/api")
+	api.Use(tag("group"))
+	api.With(tag("route")).Get("/x", final)
+	rt.Get("/y", final)
+	serve(t, rt.ServeRequest, "GET", "/api/x")
+	assert.Equal(t, []string{"global>", "group>", "route>", "handler", "<route", "<group", "<global"}, trace)
+
+	trace = nil
+	serve(t, rt.ServeRequest, "GET", "/y")
+	assert.Equal(t, []string{"global>", "handler", "<global"}, trace)
+}
+
+func TestWantDigest(t *testing.T) {
+	s, err := Serve(0, WantDigest(func(w *response.Writter, req *request.Request) {
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(map[string]string{"Transfer-Encoding": "chunked"})
+		w.WriteChunkedBody(req.Body)
+		w.WriteChunkedBodyDone()
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: the preferred algorithm is sent as a trailer
+	out := roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"+
+		"Want-Content-Digest: sha-256=1, sha-512=5\r\nContent-Length: 5\r\n\r\nhello")
+	assert.Contains(t, out, "Trailer: Content-Digest\r\n")
+	assert.Contains(t, out, "Content-Digest: sha-512=:m3HSJL1i83hdltRq0+o9czGb+8KJDKra4t/3JRlnPKcjI8PZm6XBHXx6zG4UuMXaDEZjR1wuXDre9G9zvN7AQw==:\r\n")
+
+	// Test: fixed length responses carry the digest in their header block
+	fixed, err := Serve(0, WantDigest(func(w *response.Writter, req *request.Request) {
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(response.GetDefaultHeaders(len(req.Body)))
+		w.WriteBody(req.Body)
+	}))
+	require.NoError(t, err)
+	defer fixed.Close()
+	out = roundTrip(t, fixed, "POST / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"+
+		"Want-Content-Digest: sha-256=1\r\nContent-Length: 5\r\n\r\nhello")
+	assert.Contains(t, out, "Content-Digest: sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:\r\n")
+	assert.NotContains(t, out, "Trailer")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello"), out)
+
+	// Test: requests whose body doesn't match Content-Digest get a 400
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\n"+
+		"Content-Digest: sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:\r\nContent-Length: 5\r\n\r\nhellO")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"+
+		"Content-Digest: sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:\r\nContent-Length: 5\r\n\r\nhello")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+}
+
+func TestConditional(t *testing.T) {
+	s, err := Serve(0, Conditional(func(w *response.Writter, req *request.Request) {
+		body := "hello"
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("ETag", `"v1"`)
+		h.Set("Last-Modified", "Wed, 01 May 2024 12:00:00 GMT")
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: a fresh cached copy gets 304 without a body
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nIf-None-Match: \"v1\"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"), out)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"), out)
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nIf-Modified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"), out)
+
+	// Test: If-Unmodified-Since in the past fails
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nIf-Unmodified-Since: Tue, 30 Apr 2024 12:00:00 GMT\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 412 Precondition Failed\r\n"), out)
+
+	// Test: a stale copy gets the full response
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nIf-None-Match: \"v0\"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+	assert.True(t, strings.HasSuffix(out, "hello"), out)
+}
+
+func TestCompressWith(t *testing.T) {
+	body := strings.Repeat("a", 100)
+	opts := response.DefaultCompressOptions
+	opts.MinSize = 10
+	s, err := Serve(0, CompressWith(opts)(func(w *response.Writter, req *request.Request) {
+		response.WriteText(w, response.StatusOk, nil, body)
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+	req := "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nAccept-Encoding: gzip\r\n\r\n"
+
+	// Test: bodies over the configured MinSize are compressed
+	out := roundTrip(t, s, req)
+	assert.Contains(t, out, "Content-Encoding: gzip\r\n")
+	assert.NotContains(t, out, body)
+
+	// Test: Compress keeps the default threshold
+	plain, err := Serve(0, Compress(func(w *response.Writter, req *request.Request) {
+		response.WriteText(w, response.StatusOk, nil, body)
+	}))
+	require.NoError(t, err)
+	defer plain.Close()
+	out = roundTrip(t, plain, req)
+	assert.NotContains(t, out, "Content-Encoding")
+	assert.True(t, strings.HasSuffix(out, body), out)
+}
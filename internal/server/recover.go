@@ -0,0 +1,56 @@
+package server
+
+import (
+	"crypto/tls"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"net"
+	"runtime/debug"
+)
+
+// PanicHook is told about every panic recovered from a handler, e.g. to
+// forward it to an error tracker. req is nil if the panic happened before
+// the request was parsed.
+type PanicHook func(recovered any, stack []byte, req *request.Request)
+
+// SetPanicHook installs fn to be called for recovered panics. It may be
+// called while the server is running.
+func (s *Server) SetPanicHook(fn PanicHook) {
+	s.panicHook.Store(&fn)
+}
+
+// recoverPanic turns a handler panic into a 500 when nothing has been sent
+// yet. Otherwise the response is already partially on the wire, so the
+// only honest thing left is to abort the connection.
+func (s *Server) recoverPanic(conn net.Conn, w *response.Writter, req *request.Request, recovered any) {
+	s.reportPanic(conn, req, recovered, debug.Stack())
+	if w != nil && w.StatusCode() == 0 {
+		err := response.WriteText(w, response.StatusInternalServerError, nil, "Internal Server Error\n")
+		if err == nil {
+			return
+		}
+		s.errorf("ERROR: unable to write 500 after panic. %s\n", err.Error())
+	}
+	raw := conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		raw = tlsConn.NetConn()
+	}
+	if tcp, ok := raw.(*net.TCPConn); ok {
+		// reset instead of a clean FIN so the client can't mistake a
+		// truncated response for a complete one
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// reportPanic logs a recovered panic and passes it to the panic hook.
+func (s *Server) reportPanic(conn net.Conn, req *request.Request, recovered any, stack []byte) {
+	requestLine := "<unparsed request>"
+	if req != nil {
+		requestLine = req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " HTTP/" + req.RequestLine.HttpVersion
+	}
+	s.errorf("ERROR: panic serving %s for %q: %v\n%s", conn.RemoteAddr(), requestLine, recovered, stack)
+	if hook := s.panicHook.Load(); hook != nil && *hook != nil {
+		(*hook)(recovered, stack, req)
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Router dispatches requests by path and method. Patterns are made of
+// static segments, {name} segments that capture a single segment and an
+// optional trailing {name...} segment that captures the rest of the path.
+// Captured values are available through req.PathValue.
+type Router struct {
+	root        *node
+	prefix      string
+	middlewares []Middleware
+
+	// NotFound is called when no route matches the path.
+	NotFound Handler
+}
+
+type node struct {
+	static   map[string]*node
+	param    *node
+	wildcard *node
+	// name is the capture name for param and wildcard nodes.
+	name     string
+	handlers map[string]Handler
+}
+
+func NewRouter() *Router {
+	return &Router{
+		root:     newNode(),
+		NotFound: notFound,
+	}
+}
+
+func newNode() *node {
+	return &node{
+		static:   make(map[string]*node),
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Group returns a router that registers its routes under prefix in the same
+// routing tree as r.
+func (rt *Router) Group(prefix string) *Router {
+	g := *rt
+	g.prefix = joinPath(rt.prefix, prefix)
+	g.middlewares = slices.Clone(rt.middlewares)
+	return &g
+}
+
+// Use adds middleware to every route registered through rt or its groups
+// from now on. Middleware that has to see unmatched requests as well should
+// wrap ServeRequest instead.
+func (rt *Router) Use(mws ...Middleware) {
+	rt.middlewares = append(rt.middlewares, mws...)
+}
+
+// With returns a copy of rt whose routes are additionally wrapped in mws,
+// for applying middleware to individual routes.
+func (rt *Router) With(mws ...Middleware) *Router {
+	g := *rt
+	g.middlewares = append(slices.Clone(rt.middlewares), mws...)
+	return &g
+}
+
+func (rt *Router) Get(pattern string, h Handler)    { rt.Handle("GET", pattern, h) }
+func (rt *Router) Post(pattern string, h Handler)   { rt.Handle("POST", pattern, h) }
+func (rt *Router) Put(pattern string, h Handler)    { rt.Handle("PUT", pattern, h) }
+func (rt *Router) Patch(pattern string, h Handler)  { rt.Handle("PATCH", pattern, h) }
+func (rt *Router) Delete(pattern string, h Handler) { rt.Handle("DELETE", pattern, h) }
+
+// Handle registers h for method and pattern. It panics on malformed or
+// conflicting patterns since those are programming errors.
+func (rt *Router) Handle(method, pattern string, h Handler) {
+	if h == nil {
+		panic("router: nil handler")
+	}
+	full := joinPath(rt.prefix, pattern)
+	segments := splitPath(full)
+	n := rt.root
+	for i, seg := range segments {
+		name, isParam, isWildcard, err := parseSegment(seg)
+		if err != nil {
+			panic(fmt.Sprintf("router: pattern %q: %s", full, err.Error()))
+		}
+		switch {
+		case isWildcard:
+			if i != len(segments)-1 {
+				panic(fmt.Sprintf("router: pattern %q: wildcard must be the last segment", full))
+			}
+			if n.wildcard == nil {
+				n.wildcard = newNode()
+				n.wildcard.name = name
+			} else if n.wildcard.name != name {
+				panic(fmt.Sprintf("router: pattern %q: conflicting wildcard name %q", full, n.wildcard.name))
+			}
+			n = n.wildcard
+		case isParam:
+			if n.param == nil {
+				n.param = newNode()
+				n.param.name = name
+			} else if n.param.name != name {
+				panic(fmt.Sprintf("router: pattern %q: conflicting parameter name %q", full, n.param.name))
+			}
+			n = n.param
+		default:
+			child, ok := n.static[seg]
+			if !ok {
+				child = newNode()
+				n.static[seg] = child
+			}
+			n = child
+		}
+	}
+	if _, ok := n.handlers[method]; ok {
+		panic(fmt.Sprintf("router: %s %s registered twice", method, full))
+	}
+	n.handlers[method] = Chain(rt.middlewares...)(h)
+}
+
+// ServeRequest is the router's Handler.
+func (rt *Router) ServeRequest(w *response.Writter, req *request.Request) {
+	params := make(map[string]string)
+	n := rt.root.match(splitPath(req.Path()), params)
+	if n == nil {
+		rt.NotFound(w, req)
+		return
+	}
+	req.PathParams = params
+	method := req.RequestLine.Method
+	if h, ok := n.handlers[method]; ok {
+		h(w, req)
+		return
+	}
+	if h, ok := n.handlers["GET"]; ok && method == "HEAD" {
+		h(w, req)
+		return
+	}
+	allow := n.allowed()
+	if method == "OPTIONS" {
+		h := headers.NewHeaders()
+		h.Set("Allow", allow)
+		if err := response.WriteText(w, response.StatusNoContent, h, ""); err != nil {
+			log.Printf("ERROR: unable to write OPTIONS response. %s\n", err.Error())
+		}
+		return
+	}
+	h := headers.NewHeaders()
+	h.Set("Allow", allow)
+	if err := response.WriteText(w, response.StatusMethodNotAllowed, h, "Method Not Allowed\n"); err != nil {
+		log.Printf("ERROR: unable to write 405 response. %s\n", err.Error())
+	}
+}
+
+func (n *node) match(segments []string, params map[string]string) *node {
+	if len(segments) == 0 {
+		if len(n.handlers) > 0 {
+			return n
+		}
+		// a trailing wildcard also matches an empty remainder
+		if n.wildcard != nil {
+			params[n.wildcard.name] = ""
+			return n.wildcard
+		}
+		return nil
+	}
+	seg := segments[0]
+	if child, ok := n.static[seg]; ok {
+		if m := child.match(segments[1:], params); m != nil {
+			return m
+		}
+	}
+	if n.param != nil && seg != "" {
+		if m := n.param.match(segments[1:], params); m != nil {
+			params[n.param.name] = seg
+			return m
+		}
+	}
+	if n.wildcard != nil {
+		params[n.wildcard.name] = strings.Join(segments, "/")
+		return n.wildcard
+	}
+	return nil
+}
+
+func (n *node) allowed() string {
+	methods := make([]string, 0, len(n.handlers)+2)
+	for m := range n.handlers {
+		methods = append(methods, m)
+	}
+	if _, ok := n.handlers["GET"]; ok && !slices.Contains(methods, "HEAD") {
+		methods = append(methods, "HEAD")
+	}
+	if !slices.Contains(methods, "OPTIONS") {
+		methods = append(methods, "OPTIONS")
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+func parseSegment(seg string) (name string, isParam, isWildcard bool, err error) {
+	if !strings.HasPrefix(seg, "{") {
+		if strings.ContainsAny(seg, "{}") {
+			return "", false, false, fmt.Errorf("braces must enclose a whole segment")
+		}
+		return "", false, false, nil
+	}
+	if !strings.HasSuffix(seg, "}") {
+		return "", false, false, fmt.Errorf("unterminated parameter %q", seg)
+	}
+	name = seg[1 : len(seg)-1]
+	if strings.HasSuffix(name, "...") {
+		name = strings.TrimSuffix(name, "...")
+		isWildcard = true
+	} else {
+		isParam = true
+	}
+	if name == "" {
+		return "", false, false, fmt.Errorf("empty parameter name")
+	}
+	return name, isParam, isWildcard, nil
+}
+
+func splitPath(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func joinPath(prefix, pattern string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(pattern, "/") {
+		pattern = "/" + pattern
+	}
+	return prefix + pattern
+}
+
+func notFound(w *response.Writter, req *request.Request) {
+	if err := response.WriteText(w, response.StatusNotFound, headers.NewHeaders(), "Not Found\n"); err != nil {
+		log.Printf("ERROR: unable to write 404 response. %s\n", err.Error())
+	}
+}
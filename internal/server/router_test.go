@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	var got string
+	var params map[string]string
+	record := func(name string) Handler {
+		return func(w *response.Writter, req *request.Request) {
+			got = name
+			params = req.PathParams
+			response.WriteText(w, response.StatusOk, nil, name)
+		}
+	}
+	rt := NewRouter()
+	rt.Get("/", record("root"))
+	rt.Get("/users/{id}", record("user"))
+	rt.Delete("/users/{id}", record("delete-user"))
+	rt.Get("/users/me", record("me"))
+	rt.Get("/static/{path...}", record("static"))
+	api := rt.Group("/api")
+	v1 := api.Group("v1")
+	v1.Post("/items/{id}/tags/{tag}", record("tag"))
+
+	// Test: Static root
+	out := serve(t, rt.ServeRequest, "GET", "/")
+	assert.Equal(t, "root", got)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Static segment beats parameter
+	serve(t, rt.ServeRequest, "GET", "/users/me")
+	assert.Equal(t, "me", got)
+
+	// Test: Parameter capture ignores the query string
+	serve(t, rt.ServeRequest, "GET", "/users/42?verbose=1")
+	assert.Equal(t, "user", got)
+	assert.Equal(t, "42", params["id"])
+
+	// Test: Trailing wildcard
+	serve(t, rt.ServeRequest, "GET", "/static/css/site.css")
+	assert.Equal(t, "static", got)
+	assert.Equal(t, "css/site.css", params["path"])
+
+	// Test: Nested groups
+	serve(t, rt.ServeRequest, "POST", "/api/v1/items/7/tags/red")
+	assert.Equal(t, "tag", got)
+	assert.Equal(t, map[string]string{"id": "7", "tag": "red"}, params)
+
+	// Test: HEAD falls back to GET
+	got = ""
+	serve(t, rt.ServeRequest, "HEAD", "/users/1")
+	assert.Equal(t, "user", got)
+
+	// Test: Unknown method gets 405 with Allow
+	got = ""
+	out = serve(t, rt.ServeRequest, "PUT", "/users/1")
+	assert.Equal(t, "", got)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "Allow: DELETE, GET, HEAD, OPTIONS\r\n")
+
+	// Test: Automatic OPTIONS
+	out = serve(t, rt.ServeRequest, "OPTIONS", "/api/v1/items/1/tags/x")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 204 No Content\r\n"))
+	assert.Contains(t, out, "Allow: OPTIONS, POST\r\n")
+
+	// Test: No match
+	out = serve(t, rt.ServeRequest, "GET", "/nope")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Conflicting parameter names panic
+	assert.Panics(t, func() { rt.Get("/users/{name}/posts", record("x")) })
+	assert.Panics(t, func() { rt.Get("/users/{id}", record("x")) })
+	assert.Panics(t, func() { rt.Get("/files/{rest...}/more", record("x")) })
+}
+
+func serve(t *testing.T, h Handler, method, target string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	conn := &bufConn{}
+	h(response.NewWritter(conn), req)
+	return conn.buf.String()
+}
+
+type bufConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
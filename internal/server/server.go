@@ -1,28 +1,52 @@
 package server
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/http2"
 	"github/Flarenzy/learn-http-protocol-golang/internal/request"
 	"github/Flarenzy/learn-http-protocol-golang/internal/response"
 	"io"
 	"log"
 	"net"
-	"net/http"
 	"os"
-	"strconv"
-	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	port     int
+	cfg      Config
 	handler  Handler
-	listener *net.TCPListener
+	listener net.Listener
 	running  *atomic.Bool
+	// ctx is the parent of every request context and is cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	panicHook atomic.Pointer[PanicHook]
+
+	inShutdown atomic.Bool
+	// shutdownCh is closed when shutdown starts, for connections that
+	// have to tell their client, like HTTP/2's GOAWAY.
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+	mu           sync.Mutex
+	conns        map[net.Conn]ConnState
+	onShutdown   []func()
+
+	timeouts atomic.Pointer[Timeouts]
+	metrics  serverMetrics
+
+	connSem    semaphore
+	requestSem semaphore
+
+	tlsConfig *tls.Config
+	certs     *certStore
 }
 
 type HandlerError struct {
@@ -32,193 +56,376 @@ type HandlerError struct {
 
 type Handler func(w *response.Writter, req *request.Request)
 
-func newServer(port int, handler Handler, listener *net.TCPListener) *Server {
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or
+// Close.
+var ErrServerClosed = errors.New("server closed")
+
+// New builds a Server from cfg. It fails only if the TLS certificates can't
+// be loaded.
+func New(cfg Config) (*Server, error) {
 	r := atomic.Bool{}
-	r.Store(true)
-	return &Server{
-		port:     port,
-		handler:  handler,
-		listener: listener,
-		running:  &r,
+	ctx, cancel := context.WithCancel(context.Background())
+	if cfg.MaxHeaderBytes == 0 {
+		cfg.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	if cfg.ErrorLog == nil {
+		cfg.ErrorLog = log.Default()
+	}
+	s := &Server{
+		cfg:     cfg,
+		handler: cfg.Handler,
+		running: &r,
+		ctx:     ctx,
+		cancel:  cancel,
+		conns:   make(map[net.Conn]ConnState),
+
+		shutdownCh: make(chan struct{}),
+
+		connSem:    newSemaphore(cfg.Limits.MaxConns),
+		requestSem: newSemaphore(cfg.Limits.MaxActiveRequests),
+	}
+	s.SetTimeouts(cfg.Timeouts)
+	if cfg.PanicHook != nil {
+		s.SetPanicHook(cfg.PanicHook)
+	}
+	if cfg.TLS != nil {
+		tlsConfig, err := s.buildTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		s.tlsConfig = tlsConfig
 	}
+	return s, nil
 }
 
+// Serve listens on port on all interfaces and serves handler in the
+// background. It is a shorthand for New and Serve for the simple case.
 func Serve(port int, handler Handler) (*Server, error) {
-	addr := fmt.Sprintf(":%d", port)
-	listener, err := net.Listen("tcp", addr)
+	if handler == nil {
+		return nil, fmt.Errorf("error: need handler func")
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
-	tcpListener, ok := listener.(*net.TCPListener)
-	if !ok {
-		return nil, fmt.Errorf("internal error unable to make TCPListener")
+	s, err := New(Config{Handler: handler})
+	if err != nil {
+		listener.Close()
+		return nil, err
 	}
-	if handler == nil {
-		return nil, fmt.Errorf("error: need handler func")
+	if err := s.setListener(listener); err != nil {
+		listener.Close()
+		return nil, err
 	}
-	s := newServer(
-		port,
-		handler,
-		tcpListener,
-	)
-	go s.listen()
+	go func() {
+		defer listener.Close()
+		err := s.listen(listener)
+		if err != nil && !errors.Is(err, ErrServerClosed) {
+			s.errorf("ERROR: server on port %d stopped. %s\n", port, err.Error())
+		}
+	}()
 	return s, nil
 }
 
-func (s *Server) Close() error {
-	if s.listener == nil {
-		s.running.Store(false)
-		return nil
+// ListenAndServe listens on the configured Listener or Addr and serves
+// connections until the server is shut down.
+func (s *Server) ListenAndServe() error {
+	if s.cfg.Listener != nil {
+		return s.Serve(s.cfg.Listener)
 	}
-	s.running.Store(false)
-	err := s.listener.Close()
+	addr := s.cfg.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on l until the server is shut down, then
+// returns ErrServerClosed. l is closed on return.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+		if s.cfg.TLS.WatchInterval > 0 {
+			go s.watchCertificates(s.ctx, s.cfg.TLS.WatchInterval)
+		}
+	}
+	if err := s.setListener(l); err != nil {
+		return err
+	}
+	return s.listen(l)
+}
+
+func (s *Server) setListener(l net.Listener) error {
+	if s.handler == nil {
+		return fmt.Errorf("error: need handler func")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.running.Store(true)
 	return nil
 }
 
-func (s *Server) listen() {
+// Addr returns the address the server is listening on, or nil before Serve
+// was called.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops the server immediately, closing the listener and every
+// connection and cancelling in-flight requests. Use Shutdown to let them
+// finish.
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+	s.signalShutdown()
+	s.running.Store(false)
+	s.cancel()
+	err := s.closeListener()
+	s.closeAllConns()
+	return err
+}
+
+// listen runs the accept loop. Temporary Accept errors are retried with
+// exponential backoff; it returns ErrServerClosed once the server is shut
+// down, or the error that made the listener unusable.
+func (s *Server) listen(l net.Listener) error {
+	var delay time.Duration
 	for {
 		if !s.running.Load() {
-			log.Printf("server isn't running\n")
-			break
+			s.logf("server isn't running\n")
+			return ErrServerClosed
 		}
-		conn, err := s.listener.Accept()
-		log.Printf("accepted conn at addr %s", conn.RemoteAddr())
+		conn, err := l.Accept()
 		if err != nil {
-			log.Printf("error: unable to accept connection. %s\n", err.Error())
-			return
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if isTemporaryAcceptError(err) {
+				delay = nextBackoff(delay)
+				s.metrics.acceptRetries.Add(1)
+				s.errorf("ERROR: accept failed, retrying in %s. %s\n", delay, err.Error())
+				time.Sleep(delay)
+				continue
+			}
+			s.errorf("ERROR: unable to accept connection, stopping. %s\n", err.Error())
+			return fmt.Errorf("accept: %w", err)
+		}
+		delay = 0
+		s.logf("accepted conn at addr %s", conn.RemoteAddr())
+		// waiting here for a slot keeps further clients queued in the
+		// kernel's backlog
+		if ok, _ := s.connSem.acquire(s.cfg.Limits.QueueTimeout); !ok {
+			go s.shedConn(conn)
+			continue
 		}
+		if !s.trackConn(conn) {
+			s.connSem.release()
+			conn.Close()
+			continue
+		}
+		s.metrics.activeConns.Add(1)
 		go func(conn net.Conn) {
+			defer func() {
+				s.setState(conn, StateClosed)
+				conn.Close()
+				s.metrics.activeConns.Add(-1)
+				s.connSem.release()
+			}()
 			s.handle(conn)
-			log.Printf("INFO: handeled conn on addr %s, clossing.\n", conn.RemoteAddr())
+			s.logf("INFO: handeled conn on addr %s, clossing.\n", conn.RemoteAddr())
 		}(conn)
 	}
 }
 
+func (s *Server) logf(format string, args ...any) {
+	s.cfg.Logger.Printf(format, args...)
+}
+
+func (s *Server) errorf(format string, args ...any) {
+	s.cfg.ErrorLog.Printf(format, args...)
+}
+
 func (s *Server) handle(conn net.Conn) {
+	var req *request.Request
+	var w *response.Writter
 	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
 		defer cw.CloseWrite()
 	} else {
-		log.Printf("Connection doesn't implement CloseWrite method\n")
-	}
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		log.Printf("ERROR: unable to parse request\n")
-		return
-	}
-	w := response.NewWritter(conn)
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-		proxyHanlder(w, req)
-		return
+		s.errorf("Connection doesn't implement CloseWrite method\n")
 	}
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/video") {
-		handleVideo(w, req)
+	defer func() {
+		if rec := recover(); rec != nil {
+			s.recoverPanic(conn, w, req, rec)
+		}
+	}()
+	if err := s.handshake(conn); err != nil {
+		s.errorf("ERROR: TLS handshake with %s failed. %s\n", conn.RemoteAddr(), err.Error())
 		return
 	}
-
-	s.handler(w, req)
-}
-
-func proxyHanlder(w *response.Writter, r *request.Request) {
-	proxedResp, err := proxyToHttpbin(strings.TrimPrefix(r.RequestLine.RequestTarget, "/httpbin/"))
-	if err != nil {
-		log.Printf("ERROR: unable to proxy to httpbin\n")
-		return
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+		if state.NegotiatedProtocol == http2.NextProtoTLS {
+			s.serveHTTP2(conn, nil, tlsState, nil, nil)
+			return
+		}
 	}
-	buf := make([]byte, 1024)
-	err = w.WriteStatusLine(response.StatusCode(proxedResp.StatusCode))
-	if err != nil {
-		log.Printf("ERROR: %s", err.Error())
-		return
+	cr := newConnReader(conn)
+	rr := request.NewReader(cr)
+	rr.MaxHeaderBytes = s.cfg.MaxHeaderBytes
+	rr.MaxBodyBytes = s.cfg.MaxBodyBytes
+	rr.StreamBody = s.cfg.StreamRequestBody
+	t := s.getTimeouts()
+	idle := true
+	var start time.Time
+	cr.onRead = func() {
+		if idle {
+			idle = false
+			start = time.Now()
+			s.setState(conn, StateActive)
+			conn.SetReadDeadline(t.headerDeadline(start))
+		}
 	}
-	h := proxedResp.Header
-	if v := h.Get("Content-Length"); v != "" {
-		h.Del("Content-Length")
+	rr.OnHeaders = func() {
+		conn.SetReadDeadline(t.bodyDeadline(start))
 	}
-	respHeaders := headers.NewHeaders()
-	for k := range h {
-		respHeaders.Set(k, h.Get(k))
+	conn.SetReadDeadline(t.headerDeadline(time.Now()))
+	if tlsState == nil && s.h2c() {
+		sniffed, isH2 := sniffPreface(conn)
+		if isH2 {
+			s.serveHTTP2(conn, io.MultiReader(bytes.NewReader(sniffed), conn), nil, nil, nil)
+			return
+		}
+		cr.prefix = sniffed
 	}
-	respHeaders.Set("Transfer-Encoding", "chunked")
-	respHeaders.Set("Trailer", "X-Content-Sha256, X-Content-Length")
-	w.WriteHeaders(respHeaders)
-	defer proxedResp.Body.Close()
-	sumOfWrittenBytes := 0
-	var fullBody []byte
 	for {
-		n, err := proxedResp.Body.Read(buf)
+		var err error
+		req, err = rr.ReadRequest()
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				log.Printf("DEBUG: reached EOF finished processing body.")
-				_, err := w.WriteChunkedBodyDone()
-				if err != nil {
-					log.Printf("ERROR: unable to write chunked body done.\n")
-					return
-				}
-				break
+			s.readFailed(conn, err, idle)
+			return
+		}
+		req.TLS = tlsState
+		req.RemoteAddr = conn.RemoteAddr().String()
+		if !req.BodyStreamed() {
+			// a streamed body is still read under the body deadline
+			conn.SetReadDeadline(time.Time{})
+		}
+		if tlsState == nil && s.h2c() && !req.BodyStreamed() {
+			if settings, ok := h2cUpgrade(req); ok {
+				s.upgradeH2C(conn, io.MultiReader(bytes.NewReader(rr.Buffered()), cr), req, settings)
+				return
 			}
-			log.Printf("ERROR: unable to read body of response.\n")
+		}
+		if t.Write > 0 {
+			conn.SetWriteDeadline(time.Now().Add(t.Write))
+		}
+		w = response.NewWritter(conn)
+		if req.RequestLine.Method == "HEAD" {
+			w.DiscardBody()
+		}
+		w.SetHijacker(func() (net.Conn, io.Reader, error) {
+			cr.abortPendingRead()
+			conn.SetDeadline(time.Time{})
+			return conn, io.MultiReader(bytes.NewReader(rr.Buffered()), cr), nil
+		})
+		if s.shuttingDown() || wantsClose(req) {
+			w.CloseConnection()
+		}
+		if s.acquireRequest() {
+			s.serveRequest(cr, w, req)
+		} else {
+			s.shed(w)
+		}
+		if w.Hijacked() {
 			return
 		}
-		fullBody = append(fullBody, buf[:n]...)
-		log.Printf("DEBUG: read %d number of bytes from proxy body.\n", n)
-		numOfWrittenBytes, err := w.WriteChunkedBody(buf[:n])
-		if err != nil {
-			log.Printf("ERROR: unable to write chuned body.")
+		if err := w.Finish(); err != nil {
+			s.errorf("ERROR: unable to finish response. %s\n", err.Error())
+		}
+		if errors.Is(w.Err(), os.ErrDeadlineExceeded) {
+			s.metrics.writeTimeouts.Add(1)
+			s.logf("INFO: write timeout on conn %s for %s %s\n", conn.RemoteAddr(), req.RequestLine.Method, req.RequestLine.RequestTarget)
 			return
 		}
-		log.Printf("DEBUG: wrote %d number of bytes as chunked body", numOfWrittenBytes)
-		sumOfWrittenBytes += numOfWrittenBytes
+		if w.Err() != nil || !w.KeepAlive() || s.shuttingDown() {
+			return
+		}
+		idle = true
+		s.setState(conn, StateIdle)
+		t = s.getTimeouts()
+		conn.SetWriteDeadline(time.Time{})
+		conn.SetReadDeadline(t.idleDeadline(time.Now()))
 	}
+}
 
-	sha := sha256.Sum256(fullBody)
-	fullBodyLen := len(fullBody)
-	fullBodyLenStr := strconv.Itoa(fullBodyLen)
-	log.Printf("Content sha256: %s\n Len: %s", hex.EncodeToString(sha[:]), strconv.Itoa(fullBodyLen))
-	trailers := headers.NewHeaders()
-	trailers.Set("X-Content-Sha256", hex.EncodeToString(sha[:])) // Correct capitalization
-	trailers.Set("X-Content-Length", fullBodyLenStr)
-
-	err = w.WriteTrailers(trailers)
-	if err != nil {
-		log.Printf("ERROR: %s", err.Error())
-		return
+// serveRequest runs the handler for req. The caller must have acquired a
+// request slot, which is released when the handler returns.
+func (s *Server) serveRequest(cr *connReader, w *response.Writter, req *request.Request) {
+	defer s.releaseRequest()
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	req = req.WithContext(ctx)
+	if !req.BodyStreamed() {
+		// the handler reading a streamed body notices a hang-up itself
+		cr.startBackgroundRead(cancel)
 	}
-
+	defer cr.abortPendingRead()
+	s.handler(w, req)
 }
 
-func proxyToHttpbin(target string) (*http.Response, error) {
-	url := fmt.Sprintf("https://httpbin.org/%s", target)
-	r, err := http.Get(url)
-	if err != nil {
-		return nil, err
+// readFailed reacts to an error reading a request, answering the client
+// when it is still worth talking to.
+func (s *Server) readFailed(conn net.Conn, err error, idle bool) {
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		s.readTimedOut(conn, idle)
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		s.reject(conn, response.StatusHeaderTooLarge)
+	case errors.Is(err, request.ErrBodyTooLarge):
+		s.reject(conn, response.StatusContentTooLarge)
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		s.reject(conn, response.StatusNotImplemented)
+	case errors.Is(err, request.ErrMalformedRequest):
+		s.errorf("ERROR: unable to parse request. %s\n", err.Error())
+		s.reject(conn, response.StatusBadRequest)
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+	default:
+		s.errorf("ERROR: unable to read request. %s\n", err.Error())
 	}
-	return r, nil
 }
 
-func handleVideo(w *response.Writter, r *request.Request) {
-	log.Printf("Handling video for con %s", r.RequestLine.RequestTarget)
-	rawFile, err := os.ReadFile("/Users/bdimic/Library/CloudStorage/OneDrive-BlueCat/workspaces/github.com/Flarenzy/learn-http-protocol-golang/assets/vim.mp4")
-	if err != nil {
-		w.WriteStatusLine(response.StatusInternalServerError)
-		return
-	}
-	err = w.WriteStatusLine(response.StatusOk)
-	if err != nil {
-		log.Printf("ERROR: unable to write status line")
-		return
-	}
-	header := response.GetDefaultHeaders(len(rawFile))
-	header.Set("Content-Type", "video/mp4")
-	w.WriteHeaders(header)
-	_, err = w.WriteBody(rawFile)
+// reject sends a final error response on a connection whose request
+// couldn't be read.
+func (s *Server) reject(conn net.Conn, statusCode response.StatusCode) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	w := response.NewWritter(conn)
+	w.CloseConnection()
+	err := response.WriteText(w, statusCode, headers.NewHeaders(), statusCode.String()+"\n")
 	if err != nil {
-		log.Printf("ERROR: unable to write body")
-		return
+		s.errorf("ERROR: unable to write %d. %s\n", statusCode, err.Error())
 	}
-	log.Printf("Video handled successfuly.")
+}
+
+func wantsClose(req *request.Request) bool {
+	return headers.HasToken(req.Headers.Get("Connection"), "close")
 }
 
 // func writeHandlerError(w io.Writer, h HandlerError) error {
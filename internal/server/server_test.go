@@ -0,0 +1,345 @@
+package server
+
+import (
+	"context"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestContextCancelledOnDisconnect(t *testing.T) {
+	done := make(chan error, 1)
+	started := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writter, req *request.Request) {
+		close(started)
+		select {
+		case <-req.Context().Done():
+			done <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			done <- nil
+		}
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	conn.Close()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler context was not cancelled")
+	}
+}
+
+func TestRequestContextTimeoutAndValues(t *testing.T) {
+	var id string
+	var deadlineErr error
+	h := Chain(RequestID, Timeout(10*time.Millisecond))(func(w *response.Writter, req *request.Request) {
+		id = RequestIDFromContext(req.Context())
+		<-req.Context().Done()
+		deadlineErr = req.Context().Err()
+		response.WriteText(w, response.StatusOk, nil, "")
+	})
+	serve(t, h, "GET", "/")
+	assert.Len(t, id, 16)
+	assert.ErrorIs(t, deadlineErr, context.DeadlineExceeded)
+}
+
+func TestPanicRecovery(t *testing.T) {
+	hooked := make(chan any, 2)
+	s, err := Serve(0, func(w *response.Writter, req *request.Request) {
+		if req.Path() == "/late" {
+			w.WriteStatusLine(response.StatusOk)
+			w.WriteHeaders(response.GetDefaultHeaders(100))
+		}
+		panic("boom " + req.Path())
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetPanicHook(func(recovered any, stack []byte, req *request.Request) {
+		hooked <- recovered
+	})
+
+	// Test: Panic before anything was written gets a 500
+	out := roundTrip(t, s, "GET /early HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 500 Internal Server Error\r\n")
+	assert.Equal(t, "boom /early", <-hooked)
+
+	// Test: Panic mid-response aborts the connection
+	out = roundTrip(t, s, "GET /late HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 200 OK\r\n")
+	assert.NotContains(t, out, "500")
+	assert.Equal(t, "boom /late", <-hooked)
+
+	// Test: Server keeps serving after panics
+	out = roundTrip(t, s, "GET /again HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 500 Internal Server Error\r\n")
+	<-hooked
+}
+
+// roundTrip sends raw to the server and returns everything it answers
+// until the connection is closed.
+func roundTrip(t *testing.T, s *Server, raw string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	out, _ := io.ReadAll(conn)
+	return string(out)
+}
+
+func TestKeepAlive(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writter, req *request.Request) {
+		response.WriteText(w, response.StatusOk, nil, req.Path())
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Two pipelined requests on one connection, the second asks to close
+	out := roundTrip(t, s, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /two HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "/two"))
+	assert.Contains(t, out, "Connection: close\r\n")
+}
+
+func TestRequestFraming(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writter, req *request.Request) {
+		response.WriteText(w, response.StatusOk, nil, req.Path()+" "+string(req.Body))
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: a request hidden in a chunked body is not served
+	smuggled := "GET /myproblem HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	out := roundTrip(t, s, "GET /yourproblem HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		strconv.FormatInt(int64(len(smuggled)), 16)+"\r\n"+smuggled+"\r\n0\r\n\r\n"+
+		"GET /last HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"), out)
+	assert.Contains(t, out, "/yourproblem "+smuggled)
+	assert.NotContains(t, out, "/myproblem \r\n")
+	assert.True(t, strings.HasSuffix(out, "/last "), out)
+
+	// Test: Transfer-Encoding with Content-Length is refused
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+	assert.Contains(t, out, "Connection: close\r\n")
+
+	// Test: unknown transfer codings are not implemented
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip, chunked\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 501 Not Implemented\r\n"), out)
+}
+
+func TestHead(t *testing.T) {
+	rt := NewRouter()
+	rt.Get("/fixed", func(w *response.Writter, req *request.Request) {
+		response.WriteText(w, response.StatusOk, nil, "fixed body")
+	})
+	rt.Get("/chunked", func(w *response.Writter, req *request.Request) {
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(map[string]string{"Transfer-Encoding": "chunked"})
+		w.WriteChunkedBody([]byte("chunked "))
+		w.WriteChunkedBody([]byte("body"))
+		w.WriteChunkedBodyDone()
+	})
+	s, err := Serve(0, rt.ServeRequest)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: HEAD runs the GET handler but gets no body, and the connection
+	// stays usable for the next request
+	out := roundTrip(t, s, "HEAD /fixed HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"HEAD /chunked HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /fixed HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	resps := strings.Split(out, "HTTP/1.1 200 OK\r\n")
+	require.Len(t, resps, 4, out)
+	assert.Contains(t, resps[1], "Content-Length: 10\r\n")
+	assert.True(t, strings.HasSuffix(resps[1], "\r\n\r\n"), resps[1])
+	assert.Contains(t, resps[2], "Content-Length: 12\r\n")
+	assert.NotContains(t, resps[2], "Transfer-Encoding")
+	assert.True(t, strings.HasSuffix(resps[2], "\r\n\r\n"), resps[2])
+	assert.True(t, strings.HasSuffix(resps[3], "fixed body"), resps[3])
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writter, req *request.Request) {
+		if req.Path() == "/slow" {
+			close(started)
+			<-release
+		}
+		response.WriteText(w, response.StatusOk, nil, "done")
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	hookCalled := make(chan struct{})
+	s.RegisterOnShutdown(func() { close(hookCalled) })
+
+	// an idle keep-alive connection
+	idle, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+	_, err = idle.Write([]byte("GET /fast HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	_, err = idle.Read(buf)
+	require.NoError(t, err)
+
+	// an active request
+	active := make(chan string)
+	go func() {
+		active <- roundTrip(t, s, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	}()
+	<-started
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+	<-hookCalled
+
+	// Test: Idle connection gets closed while the active one is drained
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = idle.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+	select {
+	case <-shutdownErr:
+		t.Fatal("shutdown returned with an active request")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Test: Active request completes and Shutdown returns
+	close(release)
+	out := <-active
+	assert.Contains(t, out, "HTTP/1.1 200 OK\r\n")
+	assert.NoError(t, <-shutdownErr)
+
+	// Test: No new connections are accepted
+	_, err = net.Dial("tcp", s.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestShutdownNewConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tracked := make(chan struct{})
+	s, err := New(Config{
+		Listener: listener,
+		Handler: func(w *response.Writter, req *request.Request) {
+			response.WriteText(w, response.StatusOk, nil, "ok")
+		},
+		ConnState: func(conn net.Conn, state ConnState) {
+			if state == StateNew {
+				close(tracked)
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	go s.ListenAndServe()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	<-tracked
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	// Test: A connection that hasn't sent its first request is left open
+	select {
+	case <-shutdownErr:
+		t.Fatal("shutdown returned with a new connection open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Test: Its first request is served and the connection closed after it
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, string(out), "Connection: close\r\n")
+	assert.NoError(t, <-shutdownErr)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writter, req *request.Request) {
+		close(started)
+		<-req.Context().Done()
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	// Test: Deadline expires and the stuck connection is force-closed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestTimeouts(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writter, req *request.Request) {
+		response.WriteText(w, response.StatusOk, nil, "ok")
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetTimeouts(Timeouts{
+		ReadHeader: 100 * time.Millisecond,
+		Read:       time.Second,
+		Idle:       100 * time.Millisecond,
+	})
+
+	// Test: A client dribbling headers gets a 408
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHo"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	out, _ := io.ReadAll(conn)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 408 Request Timeout\r\n"))
+	assert.Contains(t, string(out), "Connection: close\r\n")
+	assert.Equal(t, uint64(1), s.Metrics().ReadTimeouts)
+
+	// Test: An idle keep-alive connection is closed without a response
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	out, _ = io.ReadAll(conn)
+	assert.Equal(t, 1, strings.Count(string(out), "HTTP/1.1"))
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, uint64(1), s.Metrics().IdleTimeouts)
+}
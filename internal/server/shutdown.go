@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// ConnState is the lifecycle state of a client connection.
+type ConnState int
+
+const (
+	// StateNew is a connection that hasn't sent any bytes yet.
+	StateNew ConnState = iota
+	// StateActive is a connection in the middle of a request.
+	StateActive
+	// StateIdle is a keep-alive connection waiting for its next request.
+	StateIdle
+	// StateClosed is a connection that has been closed.
+	StateClosed
+)
+
+func (c ConnState) String() string {
+	return [...]string{"new", "active", "idle", "closed"}[c]
+}
+
+// shutdownPollIntervalMax caps how long Shutdown waits between checks for
+// connections that went idle.
+const shutdownPollIntervalMax = 500 * time.Millisecond
+
+// RegisterOnShutdown registers fn to be run in its own goroutine when
+// Shutdown is called, e.g. to notify long-lived connections that can't be
+// drained by the server itself.
+func (s *Server) RegisterOnShutdown(fn func()) {
+	s.mu.Lock()
+	s.onShutdown = append(s.onShutdown, fn)
+	s.mu.Unlock()
+}
+
+// Shutdown stops accepting connections, closes idle ones and waits for
+// active requests to finish. If ctx expires first, the remaining
+// connections are closed forcibly and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+	s.signalShutdown()
+	s.running.Store(false)
+	err := s.closeListener()
+
+	s.mu.Lock()
+	for _, fn := range s.onShutdown {
+		go fn()
+	}
+	s.mu.Unlock()
+
+	interval := time.Millisecond
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		if s.closeIdleConns() {
+			s.cancel()
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeAllConns()
+			s.cancel()
+			return ctx.Err()
+		case <-timer.C:
+			interval = min(interval*2, shutdownPollIntervalMax)
+			timer.Reset(interval)
+		}
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+func (s *Server) signalShutdown() {
+	s.shutdownOnce.Do(func() { close(s.shutdownCh) })
+}
+
+func (s *Server) closeListener() error {
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+	if listener == nil {
+		return nil
+	}
+	err := listener.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// trackConn records conn as new. It reports false if the server is
+// already shutting down and conn should be dropped.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	if s.shuttingDown() {
+		s.mu.Unlock()
+		return false
+	}
+	s.conns[conn] = StateNew
+	s.mu.Unlock()
+	s.notifyState(conn, StateNew)
+	return true
+}
+
+func (s *Server) setState(conn net.Conn, state ConnState) {
+	s.mu.Lock()
+	changed := true
+	if state == StateClosed {
+		delete(s.conns, conn)
+	} else if old, ok := s.conns[conn]; ok && old != state {
+		s.conns[conn] = state
+	} else {
+		changed = false
+	}
+	s.mu.Unlock()
+	if changed {
+		s.notifyState(conn, state)
+	}
+}
+
+func (s *Server) notifyState(conn net.Conn, state ConnState) {
+	if s.cfg.ConnState != nil {
+		s.cfg.ConnState(conn, state)
+	}
+}
+
+// closeIdleConns closes every keep-alive connection waiting for its next
+// request and reports whether no connections are left. New connections are
+// left to send their first request, or to hit the header read timeout, as
+// the request may already be on its way.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == StateIdle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) closeAllConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"net"
+	"time"
+)
+
+// Timeouts bound how long a connection may take at each stage. A zero
+// value disables that timeout.
+type Timeouts struct {
+	// ReadHeader is the time allowed to read a request's line and
+	// headers, counted from its first byte.
+	ReadHeader time.Duration
+	// Read is the time allowed to read a whole request, body included.
+	Read time.Duration
+	// Write is the time allowed to write the response, counted from the
+	// end of reading the request.
+	Write time.Duration
+	// Idle is how long a keep-alive connection may wait for its next
+	// request. When zero, Read is used instead.
+	Idle time.Duration
+}
+
+// SetTimeouts changes the timeouts applied to connections. It may be called
+// while the server is running; it takes effect from the next request.
+func (s *Server) SetTimeouts(t Timeouts) {
+	s.timeouts.Store(&t)
+}
+
+func (s *Server) getTimeouts() Timeouts {
+	if t := s.timeouts.Load(); t != nil {
+		return *t
+	}
+	return Timeouts{}
+}
+
+func (t Timeouts) headerDeadline(start time.Time) time.Time {
+	if t.ReadHeader > 0 {
+		return start.Add(t.ReadHeader)
+	}
+	return t.bodyDeadline(start)
+}
+
+func (t Timeouts) bodyDeadline(start time.Time) time.Time {
+	if t.Read > 0 {
+		return start.Add(t.Read)
+	}
+	return time.Time{}
+}
+
+func (t Timeouts) idleDeadline(now time.Time) time.Time {
+	if t.Idle > 0 {
+		return now.Add(t.Idle)
+	}
+	return t.bodyDeadline(now)
+}
+
+// readTimedOut handles a read deadline expiring. A client that went quiet
+// between requests is simply dropped; one that stalled mid-request is told
+// so with a 408.
+func (s *Server) readTimedOut(conn net.Conn, idle bool) {
+	if idle {
+		s.metrics.idleTimeouts.Add(1)
+		s.logf("INFO: idle timeout on conn %s\n", conn.RemoteAddr())
+		return
+	}
+	s.metrics.readTimeouts.Add(1)
+	s.logf("INFO: read timeout on conn %s, sending 408\n", conn.RemoteAddr())
+	s.reject(conn, response.StatusRequestTimeout)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/http2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig turns on TLS termination.
+type TLSConfig struct {
+	// Certificates are the key pairs to serve. The one presented is
+	// picked by matching the client's SNI name against each
+	// certificate's DNS names; the first one is the fallback.
+	Certificates []CertFile
+	// MinVersion defaults to TLS 1.2.
+	MinVersion uint16
+	// CipherSuites restricts the TLS 1.2 cipher suites, nil meaning Go's
+	// defaults. TLS 1.3 suites aren't configurable.
+	CipherSuites []uint16
+	// NextProtos lists the ALPN protocols to advertise, defaulting to
+	// h2 and http/1.1 when HTTP/2 is on and http/1.1 otherwise.
+	NextProtos []string
+	// WatchInterval, if non-zero, is how often the certificate files are
+	// checked for changes and reloaded.
+	WatchInterval time.Duration
+
+	// ClientCAFiles are PEM bundles of the CAs trusted to issue client
+	// certificates. Setting them turns on mutual TLS.
+	ClientCAFiles []string
+	// ClientAuth defaults to tls.RequireAndVerifyClientCert when
+	// ClientCAFiles is set. Use tls.VerifyClientCertIfGiven to let
+	// certificate-less clients reach routes that don't need one.
+	ClientAuth tls.ClientAuthType
+}
+
+type CertFile struct {
+	CertFile string
+	KeyFile  string
+}
+
+// certStore holds the loaded certificates and swaps them on reload.
+// Established connections keep the certificate they handshook with.
+type certStore struct {
+	files []CertFile
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	byName   map[string]*tls.Certificate
+	modTimes map[string]time.Time
+}
+
+func newCertStore(files []CertFile) (*certStore, error) {
+	if len(files) == 0 {
+		return nil, errors.New("tls: no certificates configured")
+	}
+	cs := &certStore{files: files}
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// load reads every key pair from disk. If any of them fails, the
+// previously loaded set stays in use.
+func (cs *certStore) load() error {
+	certs := make([]*tls.Certificate, 0, len(cs.files))
+	byName := make(map[string]*tls.Certificate)
+	modTimes := make(map[string]time.Time)
+	for _, f := range cs.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("tls: loading %s: %w", f.CertFile, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("tls: parsing %s: %w", f.CertFile, err)
+		}
+		cert.Leaf = leaf
+		certs = append(certs, &cert)
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+		for _, path := range []string{f.CertFile, f.KeyFile} {
+			if fi, err := os.Stat(path); err == nil {
+				modTimes[path] = fi.ModTime()
+			}
+		}
+	}
+	cs.mu.Lock()
+	cs.certs = certs
+	cs.byName = byName
+	cs.modTimes = modTimes
+	cs.mu.Unlock()
+	return nil
+}
+
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := cs.byName[name]; ok {
+		return cert, nil
+	}
+	if _, rest, ok := strings.Cut(name, "."); ok {
+		if cert, ok := cs.byName["*."+rest]; ok {
+			return cert, nil
+		}
+	}
+	return cs.certs[0], nil
+}
+
+// changed reports whether any certificate or key file was modified since
+// the last load.
+func (cs *certStore) changed() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for _, f := range cs.files {
+		for _, path := range []string{f.CertFile, f.KeyFile} {
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if !fi.ModTime().Equal(cs.modTimes[path]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) buildTLSConfig() (*tls.Config, error) {
+	cfg := s.cfg.TLS
+	store, err := newCertStore(cfg.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	s.certs = store
+	minVersion := cfg.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	nextProtos := cfg.NextProtos
+	if len(nextProtos) == 0 {
+		nextProtos = []string{"http/1.1"}
+		if s.cfg.HTTP2 != nil {
+			nextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+		}
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: store.getCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   cfg.CipherSuites,
+		NextProtos:     nextProtos,
+	}
+	if len(cfg.ClientCAFiles) > 0 {
+		pool, err := loadCertPool(cfg.ClientCAFiles)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = cfg.ClientAuth
+		if tlsConfig.ClientAuth == tls.NoClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(files []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("tls: reading client CA: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("tls: no certificates found in %s", f)
+		}
+	}
+	return pool, nil
+}
+
+// ReloadCertificates re-reads the TLS certificates from disk. New
+// handshakes use the new certificates; open connections are unaffected.
+func (s *Server) ReloadCertificates() error {
+	if s.certs == nil {
+		return errors.New("tls: server has no certificates")
+	}
+	if err := s.certs.load(); err != nil {
+		return err
+	}
+	s.logf("INFO: reloaded TLS certificates\n")
+	return nil
+}
+
+func (s *Server) watchCertificates(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.certs.changed() {
+				continue
+			}
+			if err := s.ReloadCertificates(); err != nil {
+				s.errorf("ERROR: unable to reload TLS certificates. %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// handshake completes the TLS handshake on conn, if it is a TLS
+// connection, within the read header timeout.
+func (s *Server) handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	deadline := s.getTimeouts().headerDeadline(time.Now())
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+	return tlsConn.HandshakeContext(s.ctx)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/tls"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	defaultCert := newTestCert(t, nil, "default", []string{"localhost"}, false).writeFiles(t, dir, "default")
+	apiCert := newTestCert(t, nil, "api", []string{"api.example.com"}, false).writeFiles(t, dir, "api")
+	wildCert := newTestCert(t, nil, "wild", []string{"*.apps.example.com"}, false).writeFiles(t, dir, "wild")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := New(Config{
+		Listener: listener,
+		Handler: func(w *response.Writter, req *request.Request) {
+			response.WriteText(w, response.StatusOk, nil, "secure")
+		},
+		TLS: &TLSConfig{
+			Certificates:  []CertFile{defaultCert, apiCert, wildCert},
+			MinVersion:    tls.VersionTLS12,
+			WatchInterval: 10 * time.Millisecond,
+		},
+		Logger:   log.New(io.Discard, "", 0),
+		ErrorLog: log.New(io.Discard, "", 0),
+	})
+	require.NoError(t, err)
+	go s.ListenAndServe()
+	defer s.Close()
+	require.Eventually(t, func() bool { return s.Addr() != nil }, time.Second, time.Millisecond)
+
+	dial := func(serverName string) *tls.Conn {
+		conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"http/1.1"},
+		})
+		require.NoError(t, err)
+		return conn
+	}
+	peerCN := func(conn *tls.Conn) string {
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	// Test: Certificates are chosen by SNI, including wildcards
+	conn := dial("api.example.com")
+	assert.Equal(t, "api", peerCN(conn))
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+	conn.Close()
+	conn = dial("foo.apps.example.com")
+	assert.Equal(t, "wild", peerCN(conn))
+	conn.Close()
+	conn = dial("unknown.test")
+	assert.Equal(t, "default", peerCN(conn))
+
+	// Test: Requests are served over TLS
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	var got []byte
+	buf := make([]byte, 1024)
+	for !strings.HasSuffix(string(got), "secure") {
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		got = append(got, buf[:n]...)
+	}
+	assert.True(t, strings.HasPrefix(string(got), "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Changed files are picked up without dropping open connections
+	replaced := newTestCert(t, nil, "api-rotated", []string{"api.example.com"}, false).writeFiles(t, t.TempDir(), "api")
+	for _, f := range [][2]string{{replaced.CertFile, apiCert.CertFile}, {replaced.KeyFile, apiCert.KeyFile}} {
+		data, err := os.ReadFile(f[0])
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(f[1], data, 0o600))
+	}
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(apiCert.CertFile, future, future))
+	require.Eventually(t, func() bool {
+		c := dial("api.example.com")
+		defer c.Close()
+		return peerCN(c) == "api-rotated"
+	}, 2*time.Second, 20*time.Millisecond)
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	out, _ := io.ReadAll(conn)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	conn.Close()
+
+	// Test: A broken file on reload keeps the old certificates
+	require.NoError(t, os.WriteFile(apiCert.CertFile, []byte("garbage"), 0o600))
+	assert.Error(t, s.ReloadCertificates())
+	conn = dial("api.example.com")
+	assert.Equal(t, "api-rotated", peerCN(conn))
+	conn.Close()
+}
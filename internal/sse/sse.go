@@ -0,0 +1,216 @@
+// Package sse streams Server-Sent Events over a chunked response.
+package sse
+
+import (
+	"context"
+	"errors"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultHeartbeat = 15 * time.Second
+
+var (
+	ErrClosed       = errors.New("sse: stream closed")
+	ErrInvalidField = errors.New("sse: id and event must not contain line breaks")
+)
+
+// Event is a single message on the stream. Empty fields are left out;
+// Data may span several lines.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry tells the client how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+type Options struct {
+	// Heartbeat is the interval between keep-alive comments, which stop
+	// proxies from timing out an idle stream. Zero means
+	// DefaultHeartbeat, a negative value disables them.
+	Heartbeat time.Duration
+	// WriteTimeout bounds each write to the client. The server's own
+	// write timeout is lifted since the stream lives indefinitely.
+	WriteTimeout time.Duration
+}
+
+// Writer sends events to one client. It is safe for concurrent use.
+type Writer struct {
+	w           *response.Writter
+	ctx         context.Context
+	lastEventID string
+	opts        Options
+
+	mu     sync.Mutex
+	closed bool
+	err    error
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New starts an event stream on w. The caller must Close it before the
+// handler returns.
+func New(w *response.Writter, req *request.Request, opts Options) (*Writer, error) {
+	if opts.Heartbeat == 0 {
+		opts.Heartbeat = DefaultHeartbeat
+	}
+	s := &Writer{
+		w:           w,
+		ctx:         req.Context(),
+		lastEventID: req.Headers.Get("Last-Event-ID"),
+		opts:        opts,
+		stop:        make(chan struct{}),
+	}
+	if err := w.WriteStatusLine(response.StatusOk); err != nil {
+		return nil, err
+	}
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	// a HEAD response holds its headers back until flushed
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	w.SetWriteDeadline(time.Time{})
+	if opts.Heartbeat > 0 {
+		s.wg.Add(1)
+		go s.heartbeat()
+	}
+	return s, nil
+}
+
+// LastEventID returns the Last-Event-ID sent by a reconnecting client, so
+// the stream can resume after it.
+func (s *Writer) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed when the client goes away.
+func (s *Writer) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Send writes ev and flushes it to the client. Once the client is gone it
+// returns the request context's error.
+func (s *Writer) Send(ev Event) error {
+	if strings.ContainsAny(ev.ID, "\r\n\x00") || strings.ContainsAny(ev.Event, "\r\n") {
+		return ErrInvalidField
+	}
+	return s.write(appendEvent(nil, ev))
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *Writer) Comment(text string) error {
+	return s.write(appendField(nil, "", text, true))
+}
+
+func (s *Writer) write(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.ctx.Err(); err != nil {
+		s.err = err
+		return err
+	}
+	if s.opts.WriteTimeout > 0 {
+		s.w.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout))
+	}
+	if _, err := s.w.WriteChunkedBody(p); err != nil {
+		s.err = err
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+func (s *Writer) heartbeat() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opts.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.write([]byte(":\n\n")) != nil {
+				return
+			}
+		case <-s.stop:
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// Close stops the heartbeat and ends the response.
+func (s *Writer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	s.mu.Unlock()
+	s.wg.Wait()
+	if s.err != nil {
+		return s.err
+	}
+	_, err := s.w.WriteChunkedBodyDone()
+	return err
+}
+
+func appendEvent(dst []byte, ev Event) []byte {
+	if ev.ID != "" {
+		dst = appendField(dst, "id", ev.ID, false)
+	}
+	if ev.Event != "" {
+		dst = appendField(dst, "event", ev.Event, false)
+	}
+	if ev.Retry > 0 {
+		dst = appendField(dst, "retry", strconv.FormatInt(ev.Retry.Milliseconds(), 10), false)
+	}
+	if ev.Data != "" || (ev.ID == "" && ev.Event == "" && ev.Retry <= 0) {
+		dst = appendField(dst, "data", ev.Data, false)
+	}
+	return append(dst, '\n')
+}
+
+// appendField writes one "name: value" line per line of value, treating
+// CRLF, CR and LF alike. An empty name makes comment lines, and end adds
+// the blank line that terminates a block.
+func appendField(dst []byte, name, value string, end bool) []byte {
+	value = strings.ReplaceAll(value, "\r\n", "\n")
+	value = strings.ReplaceAll(value, "\r", "\n")
+	for _, line := range strings.Split(value, "\n") {
+		dst = append(dst, name...)
+		dst = append(dst, ':')
+		if line != "" {
+			dst = append(dst, ' ')
+			dst = append(dst, line...)
+		}
+		dst = append(dst, '\n')
+	}
+	if end {
+		dst = append(dst, '\n')
+	}
+	return dst
+}
@@ -0,0 +1,81 @@
+package sse
+
+import (
+	"bufio"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"github/Flarenzy/learn-http-protocol-golang/internal/server"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   Event
+		want string
+	}{
+		{"data only", Event{Data: "hello"}, "data: hello\n\n"},
+		{"all fields", Event{ID: "7", Event: "update", Data: "x", Retry: 2 * time.Second},
+			"id: 7\nevent: update\nretry: 2000\ndata: x\n\n"},
+		{"multi-line data", Event{Data: "a\nb\r\nc\rd"}, "data: a\ndata: b\ndata: c\ndata: d\n\n"},
+		{"empty lines kept", Event{Data: "a\n\nb"}, "data: a\ndata:\ndata: b\n\n"},
+		{"empty event", Event{}, "data:\n\n"},
+		{"id without data", Event{ID: "3"}, "id: 3\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, string(appendEvent(nil, tt.ev)))
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	sendErr := make(chan error, 1)
+	s, err := server.Serve(0, func(w *response.Writter, req *request.Request) {
+		stream, err := New(w, req, Options{Heartbeat: 20 * time.Millisecond})
+		require.NoError(t, err)
+		defer stream.Close()
+		assert.ErrorIs(t, stream.Send(Event{ID: "a\nb"}), ErrInvalidField)
+		require.NoError(t, stream.Send(Event{ID: "1", Event: "greeting", Data: "resumed after " + stream.LastEventID()}))
+		<-stream.Done()
+		sendErr <- stream.Send(Event{Data: "too late"})
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", "http://"+s.Addr().String()+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "41")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	// Test: event stream headers
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+
+	// Test: event is flushed with Last-Event-ID available, then heartbeats
+	br := bufio.NewReader(resp.Body)
+	var got strings.Builder
+	for !strings.Contains(got.String(), ":\n\n") {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		got.WriteString(line)
+	}
+	assert.True(t, strings.HasPrefix(got.String(), "id: 1\nevent: greeting\ndata: resumed after 41\n\n:\n\n"), got.String())
+
+	// Test: sending stops once the client disconnects
+	resp.Body.Close()
+	select {
+	case err := <-sendErr:
+		assert.Error(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler didn't notice the disconnect")
+	}
+}
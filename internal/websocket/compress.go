@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+)
+
+// deflateTail is removed from every compressed message and restored
+// before decompressing it (RFC 7692 section 7.2.1). The final empty
+// stored block after it lets the flate reader end cleanly.
+const deflateTail = "\x00\x00\xff\xff"
+
+// compressMinSize is the smallest message worth compressing.
+const compressMinSize = 128
+
+// negotiateDeflate picks the first permessage-deflate offer that can be
+// honoured and returns the extension to answer with. Context takeover is
+// turned off in both directions so every message stands alone, which
+// keeps no per-connection compression state around.
+func negotiateDeflate(header string) (string, bool) {
+	for _, offer := range strings.Split(header, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		ok := true
+		seen := map[string]bool{}
+		for _, p := range params[1:] {
+			k, v, hasValue := strings.Cut(strings.TrimSpace(p), "=")
+			k = strings.TrimSpace(k)
+			v = strings.Trim(strings.TrimSpace(v), `"`)
+			if seen[k] {
+				ok = false
+			}
+			seen[k] = true
+			switch k {
+			case "server_no_context_takeover", "client_no_context_takeover":
+				ok = ok && !hasValue
+			case "client_max_window_bits":
+				// any window the client uses is fine for decompressing
+				ok = ok && (!hasValue || validWindowBits(v))
+			case "server_max_window_bits":
+				// compress/flate always uses a 32KiB window
+				ok = ok && v == "15"
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			return "permessage-deflate; server_no_context_takeover; client_no_context_takeover", true
+		}
+	}
+	return "", false
+}
+
+func validWindowBits(v string) bool {
+	switch v {
+	case "8", "9", "10", "11", "12", "13", "14", "15":
+		return true
+	}
+	return false
+}
+
+func compressMessage(p []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte(deflateTail)), nil
+}
+
+// decompressMessage inflates p, failing with errMessageTooBig rather than
+// producing more than limit bytes.
+func decompressMessage(p []byte, limit int64) ([]byte, error) {
+	fr := flate.NewReader(io.MultiReader(
+		bytes.NewReader(p),
+		strings.NewReader(deflateTail+"\x01\x00\x00\xff\xff"),
+	))
+	defer fr.Close()
+	out, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errMessageTooBig
+	}
+	return out, nil
+}
@@ -0,0 +1,445 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the opcode of a data message.
+type MessageType byte
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+
+	maxControlPayload = 125
+)
+
+var (
+	ErrCloseSent      = errors.New("websocket: close already sent")
+	ErrControlTooLong = errors.New("websocket: control frame payload over 125 bytes")
+
+	errMessageTooBig = errors.New("websocket: message too big")
+)
+
+// Conn is an upgraded WebSocket connection. One goroutine may read while
+// others write; writes are serialized.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	subprotocol    string
+	compress       bool
+	compressLevel  int
+	maxMessageSize int64
+	maxFrameSize   int
+	closeTimeout   time.Duration
+
+	// readMu is held by ReadMessage; Close uses it to tell whether it has
+	// to read the client's close frame itself
+	readMu      sync.Mutex
+	readErr     error
+	pongHandler func(data []byte)
+
+	wmu       sync.Mutex
+	closeSent bool
+
+	closeOnce     sync.Once
+	closeReceived chan struct{}
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, opts Options) *Conn {
+	c := &Conn{
+		conn:           conn,
+		br:             br,
+		compressLevel:  opts.CompressionLevel,
+		maxMessageSize: opts.MaxMessageSize,
+		maxFrameSize:   opts.MaxFrameSize,
+		closeTimeout:   opts.CloseTimeout,
+		closeReceived:  make(chan struct{}),
+	}
+	if c.compressLevel == 0 {
+		c.compressLevel = -1 // flate.DefaultCompression
+	}
+	if c.maxMessageSize <= 0 {
+		c.maxMessageSize = DefaultMaxMessageSize
+	}
+	if c.closeTimeout <= 0 {
+		c.closeTimeout = defaultCloseTimeout
+	}
+	return c
+}
+
+// Subprotocol returns the negotiated subprotocol, if any.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Compressed reports whether permessage-deflate was negotiated.
+func (c *Conn) Compressed() bool {
+	return c.compress
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetPongHandler sets a function called from ReadMessage for every pong
+// received. It must be set before reading starts.
+func (c *Conn) SetPongHandler(fn func(data []byte)) {
+	c.pongHandler = fn
+}
+
+type frameHeader struct {
+	fin    bool
+	rsv1   bool
+	opcode byte
+	length int64
+}
+
+func isControl(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+// ReadMessage returns the next data message, answering pings and handling
+// the close handshake on the way. Once the connection is closing it
+// returns a *CloseError; any other error means the connection broke.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	return c.readMessage()
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	var (
+		msg        []byte
+		msgType    MessageType
+		compressed bool
+		started    bool
+	)
+	for {
+		h, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, c.setReadErr(err)
+		}
+		if isControl(h.opcode) {
+			if err := c.handleControl(h.opcode, payload); err != nil {
+				return 0, nil, c.setReadErr(err)
+			}
+			continue
+		}
+		switch {
+		case h.opcode == opContinuation:
+			if !started {
+				return 0, nil, c.fail(CloseProtocolError, "continuation without a message")
+			}
+			if h.rsv1 {
+				return 0, nil, c.fail(CloseProtocolError, "RSV1 set on continuation frame")
+			}
+		default:
+			if started {
+				return 0, nil, c.fail(CloseProtocolError, "new message inside a fragmented one")
+			}
+			started = true
+			msgType = MessageType(h.opcode)
+			compressed = h.rsv1
+		}
+		if int64(len(msg))+int64(len(payload)) > c.maxMessageSize {
+			return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+		}
+		msg = append(msg, payload...)
+		if !h.fin {
+			continue
+		}
+		if compressed {
+			msg, err = decompressMessage(msg, c.maxMessageSize)
+			if errors.Is(err, errMessageTooBig) {
+				return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+			}
+			if err != nil {
+				return 0, nil, c.fail(CloseInvalidPayload, "invalid compressed data")
+			}
+		}
+		if msgType == TextMessage && !utf8.Valid(msg) {
+			return 0, nil, c.fail(CloseInvalidPayload, "invalid UTF-8 in text message")
+		}
+		return msgType, msg, nil
+	}
+}
+
+// readFrame reads and unmasks one frame, checking everything that can be
+// checked without the rest of the message.
+func (c *Conn) readFrame() (frameHeader, []byte, error) {
+	var h frameHeader
+	var b [8]byte
+	if _, err := io.ReadFull(c.br, b[:2]); err != nil {
+		return h, nil, err
+	}
+	h.fin = b[0]&0x80 != 0
+	h.rsv1 = b[0]&0x40 != 0
+	h.opcode = b[0] & 0x0f
+	masked := b[1]&0x80 != 0
+	h.length = int64(b[1] & 0x7f)
+
+	if b[0]&0x30 != 0 {
+		return h, nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	if h.rsv1 && (!c.compress || isControl(h.opcode)) {
+		return h, nil, c.fail(CloseProtocolError, "RSV1 set without compression")
+	}
+	switch h.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return h, nil, c.fail(CloseProtocolError, "unknown opcode")
+	}
+	if !masked {
+		return h, nil, c.fail(CloseProtocolError, "client frame not masked")
+	}
+
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(c.br, b[:2]); err != nil {
+			return h, nil, err
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.br, b[:8]); err != nil {
+			return h, nil, err
+		}
+		if b[0]&0x80 != 0 {
+			return h, nil, c.fail(CloseProtocolError, "invalid frame length")
+		}
+		h.length = int64(binary.BigEndian.Uint64(b[:8]))
+	}
+	if isControl(h.opcode) && (!h.fin || h.length > maxControlPayload) {
+		return h, nil, c.fail(CloseProtocolError, "invalid control frame")
+	}
+	if h.length > c.maxMessageSize {
+		return h, nil, c.fail(CloseMessageTooBig, "message too big")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return h, nil, err
+	}
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return h, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i&3]
+	}
+	return h, payload, nil
+}
+
+func (c *Conn) handleControl(opcode byte, payload []byte) error {
+	switch opcode {
+	case opPing:
+		err := c.writeControl(opPong, payload)
+		if err != nil && !errors.Is(err, ErrCloseSent) {
+			return err
+		}
+	case opPong:
+		if c.pongHandler != nil {
+			c.pongHandler(payload)
+		}
+	case opClose:
+		return c.receiveClose(payload)
+	}
+	return nil
+}
+
+// receiveClose answers the client's close frame, if this side hasn't sent
+// one yet, and closes the connection: the server closes the TCP
+// connection first once the handshake is done.
+func (c *Conn) receiveClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "invalid close payload")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Text = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.ValidString(closeErr.Text) {
+			return c.fail(CloseInvalidPayload, "invalid UTF-8 in close reason")
+		}
+	}
+	echo := closeErr.Code
+	if echo == CloseNoStatusReceived {
+		echo = CloseNormalClosure
+	}
+	c.writeClose(echo, "")
+	c.closeOnce.Do(func() { close(c.closeReceived) })
+	c.conn.Close()
+	return closeErr
+}
+
+// fail sends a close frame with code and gives up on the connection, as
+// RFC 6455 requires when the client breaks the protocol.
+func (c *Conn) fail(code int, reason string) error {
+	c.writeClose(code, reason)
+	c.conn.Close()
+	return &CloseError{Code: code, Text: reason}
+}
+
+func (c *Conn) setReadErr(err error) error {
+	c.readErr = err
+	return err
+}
+
+// WriteMessage sends data as a single message, compressed if
+// permessage-deflate was negotiated and the message is large enough to
+// benefit, and split into frames if MaxFrameSize is set.
+func (c *Conn) WriteMessage(mt MessageType, data []byte) error {
+	if mt != TextMessage && mt != BinaryMessage {
+		return errors.New("websocket: invalid message type")
+	}
+	compressed := false
+	if c.compress && len(data) >= compressMinSize {
+		p, err := compressMessage(data, c.compressLevel)
+		if err != nil {
+			return err
+		}
+		data = p
+		compressed = true
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	opcode := byte(mt)
+	for {
+		frame := data
+		fin := true
+		if c.maxFrameSize > 0 && len(frame) > c.maxFrameSize {
+			frame = frame[:c.maxFrameSize]
+			fin = false
+		}
+		if err := c.writeFrameLocked(opcode, fin, compressed, frame); err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+		data = data[len(frame):]
+		opcode = opContinuation
+		compressed = false
+	}
+}
+
+// Ping sends a ping; the client's pong goes to the pong handler.
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(opPing, data)
+}
+
+func (c *Conn) writeControl(opcode byte, data []byte) error {
+	if len(data) > maxControlPayload {
+		return ErrControlTooLong
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	return c.writeFrameLocked(opcode, true, false, data)
+}
+
+func (c *Conn) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	c.closeSent = true
+	return c.writeFrameLocked(opClose, true, false, payload)
+}
+
+func (c *Conn) writeFrameLocked(opcode byte, fin, rsv1 bool, payload []byte) error {
+	buf := make([]byte, 0, 10+len(payload))
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+	buf = append(buf, b0)
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	buf = append(buf, payload...)
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// Close starts the close handshake with code and reason, waits up to the
+// close timeout for the client's answer and closes the connection. Pending
+// messages from the client are discarded if nothing else is reading.
+func (c *Conn) Close(code int, reason string) error {
+	if err := c.writeClose(code, reason); err != nil && !errors.Is(err, ErrCloseSent) {
+		c.conn.Close()
+		return err
+	}
+	if c.readMu.TryLock() {
+		c.conn.SetReadDeadline(time.Now().Add(c.closeTimeout))
+		for {
+			if _, _, err := c.readMessage(); err != nil {
+				break
+			}
+		}
+		c.readMu.Unlock()
+	} else {
+		select {
+		case <-c.closeReceived:
+		case <-time.After(c.closeTimeout):
+		}
+	}
+	if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
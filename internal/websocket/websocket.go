@@ -0,0 +1,196 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455) with the permessage-deflate extension (RFC 7692).
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github/Flarenzy/learn-http-protocol-golang/internal/headers"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaxMessageSize bounds incoming messages when Options doesn't.
+	DefaultMaxMessageSize = 1 << 20
+	// defaultCloseTimeout is how long Close waits for the client to answer
+	// the close handshake.
+	defaultCloseTimeout = 5 * time.Second
+
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// Options configures an upgraded connection. The zero value is usable.
+type Options struct {
+	// Subprotocols lists the application protocols the server speaks, in
+	// order of preference.
+	Subprotocols []string
+	// CheckOrigin decides whether a browser request from another origin
+	// may connect. By default only same-origin requests, and requests
+	// without an Origin, are allowed.
+	CheckOrigin func(req *request.Request) bool
+	// MaxMessageSize bounds a message after reassembly and decompression.
+	// Zero means DefaultMaxMessageSize.
+	MaxMessageSize int64
+	// MaxFrameSize, if non-zero, splits outgoing messages into frames of
+	// at most this many bytes.
+	MaxFrameSize int
+	// EnableCompression accepts permessage-deflate when the client offers
+	// it. CompressionLevel is passed to compress/flate and defaults to
+	// flate.DefaultCompression.
+	EnableCompression bool
+	CompressionLevel  int
+	// CloseTimeout is how long Close waits for the client's side of the
+	// close handshake. Zero means five seconds.
+	CloseTimeout time.Duration
+}
+
+// IsUpgrade reports whether req asks to switch to the WebSocket protocol.
+func IsUpgrade(req *request.Request) bool {
+	return headers.HasToken(req.Headers.Get("Upgrade"), "websocket") &&
+		headers.HasToken(req.Headers.Get("Connection"), "upgrade")
+}
+
+// Upgrade completes the opening handshake and takes over the connection.
+// If the request isn't a valid WebSocket handshake, it answers it with an
+// error status and returns an error wrapping ErrBadHandshake. The returned
+// Conn is only usable until the handler returns.
+func Upgrade(w *response.Writter, req *request.Request, opts Options) (*Conn, error) {
+	if req.RequestLine.Method != "GET" || !IsUpgrade(req) {
+		return nil, reject(w, response.StatusBadRequest, "not a websocket handshake")
+	}
+	if req.RequestLine.HttpVersion != "1.1" {
+		return nil, reject(w, response.StatusBadRequest, "websocket needs HTTP/1.1")
+	}
+	if req.Headers.Get("Sec-WebSocket-Version") != "13" {
+		h := headers.NewHeaders()
+		h.Set("Sec-WebSocket-Version", "13")
+		return nil, rejectWith(w, response.StatusUpgradeRequired, h, "unsupported websocket version")
+	}
+	key := strings.TrimSpace(req.Headers.Get("Sec-WebSocket-Key"))
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, reject(w, response.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return nil, reject(w, response.StatusForbidden, "origin not allowed")
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+	subprotocol := selectSubprotocol(req.Headers.Get("Sec-WebSocket-Protocol"), opts.Subprotocols)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	compress := false
+	if opts.EnableCompression {
+		if ext, ok := negotiateDeflate(req.Headers.Get("Sec-WebSocket-Extensions")); ok {
+			h.Set("Sec-WebSocket-Extensions", ext)
+			compress = true
+		}
+	}
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	netConn, r, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(netConn, bufio.NewReader(r), opts)
+	c.subprotocol = subprotocol
+	c.compress = compress
+	return c, nil
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func sameOrigin(req *request.Request) bool {
+	origin := req.Headers.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Headers.Get("Host"))
+}
+
+func selectSubprotocol(offered string, supported []string) string {
+	for _, s := range supported {
+		if headers.HasToken(offered, s) {
+			return s
+		}
+	}
+	return ""
+}
+
+func reject(w *response.Writter, statusCode response.StatusCode, reason string) error {
+	return rejectWith(w, statusCode, headers.NewHeaders(), reason)
+}
+
+func rejectWith(w *response.Writter, statusCode response.StatusCode, h headers.Headers, reason string) error {
+	response.WriteText(w, statusCode, h, reason+"\n")
+	return fmt.Errorf("%w: %s", ErrBadHandshake, reason)
+}
+
+// CloseError is returned by ReadMessage once the connection is closing. It
+// carries the code and reason from the client's close frame, or the ones
+// the connection was failed with.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return "websocket: close " + strconv.Itoa(e.Code)
+	}
+	return "websocket: close " + strconv.Itoa(e.Code) + ": " + e.Text
+}
+
+// Close status codes from RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	CloseAbnormalClosure  = 1006
+	CloseInvalidPayload   = 1007
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+	CloseMandatoryExt     = 1010
+	CloseInternalError    = 1011
+)
+
+// validCloseCode reports whether code may appear in a close frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
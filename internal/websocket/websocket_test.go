@@ -0,0 +1,302 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github/Flarenzy/learn-http-protocol-golang/internal/request"
+	"github/Flarenzy/learn-http-protocol-golang/internal/response"
+	"github/Flarenzy/learn-http-protocol-golang/internal/server"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient speaks the client side of the protocol over a raw connection.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func (c *testClient) writeFrame(b0 byte, payload []byte) {
+	mask := [4]byte{1, 2, 3, 4}
+	buf := []byte{b0}
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, 0x80|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 0x80|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0x80|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	buf = append(buf, mask[:]...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i&3])
+	}
+	_, err := c.conn.Write(buf)
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) readFrame() (byte, []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var hdr [2]byte
+	_, err := io.ReadFull(c.br, hdr[:])
+	require.NoError(c.t, err)
+	require.Zero(c.t, hdr[1]&0x80, "server frames must not be masked")
+	n := int(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	require.NoError(c.t, err)
+	payload := make([]byte, n)
+	_, err = io.ReadFull(c.br, payload)
+	require.NoError(c.t, err)
+	return hdr[0], payload
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+func dial(t *testing.T, addr, extraHeaders string) (*testClient, string) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\n" +
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" + extraHeaders + "\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	return &testClient{t: t, conn: conn, br: br}, head.String()
+}
+
+func echo(opts Options) server.Handler {
+	return func(w *response.Writter, req *request.Request) {
+		ws, err := Upgrade(w, req, opts)
+		if err != nil {
+			return
+		}
+		for {
+			mt, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	s, err := server.Serve(0, echo(Options{Subprotocols: []string{"chat"}, MaxMessageSize: 1024}))
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.Addr().String()
+
+	// Test: handshake answers with the accept key from RFC 6455 section 1.3
+	c, head := dial(t, addr, "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: superchat, chat\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"), head)
+	assert.Contains(t, head, "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "Sec-WebSocket-Protocol: chat\r\n")
+	assert.NotContains(t, head, "Sec-WebSocket-Extensions")
+
+	// Test: text message is echoed
+	c.writeFrame(0x81, []byte("hello"))
+	b0, p := c.readFrame()
+	assert.Equal(t, byte(0x81), b0)
+	assert.Equal(t, "hello", string(p))
+
+	// Test: fragmented binary message with a ping in the middle
+	c.writeFrame(0x02, []byte("ab"))
+	c.writeFrame(0x89, []byte("are you there"))
+	c.writeFrame(0x80, []byte("cd"))
+	b0, p = c.readFrame()
+	assert.Equal(t, byte(0x8A), b0)
+	assert.Equal(t, "are you there", string(p))
+	b0, p = c.readFrame()
+	assert.Equal(t, byte(0x82), b0)
+	assert.Equal(t, "abcd", string(p))
+
+	// Test: 16-bit length frame
+	big := bytes.Repeat([]byte("x"), 300)
+	c.writeFrame(0x82, big)
+	_, p = c.readFrame()
+	assert.Equal(t, big, p)
+
+	// Test: close handshake is echoed and the connection closed
+	c.writeFrame(0x88, closePayload(CloseNormalClosure, "bye"))
+	b0, p = c.readFrame()
+	assert.Equal(t, byte(0x88), b0)
+	assert.Equal(t, closePayload(CloseNormalClosure, ""), p)
+	_, err = c.br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: oversized messages fail the connection with 1009
+	c, _ = dial(t, addr, "Sec-WebSocket-Version: 13\r\n")
+	c.writeFrame(0x02, bytes.Repeat([]byte("x"), 1000))
+	c.writeFrame(0x80, bytes.Repeat([]byte("x"), 100))
+	b0, p = c.readFrame()
+	assert.Equal(t, byte(0x88), b0)
+	assert.Equal(t, CloseMessageTooBig, int(binary.BigEndian.Uint16(p)))
+
+	// Test: unsupported version gets 426 with the supported one
+	_, head = dial(t, addr, "Sec-WebSocket-Version: 8\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 426 Upgrade Required\r\n"), head)
+	assert.Contains(t, head, "Sec-WebSocket-Version: 13\r\n")
+
+	// Test: cross-origin requests are refused by default
+	_, head = dial(t, addr, "Sec-WebSocket-Version: 13\r\nOrigin: http://evil.example\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 403 Forbidden\r\n"), head)
+}
+
+func TestUpgradeCompression(t *testing.T) {
+	s, err := server.Serve(0, echo(Options{EnableCompression: true}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	c, head := dial(t, s.Addr().String(), "Sec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10, permessage-deflate; client_max_window_bits\r\n")
+	assert.Contains(t, head, "Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n")
+
+	// Test: compressed message in, compressed message out
+	msg := strings.Repeat("compress me please ", 20)
+	compressed, err := compressMessage([]byte(msg), -1)
+	require.NoError(t, err)
+	c.writeFrame(0xC1, compressed)
+	b0, p := c.readFrame()
+	assert.Equal(t, byte(0xC1), b0)
+	out, err := decompressMessage(p, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(out))
+
+	// Test: small messages go out uncompressed
+	c.writeFrame(0x81, []byte("hi"))
+	b0, p = c.readFrame()
+	assert.Equal(t, byte(0x81), b0)
+	assert.Equal(t, "hi", string(p))
+}
+
+func TestConnProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames func(c *testClient)
+		code   int
+	}{
+		{"unmasked frame", func(c *testClient) {
+			c.conn.Write([]byte{0x81, 0x01, 'a'})
+		}, CloseProtocolError},
+		{"reserved bit", func(c *testClient) { c.writeFrame(0xA1, []byte("a")) }, CloseProtocolError},
+		{"compressed without extension", func(c *testClient) { c.writeFrame(0xC1, []byte("a")) }, CloseProtocolError},
+		{"unknown opcode", func(c *testClient) { c.writeFrame(0x83, nil) }, CloseProtocolError},
+		{"fragmented ping", func(c *testClient) { c.writeFrame(0x09, nil) }, CloseProtocolError},
+		{"long ping", func(c *testClient) { c.writeFrame(0x89, make([]byte, 126)) }, CloseProtocolError},
+		{"stray continuation", func(c *testClient) { c.writeFrame(0x80, []byte("a")) }, CloseProtocolError},
+		{"interleaved message", func(c *testClient) {
+			c.writeFrame(0x01, []byte("a"))
+			c.writeFrame(0x81, []byte("b"))
+		}, CloseProtocolError},
+		{"invalid utf-8", func(c *testClient) { c.writeFrame(0x81, []byte{0xff, 0xfe}) }, CloseInvalidPayload},
+		{"invalid close code", func(c *testClient) { c.writeFrame(0x88, closePayload(1005, "")) }, CloseProtocolError},
+		{"frame too big", func(c *testClient) { c.writeFrame(0x82, make([]byte, 200)) }, CloseMessageTooBig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverSide, clientSide := net.Pipe()
+			defer clientSide.Close()
+			ws := newConn(serverSide, bufio.NewReader(serverSide), Options{MaxMessageSize: 128})
+			errc := make(chan error, 1)
+			go func() {
+				_, _, err := ws.ReadMessage()
+				errc <- err
+			}()
+			c := &testClient{t: t, conn: clientSide, br: bufio.NewReader(clientSide)}
+			go tt.frames(c)
+
+			b0, p := c.readFrame()
+			assert.Equal(t, byte(0x88), b0)
+			require.GreaterOrEqual(t, len(p), 2)
+			assert.Equal(t, tt.code, int(binary.BigEndian.Uint16(p)))
+			var closeErr *CloseError
+			require.ErrorAs(t, <-errc, &closeErr)
+			assert.Equal(t, tt.code, closeErr.Code)
+		})
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	ws := newConn(serverSide, bufio.NewReader(serverSide), Options{MaxFrameSize: 4})
+	c := &testClient{t: t, conn: clientSide, br: bufio.NewReader(clientSide)}
+
+	// Test: MaxFrameSize splits outgoing messages
+	go ws.WriteMessage(TextMessage, []byte("hello"))
+	b0, p := c.readFrame()
+	assert.Equal(t, byte(0x01), b0)
+	assert.Equal(t, "hell", string(p))
+	b0, p = c.readFrame()
+	assert.Equal(t, byte(0x80), b0)
+	assert.Equal(t, "o", string(p))
+
+	// Test: Close waits for the client's close frame
+	done := make(chan error, 1)
+	go func() { done <- ws.Close(CloseGoingAway, "restart") }()
+	b0, p = c.readFrame()
+	assert.Equal(t, byte(0x88), b0)
+	assert.Equal(t, closePayload(CloseGoingAway, "restart"), p)
+	c.writeFrame(0x88, closePayload(CloseGoingAway, ""))
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	assert.ErrorIs(t, ws.WriteMessage(TextMessage, []byte("late")), ErrCloseSent)
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	tests := []struct {
+		offer string
+		ok    bool
+	}{
+		{"permessage-deflate", true},
+		{"permessage-deflate; client_max_window_bits", true},
+		{"permessage-deflate; client_max_window_bits=9; server_no_context_takeover", true},
+		{"permessage-deflate; server_max_window_bits=15", true},
+		{"permessage-deflate; server_max_window_bits=12", false},
+		{"permessage-deflate; client_no_context_takeover=1", false},
+		{"permessage-deflate; unknown", false},
+		{"permessage-deflate; client_max_window_bits; client_max_window_bits", false},
+		{"x-webkit-deflate-frame", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		_, ok := negotiateDeflate(tt.offer)
+		assert.Equal(t, tt.ok, ok, tt.offer)
+	}
+}